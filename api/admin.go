@@ -0,0 +1,459 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+type AdminConfig struct {
+	Enabled    bool         `json:"enabled"`
+	Listen     string       `json:"listen"`
+	Tokens     []AdminToken `json:"tokens"`
+	AllowedIPs []string     `json:"allowedIPs"`
+}
+
+// Name of a token is recorded in audit log for every change made with it
+type AdminToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+var modules = []string{"unlocker", "payouts"}
+
+type adminHandler func(w http.ResponseWriter, r *http.Request, source string)
+
+func (s *ApiServer) listenAdmin() {
+	if len(s.config.Admin.Tokens) == 0 {
+		log.Fatal("Admin API requires at least one token")
+	}
+	allowed, err := parseAllowedIPs(s.config.Admin.AllowedIPs)
+	if err != nil {
+		log.Fatalf("Invalid admin API allowedIPs: %v", err)
+	}
+	s.adminAllowed = allowed
+	log.Printf("Starting admin API on %v", s.config.Admin.Listen)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/blacklist", s.auth(s.AdminBlacklistIndex)).Methods("GET")
+	r.HandleFunc("/admin/blacklist", s.auth(s.AdminBlacklistAdd)).Methods("POST")
+	r.HandleFunc("/admin/blacklist/{address}", s.auth(s.AdminBlacklistRemove)).Methods("DELETE")
+	r.HandleFunc("/admin/whitelist", s.auth(s.AdminWhitelistIndex)).Methods("GET")
+	r.HandleFunc("/admin/whitelist", s.auth(s.AdminWhitelistAdd)).Methods("POST")
+	r.HandleFunc("/admin/whitelist/{ip}", s.auth(s.AdminWhitelistRemove)).Methods("DELETE")
+	r.HandleFunc("/admin/bans", s.auth(s.AdminBansIndex)).Methods("GET")
+	r.HandleFunc("/admin/bans/{ip}", s.auth(s.AdminBanRemove)).Methods("DELETE")
+	r.HandleFunc("/admin/modules", s.auth(s.AdminModulesIndex)).Methods("GET")
+	r.HandleFunc("/admin/modules/{module:unlocker|payouts}/{action:pause|resume}", s.auth(s.AdminModuleControl)).Methods("POST")
+	r.HandleFunc("/admin/payments/pending", s.auth(s.AdminPendingPaymentsIndex)).Methods("GET")
+	r.HandleFunc("/admin/accounts/{login:0x[0-9a-fA-F]{40}}/balance", s.auth(s.AdminBalanceAdjust)).Methods("POST")
+	r.HandleFunc("/admin/fees", s.auth(s.AdminFeesIndex)).Methods("GET")
+	r.HandleFunc("/admin/accounts/{login:0x[0-9a-fA-F]{40}}/fee", s.auth(s.AdminFeeOverrideSet)).Methods("POST")
+	r.HandleFunc("/admin/accounts/{login:0x[0-9a-fA-F]{40}}/fee", s.auth(s.AdminFeeOverrideRemove)).Methods("DELETE")
+	r.HandleFunc("/admin/rewards/mismatches", s.auth(s.AdminRewardMismatchesIndex)).Methods("GET")
+	r.HandleFunc("/admin/rewards/mismatches/{round}/confirm", s.auth(s.AdminRewardMismatchConfirm)).Methods("POST")
+	r.HandleFunc("/admin/nodes", s.auth(s.AdminNodesIndex)).Methods("GET")
+	r.HandleFunc("/admin/audit", s.auth(s.AdminAuditIndex)).Methods("GET")
+	r.HandleFunc("/admin/consistency", s.auth(s.AdminConsistencyIndex)).Methods("GET")
+	r.HandleFunc("/admin/metrics", s.auth(s.AdminMetricsIndex)).Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	err = http.ListenAndServe(s.config.Admin.Listen, r)
+	if err != nil {
+		log.Fatalf("Failed to start admin API: %v", err)
+	}
+}
+
+func parseAllowedIPs(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// Checks IP allowlist and token, passes token's name to handler as a source for audit log
+func (s *ApiServer) auth(handler adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.adminAllowed) > 0 {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := net.ParseIP(host)
+			allowed := false
+			for _, network := range s.adminAllowed {
+				if ip != nil && network.Contains(ip) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				log.Printf("Admin API access denied for %v", host)
+				writeAdminError(w, http.StatusForbidden, "Access denied")
+				return
+			}
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		for _, v := range s.config.Admin.Tokens {
+			if len(v.Token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(v.Token)) == 1 {
+				handler(w, r, "api:"+v.Name)
+				return
+			}
+		}
+		writeAdminError(w, http.StatusUnauthorized, "Invalid token")
+	}
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminReply(w, status, map[string]string{"error": message})
+}
+
+// Writes audit entry before change, refuses to change anything if audit log is unavailable
+func (s *ApiServer) audit(w http.ResponseWriter, source, action, target, details string) bool {
+	ctx := context.Background()
+	entry := &storage.AuditEntry{Source: source, Action: action, Target: target, Details: details}
+	err := s.backend.WriteAuditEntry(ctx, entry)
+	if err != nil {
+		log.Printf("Failed to write audit entry to backend: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, "Failed to write audit entry")
+		return false
+	}
+	return true
+}
+
+func (s *ApiServer) reply(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		log.Printf("Failed to process admin request: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminReply(w, http.StatusOK, result)
+}
+
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(v)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Malformed request: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *ApiServer) AdminBlacklistIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	list, err := s.backend.GetBlacklist(ctx)
+	s.reply(w, map[string]interface{}{"blacklist": list}, err)
+}
+
+func (s *ApiServer) AdminBlacklistAdd(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	var req struct {
+		Address string `json:"address"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	address := strings.ToLower(req.Address)
+	if !util.IsValidHexAddress(address) {
+		writeAdminError(w, http.StatusBadRequest, "Invalid address")
+		return
+	}
+	if s.audit(w, source, "blacklist.add", address, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.AddToBlacklist(ctx, address))
+	}
+}
+
+func (s *ApiServer) AdminBlacklistRemove(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	address := strings.ToLower(mux.Vars(r)["address"])
+	if s.audit(w, source, "blacklist.remove", address, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.RemoveFromBlacklist(ctx, address))
+	}
+}
+
+func (s *ApiServer) AdminWhitelistIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	list, err := s.backend.GetWhitelist(ctx)
+	s.reply(w, map[string]interface{}{"whitelist": list}, err)
+}
+
+func (s *ApiServer) AdminWhitelistAdd(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	var req struct {
+		IP string `json:"ip"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if net.ParseIP(req.IP) == nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid IP")
+		return
+	}
+	if s.audit(w, source, "whitelist.add", req.IP, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.AddToWhitelist(ctx, req.IP))
+	}
+}
+
+func (s *ApiServer) AdminWhitelistRemove(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	ip := mux.Vars(r)["ip"]
+	if s.audit(w, source, "whitelist.remove", ip, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.RemoveFromWhitelist(ctx, ip))
+	}
+}
+
+func (s *ApiServer) AdminBansIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	list, err := s.backend.GetBans(ctx)
+	s.reply(w, map[string]interface{}{"bans": list}, err)
+}
+
+func (s *ApiServer) AdminBanRemove(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	ip := mux.Vars(r)["ip"]
+	if s.audit(w, source, "ban.remove", ip, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.RemoveBan(ctx, ip))
+	}
+}
+
+func (s *ApiServer) AdminModulesIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	reply := make(map[string]interface{})
+	for _, name := range modules {
+		paused, resumedAt, err := s.backend.GetModuleState(ctx, name)
+		if err != nil {
+			s.reply(w, nil, err)
+			return
+		}
+		halt, haltedAt, err := s.backend.GetModuleHalt(ctx, name)
+		if err != nil {
+			s.reply(w, nil, err)
+			return
+		}
+		reply[name] = map[string]interface{}{
+			"paused": paused, "resumedAt": resumedAt, "halted": len(halt) > 0, "halt": halt, "haltedAt": haltedAt,
+		}
+	}
+	s.reply(w, reply, nil)
+}
+
+func (s *ApiServer) AdminModuleControl(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	module, action := vars["module"], vars["action"]
+	if !s.audit(w, source, module+"."+action, "", "") {
+		return
+	}
+	var err error
+	if action == "pause" {
+		err = s.backend.PauseModule(ctx, module)
+	} else {
+		err = s.backend.ResumeModule(ctx, module)
+	}
+	s.reply(w, map[string]interface{}{"ok": true}, err)
+}
+
+func (s *ApiServer) AdminPendingPaymentsIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	payments := s.backend.GetPendingPayments(ctx)
+	locked, err := s.backend.IsPayoutsLocked(ctx)
+	s.reply(w, map[string]interface{}{"payments": payments, "locked": locked}, err)
+}
+
+func (s *ApiServer) AdminBalanceAdjust(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	var req struct {
+		Amount int64  `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if req.Amount == 0 || len(strings.TrimSpace(req.Reason)) == 0 {
+		writeAdminError(w, http.StatusBadRequest, "Amount and reason are required")
+		return
+	}
+	login := strings.ToLower(mux.Vars(r)["login"])
+	details := fmt.Sprintf("%v Shannon: %s", req.Amount, req.Reason)
+	if s.audit(w, source, "balance.adjust", login, details) {
+		err := s.backend.AdjustBalance(ctx, login, req.Amount, req.Reason)
+		if errors.Is(err, storage.ErrInsufficientBalance) {
+			writeAdminError(w, http.StatusConflict, err.Error())
+			return
+		}
+		s.reply(w, map[string]interface{}{"ok": true}, err)
+	}
+}
+
+func (s *ApiServer) AdminFeesIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	fees, err := s.backend.GetFeeSchedule(ctx)
+	if err != nil {
+		s.reply(w, nil, err)
+		return
+	}
+	overrides, err := s.backend.GetFeeOverrides(ctx)
+	s.reply(w, map[string]interface{}{"fees": fees, "overrides": overrides}, err)
+}
+
+func (s *ApiServer) AdminFeeOverrideSet(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	var req struct {
+		Fee *float64 `json:"fee"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if req.Fee == nil || *req.Fee < 0 || *req.Fee >= 100 {
+		writeAdminError(w, http.StatusBadRequest, "Fee must be >= 0 and < 100")
+		return
+	}
+	login := strings.ToLower(mux.Vars(r)["login"])
+	if s.audit(w, source, "fee.set", login, fmt.Sprintf("%v%%", *req.Fee)) {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.SetFeeOverride(ctx, login, *req.Fee))
+	}
+}
+
+func (s *ApiServer) AdminFeeOverrideRemove(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	login := strings.ToLower(mux.Vars(r)["login"])
+	if s.audit(w, source, "fee.remove", login, "") {
+		s.reply(w, map[string]interface{}{"ok": true}, s.backend.RemoveFeeOverride(ctx, login))
+	}
+}
+
+func (s *ApiServer) AdminRewardMismatchesIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	mismatches, err := s.backend.GetRewardMismatches(ctx)
+	s.reply(w, map[string]interface{}{"mismatches": mismatches}, err)
+}
+
+// Empty reward confirms computed reward, otherwise given reward in Wei is credited instead
+func (s *ApiServer) AdminRewardMismatchConfirm(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	var req struct {
+		Reward string `json:"reward"`
+	}
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	if len(req.Reward) > 0 {
+		if reward, ok := new(big.Int).SetString(req.Reward, 10); !ok || reward.Sign() < 0 {
+			writeAdminError(w, http.StatusBadRequest, "Invalid reward")
+			return
+		}
+	}
+	round := mux.Vars(r)["round"]
+	if !s.audit(w, source, "reward.confirm", round, req.Reward) {
+		return
+	}
+	found, err := s.backend.ConfirmRewardMismatch(ctx, round, req.Reward)
+	if err == nil && !found {
+		writeAdminError(w, http.StatusNotFound, "No reward mismatch for round")
+		return
+	}
+	s.reply(w, map[string]interface{}{"ok": true}, err)
+}
+
+func (s *ApiServer) AdminNodesIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	nodes, err := s.backend.GetNodeStates(ctx)
+	s.reply(w, map[string]interface{}{"nodes": nodes}, err)
+}
+
+func (s *ApiServer) AdminAuditIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	offset, limit := parsePage(r, 100)
+	entries, err := s.backend.GetAuditLog(ctx, offset, limit)
+	s.reply(w, map[string]interface{}{"audit": entries, "offset": offset, "limit": limit}, err)
+}
+
+func (s *ApiServer) AdminConsistencyIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	report, err := s.backend.GetConsistencyReport(ctx)
+	s.reply(w, map[string]interface{}{"report": report}, err)
+}
+
+// Ledger audit results in Prometheus text format
+func (s *ApiServer) AdminMetricsIndex(w http.ResponseWriter, r *http.Request, source string) {
+	ctx := r.Context()
+	report, err := s.backend.GetConsistencyReport(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch ledger audit report from backend: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if report == nil {
+		return
+	}
+
+	fmt.Fprintf(w, "# TYPE pool_ledger_audit_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "pool_ledger_audit_timestamp_seconds %d\n", report.Timestamp)
+	fmt.Fprintf(w, "# TYPE pool_ledger_audit_discrepancies gauge\n")
+	fmt.Fprintf(w, "pool_ledger_audit_discrepancies %d\n", len(report.Discrepancies))
+	fmt.Fprintf(w, "# TYPE pool_miners_funds_shannon gauge\n")
+	for field, value := range report.MinersFunds {
+		fmt.Fprintf(w, "pool_miners_funds_shannon{field=%q} %d\n", field, value)
+	}
+	fmt.Fprintf(w, "# TYPE pool_finances_shannon gauge\n")
+	for field, value := range report.Finances {
+		fmt.Fprintf(w, "pool_finances_shannon{field=%q} %d\n", field, value)
+	}
+	if report.WalletBalance != nil {
+		fmt.Fprintf(w, "# TYPE pool_wallet_balance_shannon gauge\n")
+		fmt.Fprintf(w, "pool_wallet_balance_shannon %d\n", *report.WalletBalance)
+	}
+	fmt.Fprintf(w, "# TYPE pool_ledger_discrepancy_shannon gauge\n")
+	for _, d := range report.Discrepancies {
+		fmt.Fprintf(w, "pool_ledger_discrepancy_shannon{field=%q} %d\n", d.Field, d.Actual-d.Expected)
+	}
+}
+
+// Reads offset and limit query params, limit is capped with default value
+func parsePage(r *http.Request, defaultLimit int64) (int64, int64) {
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > defaultLimit {
+		limit = defaultLimit
+	}
+	return offset, limit
+}
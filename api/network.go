@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/webchain-network/webchain-pool/payouts"
+	"github.com/webchain-network/webchain-pool/rpc"
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+type NetworkConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Daemon   string `json:"daemon"`
+	Timeout  string `json:"timeout"`
+	Interval string `json:"interval"`
+	// Number of the latest blocks block time and network hashrate are averaged over
+	Blocks int64 `json:"blocks"`
+}
+
+// Collects network stats from API's own daemon, pool's hashrate is taken from the last collected stats
+type networkCollector struct {
+	config  *NetworkConfig
+	rpc     *rpc.RPCClient
+	backend storage.Backend
+}
+
+func newNetworkCollector(cfg *NetworkConfig, backend storage.Backend) *networkCollector {
+	if cfg.Blocks < 2 {
+		cfg.Blocks = 64
+	}
+	if len(cfg.Interval) == 0 {
+		cfg.Interval = "1m"
+	}
+	return &networkCollector{
+		config:  cfg,
+		rpc:     rpc.NewRPCClient("NetworkCollector", cfg.Daemon, cfg.Timeout),
+		backend: backend,
+	}
+}
+
+func (c *networkCollector) collect(poolHashrate int64) (*storage.NetworkStats, error) {
+	pending, err := c.rpc.GetPendingBlock()
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, fmt.Errorf("Node replied with empty pending block")
+	}
+	pendingHeight, err := strconv.ParseInt(strings.Replace(pending.Number, "0x", "", -1), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	var heights []int64
+	for h := pendingHeight - 1; h >= 0 && h >= pendingHeight-c.config.Blocks; h-- {
+		heights = append(heights, h)
+	}
+	if len(heights) < 2 {
+		return nil, fmt.Errorf("Not enough blocks to estimate network stats at height %v", pendingHeight)
+	}
+	blocks, err := c.rpc.GetBlocksByHeight(heights)
+	if err != nil {
+		return nil, err
+	}
+	for i, block := range blocks {
+		if block == nil {
+			return nil, fmt.Errorf("Error while retrieving block %v from node", heights[i])
+		}
+	}
+	stats, err := convertNetworkStats(blocks, poolHashrate)
+	if err != nil {
+		return nil, err
+	}
+	stats.Timestamp = util.MakeTimestamp() / 1000
+	return stats, c.backend.WriteNetworkStats(context.Background(), stats)
+}
+
+// Blocks go from the newest one, network hashrate is difficulty solved over time span of blocks
+func convertNetworkStats(blocks []*rpc.GetBlockReply, poolHashrate int64) (*storage.NetworkStats, error) {
+	var heights, times, diffs []int64
+	for _, block := range blocks {
+		height, err := strconv.ParseInt(strings.Replace(block.Number, "0x", "", -1), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := strconv.ParseInt(strings.Replace(block.Timestamp, "0x", "", -1), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		diff, err := strconv.ParseInt(strings.Replace(block.Difficulty, "0x", "", -1), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		heights = append(heights, height)
+		times = append(times, ts)
+		diffs = append(diffs, diff)
+	}
+
+	n := len(blocks)
+	stats := &storage.NetworkStats{
+		Height:       heights[0],
+		Difficulty:   diffs[0],
+		Reward:       payouts.GetBlockReward(heights[0] + 1).String(),
+		PoolHashrate: poolHashrate,
+	}
+	span := times[0] - times[n-1]
+	if span > 0 {
+		// Work of the oldest block was done before the span
+		var work int64
+		for _, diff := range diffs[:n-1] {
+			work += diff
+		}
+		stats.Hashrate = work / span
+		stats.BlockTime = float64(span) / float64(n-1)
+	}
+	if stats.Hashrate > 0 {
+		stats.PoolShare = float64(poolHashrate) / float64(stats.Hashrate)
+	}
+	if poolHashrate > 0 {
+		stats.BlockEta = stats.Difficulty / poolHashrate
+	}
+	return stats, nil
+}
+
+// Runs apart from stats collection, so that slow daemon does not delay it
+func (s *ApiServer) startNetworkCollector() {
+	intv := util.MustParseDuration(s.network.config.Interval)
+	log.Printf("Set network stats collect interval to %v", intv)
+	timer := time.NewTimer(intv)
+	s.collectNetworkStats()
+	for range timer.C {
+		s.collectNetworkStats()
+		timer.Reset(intv)
+	}
+}
+
+func (s *ApiServer) collectNetworkStats() {
+	start := time.Now()
+	var poolHashrate int64
+	if stats := s.getStats(); stats != nil {
+		poolHashrate, _ = stats["hashrate"].(int64)
+	}
+	stats, err := s.network.collect(poolHashrate)
+	if stats != nil {
+		s.networkStats.Store(stats)
+	}
+	if err != nil {
+		log.Printf("Failed to collect network stats: %v", err)
+		return
+	}
+	log.Printf("Network stats collection finished %s", time.Since(start))
+}
+
+func (s *ApiServer) getNetworkStats() *storage.NetworkStats {
+	stats := s.networkStats.Load()
+	if stats != nil {
+		return stats.(*storage.NetworkStats)
+	}
+	return nil
+}
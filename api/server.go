@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,33 +16,45 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/webchain-network/webchain-pool/archive"
 	"github.com/webchain-network/webchain-pool/storage"
 	"github.com/webchain-network/webchain-pool/util"
 )
 
 type ApiConfig struct {
-	Enabled              bool   `json:"enabled"`
-	Listen               string `json:"listen"`
-	StatsCollectInterval string `json:"statsCollectInterval"`
-	HashrateWindow       string `json:"hashrateWindow"`
-	HashrateLargeWindow  string `json:"hashrateLargeWindow"`
-	LuckWindow           []int  `json:"luckWindow"`
-	Payments             int64  `json:"payments"`
-	Blocks               int64  `json:"blocks"`
-	PurgeOnly            bool   `json:"purgeOnly"`
-	PurgeInterval        string `json:"purgeInterval"`
-	ShowTotalHashes      bool   `json:"showTotalHashes"`
+	Enabled                  bool   `json:"enabled"`
+	Listen                   string `json:"listen"`
+	StatsCollectInterval     string `json:"statsCollectInterval"`
+	HashrateWindow           string `json:"hashrateWindow"`
+	HashrateLargeWindow      string `json:"hashrateLargeWindow"`
+	HashrateSnapshotInterval string `json:"hashrateSnapshotInterval"`
+	LuckWindow               []int  `json:"luckWindow"`
+	BlockStatsDays           int    `json:"blockStatsDays"`
+	BlockStatsInterval       string `json:"blockStatsInterval"`
+	Payments                 int64  `json:"payments"`
+	Blocks                   int64  `json:"blocks"`
+	PurgeOnly                bool   `json:"purgeOnly"`
+	PurgeInterval            string `json:"purgeInterval"`
+	ShowTotalHashes          bool   `json:"showTotalHashes"`
+
+	Admin   AdminConfig   `json:"admin"`
+	Network NetworkConfig `json:"network"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.Backend
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	adminAllowed        []*net.IPNet
+	archive             archive.Sink
+	network             *networkCollector
+	networkStats        atomic.Value
+	blockStats          atomic.Value
 }
 
 type Entry struct {
@@ -46,16 +62,24 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.Backend, archive archive.Sink) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
-	return &ApiServer{
+	s := &ApiServer{
 		config:              cfg,
 		backend:             backend,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		archive:             archive,
 	}
+	if cfg.Network.Enabled {
+		s.network = newNetworkCollector(&cfg.Network, backend)
+	}
+	if len(cfg.BlockStatsInterval) == 0 {
+		cfg.BlockStatsInterval = "10m"
+	}
+	return s
 }
 
 func (s *ApiServer) Start() {
@@ -73,6 +97,17 @@ func (s *ApiServer) Start() {
 	purgeTimer := time.NewTimer(purgeIntv)
 	log.Printf("Set purge interval to %v", purgeIntv)
 
+	// Charts are disabled without snapshot interval
+	var snapshotIntv time.Duration
+	var snapshotTimer *time.Timer
+	var snapshotC <-chan time.Time
+	if len(s.config.HashrateSnapshotInterval) > 0 {
+		snapshotIntv = util.MustParseDuration(s.config.HashrateSnapshotInterval)
+		snapshotTimer = time.NewTimer(untilSnapshot(snapshotIntv))
+		snapshotC = snapshotTimer.C
+		log.Printf("Set hashrate snapshot interval to %v", snapshotIntv)
+	}
+
 	sort.Ints(s.config.LuckWindow)
 
 	if s.config.PurgeOnly {
@@ -93,10 +128,22 @@ func (s *ApiServer) Start() {
 			case <-purgeTimer.C:
 				s.purgeStale()
 				purgeTimer.Reset(purgeIntv)
+			case <-snapshotC:
+				s.snapshotHashrate(snapshotIntv)
+				snapshotTimer.Reset(untilSnapshot(snapshotIntv))
 			}
 		}
 	}()
 
+	if s.config.Admin.Enabled {
+		go s.listenAdmin()
+	}
+	if s.network != nil && !s.config.PurgeOnly {
+		go s.startNetworkCollector()
+	}
+	if s.config.BlockStatsDays > 0 && !s.config.PurgeOnly {
+		go s.startBlockStatsCollector()
+	}
 	if !s.config.PurgeOnly {
 		s.listen()
 	}
@@ -107,8 +154,14 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/apietc/stats", s.StatsIndex)
 	r.HandleFunc("/apietc/miners", s.MinersIndex)
 	r.HandleFunc("/apietc/blocks", s.BlocksIndex)
+	r.HandleFunc("/apietc/blocks/stats", s.BlockStatsIndex)
+	r.HandleFunc("/apietc/charts", s.ChartsIndex)
+	r.HandleFunc("/apietc/network", s.NetworkIndex)
 	r.HandleFunc("/apietc/payments", s.PaymentsIndex)
 	r.HandleFunc("/apietc/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/apietc/accounts/{login:0x[0-9a-fA-F]{40}}/ledger", s.LedgerIndex)
+	r.HandleFunc("/apietc/accounts/{login:0x[0-9a-fA-F]{40}}/payments", s.AccountPaymentsIndex)
+	r.HandleFunc("/apietc/accounts/{login:0x[0-9a-fA-F]{40}}/charts", s.AccountChartsIndex)
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -124,8 +177,9 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) purgeStale() {
+	ctx := context.Background()
 	start := time.Now()
-	total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
+	total, err := s.backend.FlushStaleStats(ctx, s.hashrateWindow, s.hashrateLargeWindow)
 	if err != nil {
 		log.Println("Failed to purge stale data from backend:", err)
 	} else {
@@ -133,32 +187,86 @@ func (s *ApiServer) purgeStale() {
 	}
 }
 
+// Snapshots are aligned to interval, so that all API instances try to write the same one
+func untilSnapshot(intv time.Duration) time.Duration {
+	return intv - time.Duration(time.Now().UnixNano())%intv + time.Second
+}
+
+func (s *ApiServer) snapshotHashrate(intv time.Duration) {
+	start := time.Now()
+	written, err := s.backend.WriteHashrateSnapshot(context.Background(), s.hashrateWindow, intv)
+	if err != nil {
+		log.Printf("Failed to write hashrate snapshot to backend: %v", err)
+	} else if written {
+		log.Printf("Hashrate snapshot written, elapsed time %v", time.Since(start))
+	}
+}
+
 func (s *ApiServer) collectStats() {
+	ctx := context.Background()
 	start := time.Now()
-	stats, err := s.backend.CollectStats(s.hashrateWindow, s.config.Blocks, s.config.Payments)
+	stats, err := s.backend.CollectStats(ctx, s.hashrateWindow, s.config.Blocks, s.config.Payments)
 	if err != nil {
 		log.Printf("Failed to fetch stats from backend: %v", err)
 		return
 	}
+	// Round effort stays 0 without node's difficulty, the rest of stats doesn't depend on it
+	nodes, err := s.backend.GetNodeStates(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch nodes stats from backend: %v", err)
+	}
+	poolStats, _ := stats["stats"].(map[string]interface{})
+	stats["roundEffort"] = currentRoundEffort(poolStats, nodes)
 	if len(s.config.LuckWindow) > 0 {
-		stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
+		stats["luck"], err = s.backend.CollectLuckStats(ctx, s.config.LuckWindow)
 		if err != nil {
 			log.Printf("Failed to fetch luck stats from backend: %v", err)
 			return
 		}
 	}
+	// Fee schedule and unlocker state are left out if they can't be read, the rest of stats doesn't depend on them
+	if fees, err := s.backend.GetFeeSchedule(ctx); err != nil {
+		log.Printf("Failed to fetch fee schedule from backend: %v", err)
+	} else {
+		stats["fees"] = fees
+	}
+	// Reason of halt is shown in admin API only
+	if halt, haltedAt, err := s.backend.GetModuleHalt(ctx, "unlocker"); err != nil {
+		log.Printf("Failed to fetch unlocker state from backend: %v", err)
+	} else {
+		stats["unlocker"] = map[string]interface{}{"halted": len(halt) > 0, "haltedAt": haltedAt}
+	}
 	s.stats.Store(stats)
 	log.Printf("Stats collection finished %s", time.Since(start))
 }
 
+// Shares of current round to network difficulty reported by the highest node, 0 until a node reports
+func currentRoundEffort(stats map[string]interface{}, nodes []map[string]interface{}) float64 {
+	roundShares, _ := stats["roundShares"].(int64)
+	var height int64
+	var difficulty float64
+	for _, node := range nodes {
+		h, _ := strconv.ParseInt(fmt.Sprint(node["height"]), 10, 64)
+		if h > height {
+			height = h
+			difficulty, _ = strconv.ParseFloat(fmt.Sprint(node["difficulty"]), 64)
+		}
+	}
+	if difficulty <= 0 {
+		return 0
+	}
+	return float64(roundShares) / difficulty
+}
+
 func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
-	nodes, err := s.backend.GetNodeStates()
+	nodes, err := s.backend.GetNodeStates(ctx)
 	if err != nil {
 		log.Printf("Failed to get nodes stats from backend: %v", err)
 	}
@@ -173,6 +281,12 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["maturedTotal"] = stats["maturedTotal"]
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
+		reply["fees"] = stats["fees"]
+		reply["unlocker"] = stats["unlocker"]
+		reply["roundEffort"] = stats["roundEffort"]
+	}
+	if network := s.getNetworkStats(); network != nil {
+		reply["network"] = network
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -206,6 +320,18 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
+
+	if isPaged(r) {
+		offset, limit := parsePage(r, s.config.Blocks)
+		entries, total, err := s.getHistory(r.Context(), "blocks:matured", offset, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Failed to fetch blocks history: %v", err)
+			return
+		}
+		s.writePage(w, map[string]interface{}{"matured": storage.DecodeBlocks(entries), "maturedTotal": total, "offset": offset, "limit": limit})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
@@ -218,6 +344,59 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 		reply["candidates"] = stats["candidates"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
 		reply["luck"] = stats["luck"]
+		reply["roundEffort"] = stats["roundEffort"]
+		if poolStats, ok := stats["stats"].(map[string]interface{}); ok {
+			reply["roundStart"] = poolStats["roundStart"]
+		}
+	}
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Block stats scan matured blocks, so they are collected apart from and less often than the rest of stats
+func (s *ApiServer) startBlockStatsCollector() {
+	intv := util.MustParseDuration(s.config.BlockStatsInterval)
+	log.Printf("Set block stats collect interval to %v", intv)
+	timer := time.NewTimer(intv)
+	s.collectBlockStats()
+	for range timer.C {
+		s.collectBlockStats()
+		timer.Reset(intv)
+	}
+}
+
+func (s *ApiServer) collectBlockStats() {
+	start := time.Now()
+	stats, err := s.backend.CollectBlockStats(context.Background(), s.config.BlockStatsDays)
+	if err != nil {
+		log.Printf("Failed to fetch block stats from backend: %v", err)
+		return
+	}
+	s.blockStats.Store(stats)
+	log.Printf("Block stats collection finished %s", time.Since(start))
+}
+
+func (s *ApiServer) getBlockStats() *storage.BlockStats {
+	stats := s.blockStats.Load()
+	if stats != nil {
+		return stats.(*storage.BlockStats)
+	}
+	return nil
+}
+
+// Daily orphan and uncle rates with propagation delay, in total and by upstream
+func (s *ApiServer) BlockStatsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	if stats := s.getBlockStats(); stats != nil {
+		reply["blockStats"] = stats
 	}
 
 	err := json.NewEncoder(w).Encode(reply)
@@ -226,10 +405,97 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var chartPeriods = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// Pool's hashrate, shares, miners and workers over period of 24h, 7d or 30d
+func (s *ApiServer) ChartsIndex(w http.ResponseWriter, r *http.Request) {
+	s.writeChart(w, r, "")
+}
+
+// Miner's and workers' hashrate and shares over period of 24h, 7d or 30d
+func (s *ApiServer) AccountChartsIndex(w http.ResponseWriter, r *http.Request) {
+	s.writeChart(w, r, strings.ToLower(mux.Vars(r)["login"]))
+}
+
+func (s *ApiServer) writeChart(w http.ResponseWriter, r *http.Request, login string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	name := r.URL.Query().Get("period")
+	if len(name) == 0 {
+		name = "24h"
+	}
+	period, ok := chartPeriods[name]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	points, err := s.backend.GetHashrateChart(r.Context(), login, period)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch chart from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	reply := map[string]interface{}{"period": name, "points": points}
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Current network stats and their history over period of 24h, 7d or 30d
+func (s *ApiServer) NetworkIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	name := r.URL.Query().Get("period")
+	if len(name) == 0 {
+		name = "24h"
+	}
+	period, ok := chartPeriods[name]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	history, err := s.backend.GetNetworkHistory(r.Context(), period)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch network history from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	reply := map[string]interface{}{"period": name, "network": s.getNetworkStats(), "history": history}
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
 func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
+
+	if isPaged(r) {
+		offset, limit := parsePage(r, s.config.Payments)
+		entries, total, err := s.getHistory(r.Context(), "payments:all", offset, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Failed to fetch payments history: %v", err)
+			return
+		}
+		s.writePage(w, map[string]interface{}{"payments": storage.DecodePayments(entries), "paymentsTotal": total, "offset": offset, "limit": limit})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 
 	reply := make(map[string]interface{})
@@ -246,6 +512,7 @@ func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -259,7 +526,7 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	cacheIntv := int64(s.statsIntv / time.Millisecond)
 	// Refresh stats if stale
 	if !ok || reply.updatedAt < now-cacheIntv {
-		exist, err := s.backend.IsMinerExists(login)
+		exist, err := s.backend.IsMinerExists(ctx, login)
 		if !exist {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -270,13 +537,13 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		stats, err := s.backend.GetMinerStats(login, s.config.Payments)
+		stats, err := s.backend.GetMinerStats(ctx, login, s.config.Payments)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Failed to fetch stats from backend: %v", err)
 			return
 		}
-		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login, s.config.ShowTotalHashes)
+		workers, err := s.backend.CollectWorkersStats(ctx, s.hashrateWindow, s.hashrateLargeWindow, login, s.config.ShowTotalHashes)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Failed to fetch stats from backend: %v", err)
@@ -286,6 +553,13 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			stats[key] = value
 		}
 		stats["pageSize"] = s.config.Payments
+		stats["blocks"] = s.getMinerBlocks(login)
+		stats["fee"], err = s.getMinerFee(ctx, login)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Failed to fetch fees from backend: %v", err)
+			return
+		}
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
 	}
@@ -297,6 +571,122 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *ApiServer) LedgerIndex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	offset, limit := parsePage(r, s.config.Payments)
+	ledger, err := s.backend.GetLedger(ctx, login, offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch ledger from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	reply := map[string]interface{}{"ledger": ledger, "offset": offset, "limit": limit}
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) AccountPaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	offset, limit := parsePage(r, s.config.Payments)
+	entries, total, err := s.getHistory(r.Context(), storage.MinerPaymentsKey(login), offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch payments history: %v", err)
+		return
+	}
+	s.writePage(w, map[string]interface{}{"payments": storage.DecodePayments(entries), "paymentsTotal": total, "offset": offset, "limit": limit})
+}
+
+// Page of history is read from Redis first and continues into archive past the oldest entry kept in Redis,
+// number of archived entries is counted by backend, so archive is read only for pages past Redis
+func (s *ApiServer) getHistory(ctx context.Context, key string, offset, limit int64) ([]*storage.HistoryEntry, int64, error) {
+	entries, total, err := s.backend.GetHistory(ctx, key, offset, limit)
+	if err != nil || s.archive == nil {
+		return entries, total, err
+	}
+	archived, _, err := s.backend.GetArchivedCount(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n := int64(len(entries)); n < limit && offset+n < total+archived {
+		rest, err := s.archive.Read(key, offset+n-total, limit-n)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, rest...)
+	}
+	return entries, total + archived, nil
+}
+
+func isPaged(r *http.Request) bool {
+	q := r.URL.Query()
+	return len(q.Get("offset")) > 0 || len(q.Get("limit")) > 0
+}
+
+func (s *ApiServer) writePage(w http.ResponseWriter, reply map[string]interface{}) {
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Fee applied to miner's rewards, nil until unlocker published fee schedule
+func (s *ApiServer) getMinerFee(ctx context.Context, login string) (interface{}, error) {
+	stats := s.getStats()
+	if stats == nil {
+		return nil, nil
+	}
+	fees, _ := stats["fees"].(*storage.FeeSchedule)
+	if fees == nil {
+		return nil, nil
+	}
+	overrides, err := s.backend.GetFeeOverrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hashrate := int64(0)
+	if _, ok := overrides[login]; !ok && len(fees.Tiers) > 0 {
+		hashrates, err := s.backend.GetMinersHashrate(ctx, []string{login}, util.MustParseDuration(fees.TierWindow))
+		if err != nil {
+			return nil, err
+		}
+		hashrate = hashrates[login]
+	}
+	return fees.MinerFee(overrides, login, hashrate), nil
+}
+
+// Recent blocks found by miner, taken from cached pool's blocks newest first
+func (s *ApiServer) getMinerBlocks(login string) []*storage.BlockData {
+	result := []*storage.BlockData{}
+	stats := s.getStats()
+	if stats == nil {
+		return result
+	}
+	for _, key := range []string{"candidates", "immature", "matured"} {
+		blocks, _ := stats[key].([]*storage.BlockData)
+		for _, block := range blocks {
+			if block.Finder == login {
+				result = append(result, block)
+			}
+		}
+	}
+	return result
+}
+
 func (s *ApiServer) getStats() map[string]interface{} {
 	stats := s.stats.Load()
 	if stats != nil {
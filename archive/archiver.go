@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+type Config struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Entries older than this are moved out of Redis
+	MaxAge string `json:"maxAge"`
+	// "jsonl" writes flat files into Path, "sql" writes into PostgreSQL database at Url
+	Format string `json:"format"`
+	Path   string `json:"path"`
+	Url    string `json:"url"`
+}
+
+// Append-only store of history entries moved out of Redis
+type Sink interface {
+	// Entries already archived are skipped
+	Append(key string, entries []*storage.HistoryEntry) error
+	// Returns page of archived entries newest first
+	Read(key string, offset, limit int64) ([]*storage.HistoryEntry, error)
+	Count(key string) (int64, error)
+	Close() error
+}
+
+func NewSink(cfg *Config) (Sink, error) {
+	switch cfg.Format {
+	case "jsonl", "":
+		return NewFileSink(cfg.Path)
+	case "sql":
+		return NewSQLSink(cfg.Url)
+	}
+	return nil, fmt.Errorf("Unknown archive format: %s", cfg.Format)
+}
+
+type Archiver struct {
+	config  *Config
+	backend storage.Backend
+	sink    Sink
+	maxAge  time.Duration
+}
+
+// Entries are read and removed in batches to keep Redis responsive
+const archiveBatch = 100
+
+func NewArchiver(cfg *Config, backend storage.Backend, sink Sink) *Archiver {
+	return &Archiver{config: cfg, backend: backend, sink: sink, maxAge: util.MustParseDuration(cfg.MaxAge)}
+}
+
+func (a *Archiver) Start() {
+	log.Println("Starting history archiver")
+
+	intv := util.MustParseDuration(a.config.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set archive interval to %v, archiving entries older than %v", intv, a.maxAge)
+
+	a.archive()
+	timer.Reset(intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				a.archive()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (a *Archiver) archive() {
+	total, err := a.Run(context.Background())
+	if err != nil {
+		log.Printf("Failed to archive history: %v", err)
+	}
+	if total > 0 {
+		log.Printf("Archived %v history entries", total)
+	}
+}
+
+// Runs single archive pass over pool's and miners' history, used by "archive run" command
+func (a *Archiver) Run(ctx context.Context) (int64, error) {
+	cutoff := util.MakeTimestamp()/1000 - int64(a.maxAge/time.Second)
+	keys := append([]string{}, storage.HistoryKeys...)
+	logins, err := a.backend.GetPayees(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, login := range logins {
+		keys = append(keys, storage.MinerPaymentsKey(login))
+	}
+
+	total := int64(0)
+	for _, key := range keys {
+		n, err := a.archiveKey(ctx, key, cutoff)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return total, nil
+}
+
+// Entries are removed from Redis only after archive accepted them, so crash in between never loses history.
+// Archive skips entries it already has when they are appended again.
+func (a *Archiver) archiveKey(ctx context.Context, key string, cutoff int64) (int64, error) {
+	if err := a.countArchived(ctx, key); err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for {
+		entries, err := a.backend.GetOldestHistory(ctx, key, archiveBatch)
+		if err != nil {
+			return total, err
+		}
+		n := 0
+		for n < len(entries) && entries[n].Timestamp < cutoff {
+			n++
+		}
+		if n == 0 {
+			return total, nil
+		}
+		if err := a.sink.Append(key, entries[:n]); err != nil {
+			return total, err
+		}
+		if err := a.backend.RemoveHistory(ctx, key, entries[:n]); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if n < len(entries) {
+			return total, nil
+		}
+	}
+}
+
+// Backend counts entries as they are removed, entries archived before that are counted once from archive
+func (a *Archiver) countArchived(ctx context.Context, key string) error {
+	if _, ok, err := a.backend.GetArchivedCount(ctx, key); err != nil || ok {
+		return err
+	}
+	n, err := a.sink.Count(key)
+	if err != nil {
+		return err
+	}
+	return a.backend.SetArchivedCount(ctx, key, n)
+}
@@ -0,0 +1,77 @@
+package archive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+func TestArchiveRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	backend := storage.NewMemoryBackend()
+	backend.AdjustBalance(ctx, "0xa", 3000, "test")
+	for _, tx := range []string{"0x1", "0x2", "0x3"} {
+		backend.UpdateBalance(ctx, "0xa", 1000)
+		backend.WritePayment(ctx, "0xa", tx, 1000)
+	}
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewArchiver(&Config{MaxAge: "1h"}, backend, sink)
+	if total, _ := a.Run(ctx); total != 0 {
+		t.Errorf("Must not archive recent entries: %v", total)
+	}
+
+	a = NewArchiver(&Config{MaxAge: "-1h"}, backend, sink)
+	total, err := a.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 6 {
+		t.Errorf("Must archive pool's and miner's payments: %v", total)
+	}
+	if _, count, _ := backend.GetHistory(ctx, "payments:all", 0, 10); count != 0 {
+		t.Errorf("Must remove archived entries from backend: %v", count)
+	}
+	if n, _ := sink.Count(storage.MinerPaymentsKey("0xa")); n != 3 {
+		t.Errorf("Must append archived entries: %v", n)
+	}
+	if n, _, _ := backend.GetArchivedCount(ctx, storage.MinerPaymentsKey("0xa")); n != 3 {
+		t.Errorf("Must count archived entries in backend: %v", n)
+	}
+
+	// Append repeated after a crash must not duplicate entries
+	page, _ := sink.Read(storage.MinerPaymentsKey("0xa"), 0, 10)
+	if err := sink.Append(storage.MinerPaymentsKey("0xa"), page[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sink.Count(storage.MinerPaymentsKey("0xa")); n != 3 {
+		t.Errorf("Must skip entries already archived: %v", n)
+	}
+
+	// Lost index is rebuilt from archive
+	os.Remove(sink.indexPath("payments:all"))
+	page, _ = sink.Read("payments:all", 0, 2)
+	payments := storage.DecodePayments(page)
+	if len(payments) != 2 || payments[0]["tx"] != "0x3" || payments[1]["tx"] != "0x2" {
+		t.Errorf("Must read archive newest first: %v", payments)
+	}
+	page, _ = sink.Read("payments:all", 2, 10)
+	if payments := storage.DecodePayments(page); len(payments) != 1 || payments[0]["tx"] != "0x1" {
+		t.Errorf("Must skip offset: %v", payments)
+	}
+	if page, _ := sink.Read("payments:x", 0, 10); len(page) != 0 {
+		t.Errorf("Must return empty page for missing file: %+v", page)
+	}
+}
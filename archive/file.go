@@ -0,0 +1,289 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+// Keeps every history key in its own JSON Lines file, oldest entries first.
+// Offset of every line is kept in index file next to it, so pages are read without parsing the whole file.
+type FileSink struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// Size of line offset in index file, offsets are big endian
+const offsetSize = 8
+
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+func (s *FileSink) path(key string) string {
+	return filepath.Join(s.dir, strings.Replace(key, ":", "_", -1)+".jsonl")
+}
+
+func (s *FileSink) indexPath(key string) string {
+	return s.path(key) + ".idx"
+}
+
+// Entries already archived are skipped, so append repeated after a crash doesn't duplicate them
+func (s *FileSink) Append(key string, entries []*storage.HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, end, err := s.syncIndex(key)
+	if err != nil {
+		return err
+	}
+	entries, err = s.skipArchived(key, count, entries)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(key), os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	// Drop partial line left by a crash in the middle of write
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	w := bufio.NewWriter(f)
+	offsets := make([]byte, 0, len(entries)*offsetSize)
+	pos := end
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		offsets = appendOffset(offsets, pos)
+		w.Write(data)
+		w.WriteByte('\n')
+		pos += int64(len(data)) + 1
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	// Entries are removed from Redis right after append, must be on disk by then
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.appendIndex(key, offsets)
+}
+
+func (s *FileSink) appendIndex(key string, offsets []byte) error {
+	f, err := os.OpenFile(s.indexPath(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(offsets); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns number of indexed lines and end of the last complete line. Lines written after the last indexed one,
+// by a crash between data and index writes or by version without index, are indexed first.
+func (s *FileSink) syncIndex(key string) (int64, int64, error) {
+	data, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer data.Close()
+
+	count := int64(0)
+	if info, err := os.Stat(s.indexPath(key)); err == nil {
+		count = info.Size() / offsetSize
+		// Partial offset left by a crash is cut off
+		if info.Size()%offsetSize != 0 {
+			if err := os.Truncate(s.indexPath(key), count*offsetSize); err != nil {
+				return 0, 0, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+
+	end := int64(0)
+	if count > 0 {
+		offsets, err := s.readOffsets(key, count-1, 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		line, err := readLine(data, offsets[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		end = offsets[0] + int64(len(line))
+	}
+
+	var missing []byte
+	r := bufio.NewReader(io.NewSectionReader(data, end, 1<<62))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, err
+		}
+		missing = appendOffset(missing, end)
+		end += int64(len(line))
+	}
+	if len(missing) > 0 {
+		if err := s.appendIndex(key, missing); err != nil {
+			return 0, 0, err
+		}
+		count += int64(len(missing) / offsetSize)
+	}
+	return count, end, nil
+}
+
+func appendOffset(buf []byte, offset int64) []byte {
+	var b [offsetSize]byte
+	binary.BigEndian.PutUint64(b[:], uint64(offset))
+	return append(buf, b[:]...)
+}
+
+func (s *FileSink) readOffsets(key string, from, n int64) ([]int64, error) {
+	f, err := os.Open(s.indexPath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, n*offsetSize)
+	if _, err := f.ReadAt(buf, from*offsetSize); err != nil {
+		return nil, err
+	}
+	result := make([]int64, n)
+	for i := range result {
+		result[i] = int64(binary.BigEndian.Uint64(buf[i*offsetSize:]))
+	}
+	return result, nil
+}
+
+func readLine(f *os.File, offset int64) ([]byte, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(f, offset, 1<<62)).ReadBytes('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	return line, err
+}
+
+// Returns entries of lines from..from+n-1, oldest first
+func (s *FileSink) readEntries(key string, from, n int64) ([]*storage.HistoryEntry, error) {
+	offsets, err := s.readOffsets(key, from, n)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make([]*storage.HistoryEntry, 0, n)
+	for _, offset := range offsets {
+		line, err := readLine(f, offset)
+		if err != nil {
+			return nil, err
+		}
+		entry := &storage.HistoryEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// Archive is appended in order of score, so only its tail may hold entries of a repeated append
+func (s *FileSink) skipArchived(key string, count int64, entries []*storage.HistoryEntry) ([]*storage.HistoryEntry, error) {
+	if count == 0 || len(entries) == 0 {
+		return entries, nil
+	}
+	archived := make(map[string]bool)
+	for i := count - 1; i >= 0; i-- {
+		tail, err := s.readEntries(key, i, 1)
+		if err != nil {
+			return nil, err
+		}
+		if tail[0].Score < entries[0].Score {
+			break
+		}
+		archived[tail[0].Member] = true
+	}
+	var result []*storage.HistoryEntry
+	for _, e := range entries {
+		if !archived[e.Member] {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (s *FileSink) Read(key string, offset, limit int64) ([]*storage.HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []*storage.HistoryEntry{}
+	count, _, err := s.syncIndex(key)
+	if err != nil || offset >= count || limit <= 0 {
+		return result, err
+	}
+	last := count - 1 - offset
+	first := last - limit + 1
+	if first < 0 {
+		first = 0
+	}
+	entries, err := s.readEntries(key, first, last-first+1)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		result = append(result, entries[i])
+	}
+	return result, nil
+}
+
+func (s *FileSink) Count(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, _, err := s.syncIndex(key)
+	return count, err
+}
+
+func (s *FileSink) Close() error {
+	return nil
+}
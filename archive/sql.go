@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+// Keeps archived history in PostgreSQL table, duplicates of already archived entries are ignored
+type SQLSink struct {
+	db *sql.DB
+}
+
+const archiveSchema = `CREATE TABLE IF NOT EXISTS archive (
+	key TEXT NOT NULL,
+	score DOUBLE PRECISION NOT NULL,
+	member TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	PRIMARY KEY (key, member)
+)`
+
+const archiveIndex = `CREATE INDEX IF NOT EXISTS archive_key_score_idx ON archive (key, score)`
+
+func NewSQLSink(url string) (*SQLSink, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range []string{archiveSchema, archiveIndex} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Failed to create archive schema: %v", err)
+		}
+	}
+	return &SQLSink{db: db}, nil
+}
+
+func (s *SQLSink) Append(key string, entries []*storage.HistoryEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		_, err := tx.Exec(`INSERT INTO archive (key, score, member, timestamp) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+			key, e.Score, e.Member, e.Timestamp)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLSink) Read(key string, offset, limit int64) ([]*storage.HistoryEntry, error) {
+	rows, err := s.db.Query(`SELECT score, member, timestamp FROM archive WHERE key = $1 ORDER BY score DESC, member DESC OFFSET $2 LIMIT $3`,
+		key, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*storage.HistoryEntry{}
+	for rows.Next() {
+		e := &storage.HistoryEntry{Key: key}
+		if err := rows.Scan(&e.Score, &e.Member, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLSink) Count(key string) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM archive WHERE key = $1`, key).Scan(&n)
+	return n, err
+}
+
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
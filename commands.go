@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/webchain-network/webchain-pool/archive"
+	"github.com/webchain-network/webchain-pool/payouts"
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+// Operator's command, e.g. "balance adjust <login> <amount> <reason>"
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"payouts": {
+		"resolve": {"", resolvePayoutsCmd},
+	},
+	"balance": {
+		"show":   {"<login>", showBalanceCmd},
+		"adjust": {"<login> <amount in Shannon> <reason>", adjustBalanceCmd},
+	},
+	"blocks": {
+		"list":    {"[limit]", listBlocksCmd},
+		"recheck": {"", recheckBlocksCmd},
+	},
+	"ban": {
+		"add":    {"<ip> [timeout in seconds]", addBanCmd},
+		"remove": {"<ip>", removeBanCmd},
+	},
+	"blacklist": {
+		"add": {"<address>", addToBlacklistCmd},
+	},
+	"ledger": {
+		"audit": {"", auditLedgerCmd},
+	},
+	"archive": {
+		"run": {"", runArchiveCmd},
+	},
+	"storage": {
+		"migrate":   {"", migrateStorageCmd},
+		"reconcile": {"", reconcileStorageCmd},
+		"restore":   {"", restoreStorageCmd},
+	},
+	"stats": {
+		"dump": {"", dumpStatsCmd},
+	},
+}
+
+func isCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+func runCommand(args []string) error {
+	group, ok := commands[args[0]]
+	if !ok || len(args) < 2 {
+		return fmt.Errorf("Unknown command %q\n%s", strings.Join(args, " "), commandsUsage())
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		return fmt.Errorf("Unknown command %q\n%s", strings.Join(args, " "), commandsUsage())
+	}
+	return cmd.run(args[2:])
+}
+
+func commandsUsage() string {
+	var lines []string
+	for name, group := range commands {
+		for sub, cmd := range group {
+			lines = append(lines, strings.TrimSpace(fmt.Sprintf("\t%s %s %s", name, sub, cmd.usage)))
+		}
+	}
+	sort.Strings(lines)
+	return "Commands:\n\t" + strings.Join(lines, "\n\t")
+}
+
+// Every command leaves a trace in backend's audit log
+func audit(action, target, details string) error {
+	ctx := context.Background()
+	source := "cli"
+	if u, err := user.Current(); err == nil {
+		source = "cli:" + u.Username
+	}
+	entry := &storage.AuditEntry{Source: source, Action: action, Target: target, Details: details}
+	if err := backend.WriteAuditEntry(ctx, entry); err != nil {
+		return fmt.Errorf("Failed to write audit entry: %v", err)
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func parseLogin(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("Login is required")
+	}
+	login := strings.ToLower(args[0])
+	if !util.IsValidHexAddress(login) {
+		return "", fmt.Errorf("Invalid login %q", args[0])
+	}
+	return login, nil
+}
+
+func resolvePayoutsCmd(args []string) error {
+	if err := audit("payouts.resolve", "", ""); err != nil {
+		return err
+	}
+	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
+	return u.ResolvePayouts()
+}
+
+func showBalanceCmd(args []string) error {
+	ctx := context.Background()
+	login, err := parseLogin(args)
+	if err != nil {
+		return err
+	}
+	if err := audit("balance.show", login, ""); err != nil {
+		return err
+	}
+	stats, err := backend.GetMinerStats(ctx, login, cfg.Api.Payments)
+	if err != nil {
+		return err
+	}
+	return printJSON(stats)
+}
+
+func adjustBalanceCmd(args []string) error {
+	ctx := context.Background()
+	login, err := parseLogin(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return fmt.Errorf("Amount and reason are required")
+	}
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount == 0 {
+		return fmt.Errorf("Invalid amount %q", args[1])
+	}
+	reason := strings.Join(args[2:], " ")
+	details := fmt.Sprintf("%v Shannon: %s", amount, reason)
+	if err := audit("balance.adjust", login, details); err != nil {
+		return err
+	}
+	if err := backend.AdjustBalance(ctx, login, amount, reason); err != nil {
+		return err
+	}
+	fmt.Printf("Adjusted balance of %s by %v Shannon\n", login, amount)
+	return nil
+}
+
+func listBlocksCmd(args []string) error {
+	ctx := context.Background()
+	limit := cfg.Api.Blocks
+	if len(args) > 0 {
+		n, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid limit %q", args[0])
+		}
+		limit = n
+	}
+	if err := audit("blocks.list", "", ""); err != nil {
+		return err
+	}
+	// Candidates and immature blocks are always listed in full
+	candidates, err := backend.GetCandidates(ctx, 1<<62)
+	if err != nil {
+		return err
+	}
+	immature, err := backend.GetImmatureBlocks(ctx, 1<<62)
+	if err != nil {
+		return err
+	}
+	matured, err := backend.GetMaturedBlocks(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{
+		"candidates": candidates,
+		"immature":   immature,
+		"matured":    matured,
+	})
+}
+
+func recheckBlocksCmd(args []string) error {
+	if err := audit("blocks.recheck", "", ""); err != nil {
+		return err
+	}
+	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
+	return u.Recheck()
+}
+
+func addBanCmd(args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		return fmt.Errorf("IP is required")
+	}
+	ip := args[0]
+	timeout := int64(0)
+	if len(args) > 1 {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid timeout %q", args[1])
+		}
+		timeout = n
+	}
+	if err := audit("ban.add", ip, fmt.Sprintf("timeout %vs", timeout)); err != nil {
+		return err
+	}
+	if err := backend.AddBan(ctx, ip, timeout); err != nil {
+		return err
+	}
+	fmt.Printf("Banned %s, proxies will apply it on next policy refresh\n", ip)
+	return nil
+}
+
+func removeBanCmd(args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		return fmt.Errorf("IP is required")
+	}
+	ip := args[0]
+	if err := audit("ban.remove", ip, ""); err != nil {
+		return err
+	}
+	if err := backend.RemoveBan(ctx, ip); err != nil {
+		return err
+	}
+	fmt.Printf("Ban of %s removed, proxies will lift it on next policy refresh\n", ip)
+	return nil
+}
+
+func addToBlacklistCmd(args []string) error {
+	ctx := context.Background()
+	login, err := parseLogin(args)
+	if err != nil {
+		return err
+	}
+	if err := audit("blacklist.add", login, ""); err != nil {
+		return err
+	}
+	if err := backend.AddToBlacklist(ctx, login); err != nil {
+		return err
+	}
+	fmt.Printf("Blacklisted %s\n", login)
+	return nil
+}
+
+func auditLedgerCmd(args []string) error {
+	if err := audit("ledger.audit", "", ""); err != nil {
+		return err
+	}
+	a := payouts.NewLedgerAuditor(&cfg.LedgerAudit, &cfg.Payouts, backend)
+	report, err := a.Check()
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+func runArchiveCmd(args []string) error {
+	sink := newArchive()
+	if sink == nil {
+		return fmt.Errorf("Archive path or url must be set")
+	}
+	defer sink.Close()
+	if err := audit("archive.run", "", ""); err != nil {
+		return err
+	}
+	a := archive.NewArchiver(&cfg.Archive, backend, sink)
+	total, err := a.Run(context.Background())
+	fmt.Printf("Archived %v history entries\n", total)
+	return err
+}
+
+func migrateStorageCmd(args []string) error {
+	if err := audit("storage.migrate", "", ""); err != nil {
+		return err
+	}
+	total, err := backend.MigrateRecords(context.Background())
+	fmt.Printf("Migrated %v records\n", total)
+	return err
+}
+
+func journalBackend() (*storage.PostgresClient, error) {
+	pg, ok := backend.(*storage.PostgresClient)
+	if !ok {
+		return nil, fmt.Errorf("PostgreSQL journal is not enabled")
+	}
+	return pg, nil
+}
+
+func reconcileStorageCmd(args []string) error {
+	pg, err := journalBackend()
+	if err != nil {
+		return err
+	}
+	if err := audit("storage.reconcile", "", ""); err != nil {
+		return err
+	}
+	total, err := pg.ReconcileJournal(context.Background())
+	fmt.Printf("Resolved %v pending journal records\n", total)
+	return err
+}
+
+func restoreStorageCmd(args []string) error {
+	pg, err := journalBackend()
+	if err != nil {
+		return err
+	}
+	if err := audit("storage.restore", "", ""); err != nil {
+		return err
+	}
+	total, err := pg.RestoreBalances(context.Background())
+	fmt.Printf("Restored funds of %v miners\n", total)
+	return err
+}
+
+func dumpStatsCmd(args []string) error {
+	ctx := context.Background()
+	if err := audit("stats.dump", "", ""); err != nil {
+		return err
+	}
+	window := util.MustParseDuration(cfg.Api.HashrateWindow)
+	stats, err := backend.CollectStats(ctx, window, cfg.Api.Blocks, cfg.Api.Payments)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Api.LuckWindow) > 0 {
+		sort.Ints(cfg.Api.LuckWindow)
+		stats["luck"], err = backend.CollectLuckStats(ctx, cfg.Api.LuckWindow)
+		if err != nil {
+			return err
+		}
+	}
+	return printJSON(stats)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/webchain-network/webchain-pool/proxy"
+)
+
+// Prefix of environment variables overriding config values,
+// e.g. POOL_REDIS_PASSWORD or POOL_PAYOUTS_ADDRESS.
+const envPrefix = "POOL"
+
+// Suffix of environment variables pointing to a file with the value, e.g. POOL_REDIS_PASSWORD_FILE
+const envFileSuffix = "_FILE"
+
+// Repeatable -set flag holding "path=value" overrides
+type overrideFlags []string
+
+func (o *overrideFlags) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrideFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("override must be in form path=value, got %q", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+/* Configuration is layered: config file (JSON, YAML or TOML) first,
+ * then POOL_* environment variables, then -set flags from command line.
+ * Every layer maps onto proxy.Config using the json tags of its fields.
+ */
+func loadConfig(cfg *proxy.Config, configFileName string, overrides []string) error {
+	configFileName, _ = filepath.Abs(configFileName)
+	log.Printf("Loading config: %v", configFileName)
+
+	if err := readConfigFile(cfg, configFileName); err != nil {
+		return err
+	}
+	if err := applyEnvOverrides(reflect.ValueOf(cfg).Elem(), envPrefix, os.LookupEnv); err != nil {
+		return err
+	}
+	for _, v := range overrides {
+		kv := strings.SplitN(v, "=", 2)
+		if err := applyOverride(reflect.ValueOf(cfg).Elem(), kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return validateConfig(cfg)
+}
+
+// Checks settings of different modules which depend on each other
+func validateConfig(cfg *proxy.Config) error {
+	// Payments change balance of coinbase apart from rewards, unlocker would hold every round paid out at its height
+	if c := cfg.BlockUnlocker.Coinbase; len(c) > 0 && strings.EqualFold(c, cfg.Payouts.Address) {
+		return fmt.Errorf("Config error: unlocker coinbase %v must not be payouts address", c)
+	}
+	return validateFeeTierWindow(cfg)
+}
+
+func validateFeeTierWindow(cfg *proxy.Config) error {
+	if len(cfg.BlockUnlocker.FeeTiers) == 0 {
+		return nil
+	}
+	window, err := time.ParseDuration(cfg.BlockUnlocker.FeeTierWindow)
+	if err != nil {
+		return fmt.Errorf("Config error: feeTierWindow: %v", err)
+	}
+	// Hashrate entries older than these are removed, average over longer window would understate hashrate
+	retained := map[string]string{
+		"hashrateLargeWindow": cfg.Api.HashrateLargeWindow,
+		"hashrateExpiration":  cfg.Proxy.HashrateExpiration,
+	}
+	for name, value := range retained {
+		if len(value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Config error: %s: %v", name, err)
+		}
+		if window > d {
+			return fmt.Errorf("Config error: feeTierWindow %v is longer than %s %v", window, name, d)
+		}
+	}
+	return nil
+}
+
+func readConfigFile(cfg *proxy.Config, fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("File error: %v", err)
+	}
+
+	// YAML and TOML are converted to JSON in order to reuse json tags of config structs
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+		raw = normalizeYAML(raw)
+	case ".toml":
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(data), &m)
+		raw = m
+	default:
+		err = json.Unmarshal(data, cfg)
+		if err != nil {
+			return fmt.Errorf("Config error: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Config error: %v", err)
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return fmt.Errorf("Config error: %v", err)
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("Config error: %v", err)
+	}
+	return nil
+}
+
+// YAML decoder produces map[interface{}]interface{} which can't be marshalled to JSON
+func normalizeYAML(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			m[fmt.Sprint(k)] = normalizeYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range x {
+			x[i] = normalizeYAML(v)
+		}
+	}
+	return v
+}
+
+// Walks config struct and sets every field with matching PREFIX_FIELD or PREFIX_FIELD_FILE variable
+func applyEnvOverrides(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if len(name) == 0 {
+				continue
+			}
+			err := applyEnvOverrides(v.Field(i), prefix+"_"+envName(name), lookup)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		// Only existing entries of struct lists (e.g. upstreams) can be overridden by index
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				err := applyEnvOverrides(v.Index(i), prefix+"_"+strconv.Itoa(i), lookup)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	value, ok := lookup(prefix)
+	if !ok {
+		fileName, ok := lookup(prefix + envFileSuffix)
+		if !ok {
+			return nil
+		}
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("Can't read %s%s: %v", prefix, envFileSuffix, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("Invalid value of %s: %v", prefix, err)
+	}
+	return nil
+}
+
+// Sets config value by dot separated path of json names, e.g. "redis.password" or "upstream.0.url"
+func applyOverride(v reflect.Value, path, value string) error {
+	for _, part := range strings.Split(path, ".") {
+		switch v.Kind() {
+		case reflect.Struct:
+			field, ok := fieldByJSONName(v, part)
+			if !ok {
+				return fmt.Errorf("Unknown config option %q", path)
+			}
+			v = field
+		case reflect.Slice:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= v.Len() {
+				return fmt.Errorf("Invalid index in config option %q", path)
+			}
+			v = v.Index(i)
+		default:
+			return fmt.Errorf("Unknown config option %q", path)
+		}
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("Invalid value of %s: %v", path, err)
+	}
+	return nil
+}
+
+func fieldByJSONName(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(jsonName(t.Field(i)), name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func setValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		// Lists of scalars are comma separated: POOL_API_LUCK_WINDOW=64,128,256
+		parts := strings.Split(s, ",")
+		list := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(list.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+func jsonName(f reflect.StructField) string {
+	if len(f.PkgPath) > 0 {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if len(name) == 0 {
+		return f.Name
+	}
+	return name
+}
+
+// Converts camelCase json name to upper snake case: poolFeeAddress => POOL_FEE_ADDRESS
+func envName(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Returns config file name, config overrides and operator's command with arguments if any
+func parseFlags() (string, []string, []string) {
+	var overrides overrideFlags
+	configFileName := flag.String("config", "", "Path to config file (JSON, YAML or TOML)")
+	flag.Var(&overrides, "set", "Override config option, e.g. -set redis.password=secret (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [config file] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, commandsUsage())
+	}
+	flag.Parse()
+
+	// Keep supporting config path as a first positional argument
+	args := flag.Args()
+	if len(args) > 0 && !isCommand(args[0]) {
+		if len(*configFileName) == 0 {
+			*configFileName = args[0]
+		}
+		args = args[1:]
+	}
+	if len(*configFileName) == 0 {
+		*configFileName = "config.json"
+	}
+	return *configFileName, overrides, args
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/webchain-network/webchain-pool/proxy"
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+func TestEnvName(t *testing.T) {
+	names := map[string]string{
+		"password":       "PASSWORD",
+		"poolFeeAddress": "POOL_FEE_ADDRESS",
+		"newrelicKey":    "NEWRELIC_KEY",
+		"purgeInterval":  "PURGE_INTERVAL",
+		"ipset":          "IPSET",
+		"hashrateWindow": "HASHRATE_WINDOW",
+	}
+	for name, expected := range names {
+		if v := envName(name); v != expected {
+			t.Errorf("Invalid env name for %v, expected %v vs %v", name, expected, v)
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pool")
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "newrelic")
+	ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600)
+
+	env := map[string]string{
+		"POOL_REDIS_PASSWORD":         "redispass",
+		"POOL_PAYOUTS_ADDRESS":        "0x1",
+		"POOL_PAYOUTS_THRESHOLD":      "100",
+		"POOL_UNLOCKER_DEV_DONATE":    "2.5",
+		"POOL_API_LUCK_WINDOW":        "64, 128",
+		"POOL_UPSTREAM_0_URL":         "http://127.0.0.1:8545",
+		"POOL_PROXY_STRATUM_ENABLED":  "true",
+		"POOL_NEWRELIC_KEY" + "_FILE": secret,
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	cfg := proxy.Config{Upstream: []proxy.Upstream{{Name: "main"}}}
+	err := applyEnvOverrides(reflect.ValueOf(&cfg).Elem(), envPrefix, lookup)
+	if err != nil {
+		t.Fatalf("Must apply overrides: %v", err)
+	}
+	if cfg.Redis.Password != "redispass" {
+		t.Error("Must override redis password")
+	}
+	if cfg.Payouts.Address != "0x1" || cfg.Payouts.Threshold != 100 {
+		t.Error("Must override payouts options")
+	}
+	if cfg.BlockUnlocker.DevDonate == nil || *cfg.BlockUnlocker.DevDonate != 2.5 {
+		t.Error("Must override pointer option")
+	}
+	if !reflect.DeepEqual(cfg.Api.LuckWindow, []int{64, 128}) {
+		t.Errorf("Must override list option: %v", cfg.Api.LuckWindow)
+	}
+	if cfg.Upstream[0].Url != "http://127.0.0.1:8545" || cfg.Upstream[0].Name != "main" {
+		t.Error("Must override upstream by index")
+	}
+	if !cfg.Proxy.Stratum.Enabled {
+		t.Error("Must override nested option")
+	}
+	if cfg.NewrelicKey != "s3cr3t" {
+		t.Errorf("Must read secret from file: %q", cfg.NewrelicKey)
+	}
+}
+
+func TestApplyOverride(t *testing.T) {
+	cfg := proxy.Config{Upstream: []proxy.Upstream{{Name: "main"}}}
+	v := reflect.ValueOf(&cfg).Elem()
+
+	if err := applyOverride(v, "redis.password", "x"); err != nil || cfg.Redis.Password != "x" {
+		t.Error("Must override by path")
+	}
+	if err := applyOverride(v, "unlocker.poolFeeAddress", "0x2"); err != nil || cfg.BlockUnlocker.PoolFeeAddress != "0x2" {
+		t.Error("Must override camel case option")
+	}
+	if err := applyOverride(v, "upstream.0.timeout", "5s"); err != nil || cfg.Upstream[0].Timeout != "5s" {
+		t.Error("Must override list entry")
+	}
+	if err := applyOverride(v, "upstream.1.timeout", "5s"); err == nil {
+		t.Error("Must not override missing list entry")
+	}
+	if err := applyOverride(v, "redis.unknown", "x"); err == nil {
+		t.Error("Must fail on unknown option")
+	}
+	if err := applyOverride(v, "redis.database", "x"); err == nil {
+		t.Error("Must fail on malformed value")
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pool")
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{"name": "main", "redis": {"endpoint": "127.0.0.1:6379", "poolSize": 10}, "api": {"luckWindow": [64]}}`,
+		"config.yaml": "name: main\nredis:\n  endpoint: 127.0.0.1:6379\n  poolSize: 10\napi:\n  luckWindow: [64]\n",
+		"config.toml": "name = \"main\"\n[redis]\nendpoint = \"127.0.0.1:6379\"\npoolSize = 10\n[api]\nluckWindow = [64]\n",
+	}
+	for name, data := range files {
+		fileName := filepath.Join(dir, name)
+		ioutil.WriteFile(fileName, []byte(data), 0600)
+
+		var cfg proxy.Config
+		if err := readConfigFile(&cfg, fileName); err != nil {
+			t.Errorf("Must read %v: %v", name, err)
+			continue
+		}
+		if cfg.Name != "main" || cfg.Redis.Endpoint != "127.0.0.1:6379" || cfg.Redis.PoolSize != 10 {
+			t.Errorf("Must map %v onto config: %+v", name, cfg.Redis)
+		}
+		if !reflect.DeepEqual(cfg.Api.LuckWindow, []int{64}) {
+			t.Errorf("Must map lists of %v onto config", name)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var cfg proxy.Config
+	cfg.BlockUnlocker.FeeTiers = []*storage.FeeTier{{Hashrate: 5000, Fee: 0.5}}
+	cfg.BlockUnlocker.FeeTierWindow = "3h"
+	cfg.Api.HashrateLargeWindow = "3h"
+	cfg.Proxy.HashrateExpiration = "3h"
+	if err := validateConfig(&cfg); err != nil {
+		t.Errorf("Must accept fee tier window covered by kept hashrate: %v", err)
+	}
+	cfg.BlockUnlocker.FeeTierWindow = "24h"
+	if err := validateConfig(&cfg); err == nil {
+		t.Error("Must reject fee tier window longer than kept hashrate")
+	}
+
+	cfg.BlockUnlocker.FeeTierWindow = "3h"
+	cfg.BlockUnlocker.Coinbase = "0x2a42292799d49895a4c8d39411ae735e82987008"
+	cfg.Payouts.Address = "0x2A42292799D49895A4C8D39411AE735E82987008"
+	if err := validateConfig(&cfg); err == nil {
+		t.Error("Must reject coinbase used as payouts address")
+	}
+	cfg.Payouts.Address = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
+	if err := validateConfig(&cfg); err != nil {
+		t.Errorf("Must accept payouts from address other than coinbase: %v", err)
+	}
+}
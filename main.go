@@ -1,24 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"math/rand"
-	"os"
-	"path/filepath"
 	"runtime"
 	"time"
 
 	"github.com/yvasiyarov/gorelic"
 
 	"github.com/webchain-network/webchain-pool/api"
+	"github.com/webchain-network/webchain-pool/archive"
 	"github.com/webchain-network/webchain-pool/payouts"
 	"github.com/webchain-network/webchain-pool/proxy"
 	"github.com/webchain-network/webchain-pool/storage"
 )
 
 var cfg proxy.Config
-var backend *storage.RedisClient
+var backend storage.Backend
 
 func startProxy() {
 	s := proxy.NewProxy(&cfg, backend)
@@ -26,7 +25,7 @@ func startProxy() {
 }
 
 func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
+	s := api.NewApiServer(&cfg.Api, backend, newArchive())
 	s.Start()
 }
 
@@ -40,6 +39,20 @@ func startPayoutsProcessor() {
 	u.Start()
 }
 
+func startLedgerAuditor() {
+	a := payouts.NewLedgerAuditor(&cfg.LedgerAudit, &cfg.Payouts, backend)
+	a.Start()
+}
+
+func startArchiver() {
+	sink := newArchive()
+	if sink == nil {
+		log.Fatal("Archive path or url must be set to run archiver")
+	}
+	a := archive.NewArchiver(&cfg.Archive, backend, sink)
+	a.Start()
+}
+
 func startNewrelic() {
 	if cfg.NewrelicEnabled {
 		nr := gorelic.NewAgent()
@@ -50,29 +63,56 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+func newBackend() storage.Backend {
+	if cfg.Backend == "memory" {
+		log.Println("Using in-memory backend, all data will be lost on exit")
+		return storage.NewMemoryBackend()
+	}
+	redis := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if !cfg.Postgres.Enabled {
+		return redis
+	}
+	backend, err := storage.NewPostgresClient(&cfg.Postgres, redis)
+	if err != nil {
+		log.Fatalf("Can't establish connection to PostgreSQL: %v", err)
 	}
-	configFileName, _ = filepath.Abs(configFileName)
-	log.Printf("Loading config: %v", configFileName)
+	return backend
+}
 
-	configFile, err := os.Open(configFileName)
+// API reads old history from archive if it is configured, even if archiver runs in another process
+func newArchive() archive.Sink {
+	if len(cfg.Archive.Path) == 0 && len(cfg.Archive.Url) == 0 {
+		return nil
+	}
+	sink, err := archive.NewSink(&cfg.Archive)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		log.Fatalf("Can't open history archive: %v", err)
 	}
-	defer configFile.Close()
-	jsonParser := json.NewDecoder(configFile)
-	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+	return sink
+}
+
+func readConfig(cfg *proxy.Config) []string {
+	configFileName, overrides, args := parseFlags()
+	if err := loadConfig(cfg, configFileName, overrides); err != nil {
+		log.Fatal(err)
 	}
+	return args
 }
 
 func main() {
-	readConfig(&cfg)
+	ctx := context.Background()
+	args := readConfig(&cfg)
 	rand.Seed(time.Now().UnixNano())
 
+	// Run operator's command and exit
+	if len(args) > 0 {
+		backend = newBackend()
+		if err := runCommand(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
 		log.Printf("Running with %v threads", cfg.Threads)
@@ -80,8 +120,8 @@ func main() {
 
 	startNewrelic()
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
-	pong, err := backend.Check()
+	backend = newBackend()
+	pong, err := backend.Check(ctx)
 	if err != nil {
 		log.Printf("Can't establish connection to backend: %v", err)
 	} else {
@@ -100,6 +140,12 @@ func main() {
 	if cfg.Payouts.Enabled {
 		go startPayoutsProcessor()
 	}
+	if cfg.LedgerAudit.Enabled {
+		go startLedgerAuditor()
+	}
+	if cfg.Archive.Enabled {
+		go startArchiver()
+	}
 	quit := make(chan bool)
 	<-quit
 }
@@ -0,0 +1,135 @@
+package payouts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/webchain-network/webchaind/common"
+
+	"github.com/webchain-network/webchain-pool/rpc"
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+type AuditConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+}
+
+// Verifies that finances counters agree with per-miner funds and that payer's wallet holds what pool owes to miners
+type LedgerAuditor struct {
+	config  *AuditConfig
+	payouts *PayoutsConfig
+	backend storage.Backend
+	rpc     *rpc.RPCClient
+}
+
+// Scan is repeated if finances were changed by unlocker or payer while scanning miners
+const maxAuditAttempts = 3
+
+func NewLedgerAuditor(cfg *AuditConfig, payouts *PayoutsConfig, backend storage.Backend) *LedgerAuditor {
+	a := &LedgerAuditor{config: cfg, payouts: payouts, backend: backend}
+	if len(payouts.Address) > 0 {
+		a.rpc = rpc.NewRPCClient("LedgerAuditor", payouts.Daemon, payouts.Timeout)
+	}
+	return a
+}
+
+func (a *LedgerAuditor) Start() {
+	log.Println("Starting ledger audit")
+
+	intv := util.MustParseDuration(a.config.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set ledger audit interval to %v", intv)
+
+	a.audit()
+	timer.Reset(intv)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				a.audit()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (a *LedgerAuditor) audit() {
+	ctx := context.Background()
+	report, err := a.Check()
+	if err != nil {
+		log.Printf("Ledger audit failed: %v", err)
+		return
+	}
+	for _, d := range report.Discrepancies {
+		log.Printf("Ledger discrepancy in %s: expected %v Shannon, got %v Shannon", d.Field, d.Expected, d.Actual)
+	}
+	if len(report.Discrepancies) == 0 {
+		log.Printf("Ledger audit passed for %v miners", report.Miners)
+	}
+	err = a.backend.WriteConsistencyReport(ctx, report)
+	if err != nil {
+		log.Printf("Failed to write ledger audit report to backend: %v", err)
+	}
+}
+
+// Runs single audit pass, used by "ledger audit" command
+func (a *LedgerAuditor) Check() (*storage.ConsistencyReport, error) {
+	ctx := context.Background()
+	report := &storage.ConsistencyReport{Timestamp: util.MakeTimestamp() / 1000}
+
+	for i := 0; ; i++ {
+		before, err := a.backend.GetFinances(ctx)
+		if err != nil {
+			return nil, err
+		}
+		report.Miners, report.MinersFunds, err = a.backend.SumMinersFunds(ctx)
+		if err != nil {
+			return nil, err
+		}
+		report.Finances, err = a.backend.GetFinances(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(before, report.Finances) {
+			break
+		}
+		if i+1 == maxAuditAttempts {
+			return nil, fmt.Errorf("Finances are changing too fast, gave up after %v attempts", maxAuditAttempts)
+		}
+	}
+
+	report.Discrepancies = compareFunds(report.MinersFunds, report.Finances)
+
+	if a.rpc != nil {
+		balance, err := a.rpc.GetBalance(a.payouts.Address)
+		if err != nil {
+			return nil, err
+		}
+		walletBalance := new(big.Int).Div(balance, common.Shannon).Int64()
+		report.WalletBalance = &walletBalance
+
+		// Wallet may hold pool's profit, but never less than miners' balances and pending payouts
+		owed := report.Finances["balance"] + report.Finances["pending"]
+		if walletBalance < owed {
+			report.Discrepancies = append(report.Discrepancies, &storage.Discrepancy{Field: "wallet", Expected: owed, Actual: walletBalance})
+		}
+	}
+	return report, nil
+}
+
+func compareFunds(minersFunds, finances map[string]int64) []*storage.Discrepancy {
+	result := []*storage.Discrepancy{}
+	for _, field := range []string{"balance", "immature", "pending", "paid"} {
+		if minersFunds[field] != finances[field] {
+			result = append(result, &storage.Discrepancy{Field: field, Expected: minersFunds[field], Actual: finances[field]})
+		}
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+package payouts
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/webchain-network/webchaind/common"
+
+	"github.com/webchain-network/webchain-pool/rpc"
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+func TestCompareFunds(t *testing.T) {
+	minersFunds := map[string]int64{"balance": 100, "immature": 50, "pending": 0, "paid": 1000}
+	finances := map[string]int64{"balance": 100, "immature": 40, "pending": 0, "paid": 1000, "totalMined": 5000}
+
+	result := compareFunds(minersFunds, finances)
+	if len(result) != 1 {
+		t.Fatalf("Must find single discrepancy: %v", result)
+	}
+	if result[0].Field != "immature" || result[0].Expected != 50 || result[0].Actual != 40 {
+		t.Errorf("Must report immature discrepancy: %+v", result[0])
+	}
+	if len(compareFunds(minersFunds, minersFunds)) != 0 {
+		t.Error("Must not report equal funds")
+	}
+}
+
+// Credits miner while auditor scans miners, as unlocker running alongside would
+type changingBackend struct {
+	*storage.MemoryBackend
+	changes int
+	scans   int
+}
+
+func (b *changingBackend) SumMinersFunds(ctx context.Context) (int64, map[string]int64, error) {
+	b.scans++
+	if b.changes > 0 {
+		b.changes--
+		b.AdjustBalance(ctx, "0xa", 10, "test")
+	}
+	return b.MemoryBackend.SumMinersFunds(ctx)
+}
+
+func TestAuditorCheck(t *testing.T) {
+	ctx := context.Background()
+	// Wallet holds 1000 Shannon
+	wallet := new(big.Int).Mul(big.NewInt(1000), common.Shannon)
+	node := &testNode{blocks: make(map[int64]*rpc.GetBlockReply), balance: "0x" + wallet.Text(16)}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := &changingBackend{MemoryBackend: storage.NewMemoryBackend(), changes: 1}
+	backend.AdjustBalance(ctx, "0xa", 900, "test")
+	backend.AdjustBalance(ctx, "0xb", 50, "test")
+	backend.UpdateBalance(ctx, "0xb", 50)
+	auditor := NewLedgerAuditor(&AuditConfig{Enabled: true}, &PayoutsConfig{Address: "0xpool", Daemon: server.URL, Timeout: "5s"}, backend)
+
+	report, err := auditor.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.scans != 2 {
+		t.Errorf("Must scan again after finances changed: %v scans", backend.scans)
+	}
+	if report.Miners != 2 || report.MinersFunds["balance"] != 910 || report.Finances["balance"] != 910 {
+		t.Errorf("Must report funds of the last scan: %+v", report)
+	}
+	if len(report.Discrepancies) != 0 || report.WalletBalance == nil || *report.WalletBalance != 1000 {
+		t.Errorf("Must pass with wallet covering balances and pending payouts: %+v", report)
+	}
+
+	// Pool owes 1050 Shannon, 50 more than wallet holds
+	backend.AdjustBalance(ctx, "0xb", 90, "test")
+	report, err = auditor.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Discrepancies) != 1 {
+		t.Fatalf("Must report wallet shortfall only: %+v", report.Discrepancies)
+	}
+	if d := report.Discrepancies[0]; d.Field != "wallet" || d.Expected != 1050 || d.Actual != 1000 {
+		t.Errorf("Must report what wallet lacks: %+v", d)
+	}
+
+	backend.changes, backend.scans = maxAuditAttempts, 0
+	if _, err := auditor.Check(); err == nil {
+		t.Error("Must give up when finances keep changing")
+	}
+	if backend.scans != maxAuditAttempts {
+		t.Errorf("Must scan %v times before giving up: %v", maxAuditAttempts, backend.scans)
+	}
+}
@@ -0,0 +1,65 @@
+package payouts
+
+import (
+	"log"
+
+	"github.com/webchain-network/webchain-pool/rpc"
+)
+
+type Daemon struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Timeout string `json:"timeout"`
+}
+
+// Nodes of unlocker or payouts module, first healthy node is used for the whole pass
+type nodeSet struct {
+	clients []*rpc.RPCClient
+	current int
+}
+
+// Single legacy daemon is used if list of daemons is empty
+func newNodeSet(module string, daemons []*Daemon, url, timeout string) *nodeSet {
+	if len(daemons) == 0 {
+		daemons = []*Daemon{{Name: "main", Url: url, Timeout: timeout}}
+	}
+	n := &nodeSet{}
+	for _, d := range daemons {
+		n.clients = append(n.clients, rpc.NewRPCClient(module+":"+d.Name, d.Url, d.Timeout))
+		log.Printf("%s daemon: %s => %s", module, d.Name, d.Url)
+	}
+	return n
+}
+
+func (n *nodeSet) rpc() *rpc.RPCClient {
+	return n.clients[n.current]
+}
+
+// Other nodes used to confirm what current one says
+func (n *nodeSet) others() []*rpc.RPCClient {
+	var result []*rpc.RPCClient
+	for i, c := range n.clients {
+		if i != n.current {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// Switches to first node that replies, stays on current one if none does
+func (n *nodeSet) check() {
+	if len(n.clients) == 1 {
+		return
+	}
+	for i, c := range n.clients {
+		if _, err := c.GetPendingBlock(); err != nil {
+			log.Printf("Daemon %s is unavailable: %v", c.Name, err)
+			continue
+		}
+		if i != n.current {
+			log.Printf("Switching to %v daemon", c.Name)
+			n.current = i
+		}
+		return
+	}
+}
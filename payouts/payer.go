@@ -1,11 +1,10 @@
 package payouts
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/big"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/webchain-network/webchaind/common"
@@ -21,10 +20,12 @@ type PayoutsConfig struct {
 	Interval     string `json:"interval"`
 	Daemon       string `json:"daemon"`
 	Timeout      string `json:"timeout"`
-	Address      string `json:"address"`
-	Gas          string `json:"gas"`
-	GasPrice     string `json:"gasPrice"`
-	AutoGas      bool   `json:"autoGas"`
+	// Replaces daemon and timeout if set, first healthy node is used, all of them must have pool's account unlocked
+	Daemons  []*Daemon `json:"daemons"`
+	Address  string    `json:"address"`
+	Gas      string    `json:"gas"`
+	GasPrice string    `json:"gasPrice"`
+	AutoGas  bool      `json:"autoGas"`
 	// In Shannon
 	Threshold int64 `json:"threshold"`
 	BgSave    bool  `json:"bgsave"`
@@ -43,41 +44,39 @@ func (self PayoutsConfig) GasPriceHex() string {
 }
 
 type PayoutsProcessor struct {
-	config   *PayoutsConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config    *PayoutsConfig
+	backend   storage.Backend
+	nodes     *nodeSet
+	halt      bool
+	lastFail  error
+	resumedAt int64
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend storage.Backend) *PayoutsProcessor {
+	ctx := context.Background()
 	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+	u.nodes = newNodeSet("PayoutsProcessor", cfg.Daemons, cfg.Daemon, cfg.Timeout)
+	// Ignore resume requests made before start
+	_, u.resumedAt, _ = backend.GetModuleState(ctx, "payouts")
 	return u
 }
 
 func (u *PayoutsProcessor) Start() {
+	ctx := context.Background()
 	log.Println("Starting payouts")
 
-	if u.mustResolvePayout() {
-		log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-		u.resolvePayouts()
-		log.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
-		return
-	}
-
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
-	payments := u.backend.GetPendingPayments()
+	payments := u.backend.GetPendingPayments(ctx)
 	if len(payments) > 0 {
 		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
 			formatPendingPayments(payments))
 		return
 	}
 
-	locked, err := u.backend.IsPayoutsLocked()
+	locked, err := u.backend.IsPayoutsLocked(ctx)
 	if err != nil {
 		log.Println("Unable to start payouts:", err)
 		return
@@ -106,22 +105,50 @@ func toHexInt(n *big.Int) string {
 	return fmt.Sprintf("0x%x", n)
 }
 
+// Applies pause and resume requests made by operator through admin API
+func (u *PayoutsProcessor) isPaused() bool {
+	ctx := context.Background()
+	paused, resumedAt, err := u.backend.GetModuleState(ctx, "payouts")
+	if err != nil {
+		// Don't send money without knowing operator's intent
+		log.Printf("Failed to get payouts state from backend: %v", err)
+		return true
+	}
+	if resumedAt > u.resumedAt {
+		u.resumedAt = resumedAt
+		if u.halt {
+			log.Println("Payments resumed by operator after critical error:", u.lastFail)
+			u.halt = false
+			u.lastFail = nil
+		}
+	}
+	if paused {
+		log.Println("Payments paused by operator")
+	}
+	return paused
+}
+
 func (u *PayoutsProcessor) process() {
+	ctx := context.Background()
+	if u.isPaused() {
+		return
+	}
 	if u.halt {
 		log.Println("Payments suspended due to last critical error:", u.lastFail)
 		return
 	}
+	u.nodes.check()
 	mustPay := 0
 	minersPaid := 0
 	totalAmount := big.NewInt(0)
-	payees, err := u.backend.GetPayees()
+	payees, err := u.backend.GetPayees(ctx)
 	if err != nil {
 		log.Println("Error while retrieving payees from backend:", err)
 		return
 	}
 
 	for _, login := range payees {
-		amount, _ := u.backend.GetBalance(login)
+		amount, _ := u.backend.GetBalance(ctx, login)
 		amountInShannon := big.NewInt(amount)
 
 		// Shannon^2 = Wei
@@ -142,7 +169,7 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		// Check if we have enough funds
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
+		poolBalance, err := u.rpc().GetBalance(u.config.Address)
 		if err != nil {
 			u.halt = true
 			u.lastFail = err
@@ -157,7 +184,7 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		// Lock payments for current payout
-		err = u.backend.LockPayouts(login, amount)
+		err = u.backend.LockPayouts(ctx, login, amount)
 		if err != nil {
 			log.Printf("Failed to lock payment for %s: %v", login, err)
 			u.halt = true
@@ -167,7 +194,7 @@ func (u *PayoutsProcessor) process() {
 		log.Printf("Locked payment for %s, %v Shannon", login, amount)
 
 		// Debit miner's balance and update stats
-		err = u.backend.UpdateBalance(login, amount)
+		err = u.backend.UpdateBalance(ctx, login, amount)
 		if err != nil {
 			log.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
 			u.halt = true
@@ -176,7 +203,7 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		value := toHexInt(amountInWei)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
+		txHash, err := u.rpc().SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
 		if err != nil {
 			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
 				login, amount, err, login)
@@ -186,7 +213,7 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		// Log transaction hash
-		err = u.backend.WritePayment(login, txHash, amount)
+		err = u.backend.WritePayment(ctx, login, txHash, amount)
 		if err != nil {
 			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
 			u.halt = true
@@ -202,7 +229,7 @@ func (u *PayoutsProcessor) process() {
 		log.Printf("Waiting for tx confirmation: %v", txHash)
 		for {
 			time.Sleep(1 * time.Second)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
+			receipt, err := u.rpc().GetTxReceipt(txHash)
 			if err != nil {
 				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
 			}
@@ -225,8 +252,12 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
+func (u *PayoutsProcessor) rpc() *rpc.RPCClient {
+	return u.nodes.rpc()
+}
+
 func (self PayoutsProcessor) isUnlockedAccount() bool {
-	_, err := self.rpc.Sign(self.config.Address, "0x00")
+	_, err := self.rpc().Sign(self.config.Address, "0x00")
 	if err != nil {
 		log.Println("Unable to process payouts:", err)
 		return false
@@ -235,7 +266,7 @@ func (self PayoutsProcessor) isUnlockedAccount() bool {
 }
 
 func (self PayoutsProcessor) checkPeers() bool {
-	n, err := self.rpc.GetPeerCount()
+	n, err := self.rpc().GetPeerCount()
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
 		return false
@@ -260,7 +291,8 @@ func formatPendingPayments(list []*storage.PendingPayment) string {
 }
 
 func (self PayoutsProcessor) bgSave() {
-	result, err := self.backend.BgSave()
+	ctx := context.Background()
+	result, err := self.backend.BgSave(ctx)
 	if err != nil {
 		log.Println("Failed to perform BGSAVE on backend:", err)
 		return
@@ -268,24 +300,24 @@ func (self PayoutsProcessor) bgSave() {
 	log.Println("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
-	payments := self.backend.GetPendingPayments()
+// Credits pending payments back to miners and unlocks payouts, run by "payouts resolve" command
+func (self PayoutsProcessor) ResolvePayouts() error {
+	ctx := context.Background()
+	payments := self.backend.GetPendingPayments(ctx)
 
 	if len(payments) > 0 {
 		log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
 
 		for _, v := range payments {
-			err := self.backend.RollbackBalance(v.Address, v.Amount)
+			err := self.backend.RollbackBalance(ctx, v.Address, v.Amount)
 			if err != nil {
-				log.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
-				return
+				return fmt.Errorf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
 			}
 			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
 		}
-		err := self.backend.UnlockPayouts()
+		err := self.backend.UnlockPayouts(ctx)
 		if err != nil {
-			log.Println("Failed to unlock payouts:", err)
-			return
+			return fmt.Errorf("Failed to unlock payouts: %v", err)
 		}
 	} else {
 		log.Println("No pending payments to resolve")
@@ -295,9 +327,5 @@ func (self PayoutsProcessor) resolvePayouts() {
 		self.bgSave()
 	}
 	log.Println("Payouts unlocked")
-}
-
-func (self PayoutsProcessor) mustResolvePayout() bool {
-	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
-	return v
+	return nil
 }
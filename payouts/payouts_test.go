@@ -0,0 +1,543 @@
+package payouts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webchain-network/webchain-pool/rpc"
+	"github.com/webchain-network/webchain-pool/storage"
+)
+
+// Minimal JSON-RPC node serving blocks, balances and transactions for unlocker and payer
+type testNode struct {
+	sync.Mutex
+	height   int64
+	blocks   map[int64]*rpc.GetBlockReply
+	uncles   map[int64][]*rpc.GetBlockReply
+	balance  string
+	balances map[string]string
+	sent     []map[string]string
+	requests int
+	// Next requests fail as if node was unavailable
+	failRequests int
+}
+
+type testRequest struct {
+	Id     int               `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(r.Body).Decode(&body)
+
+	n.Lock()
+	defer n.Unlock()
+	n.requests++
+	if n.failRequests > 0 {
+		n.failRequests--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []testRequest
+		json.Unmarshal(body, &reqs)
+		var replies []map[string]interface{}
+		// Reply in reverse order, batch replies are not ordered
+		for i := len(reqs) - 1; i >= 0; i-- {
+			replies = append(replies, map[string]interface{}{"jsonrpc": "2.0", "id": reqs[i].Id, "result": n.call(&reqs[i])})
+		}
+		json.NewEncoder(w).Encode(replies)
+		return
+	}
+	var req testRequest
+	json.Unmarshal(body, &req)
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 0, "result": n.call(&req)})
+}
+
+func (n *testNode) call(req *testRequest) interface{} {
+	var result interface{}
+	switch req.Method {
+	case "eth_getBlockByNumber":
+		var number string
+		json.Unmarshal(req.Params[0], &number)
+		if number == "pending" {
+			result = &rpc.GetBlockReplyPart{Number: fmt.Sprintf("0x%x", n.height)}
+			break
+		}
+		height, _ := strconv.ParseInt(number[2:], 16, 64)
+		if block, ok := n.blocks[height]; ok {
+			result = block
+		} else if height <= n.height {
+			result = &rpc.GetBlockReply{Number: number, Hash: fmt.Sprintf("0x%064x", height)}
+		}
+	case "eth_getUncleByBlockNumberAndIndex":
+		var number, index string
+		json.Unmarshal(req.Params[0], &number)
+		json.Unmarshal(req.Params[1], &index)
+		height, _ := strconv.ParseInt(number[2:], 16, 64)
+		i, _ := strconv.ParseInt(index[2:], 16, 64)
+		if int(i) < len(n.uncles[height]) {
+			result = n.uncles[height][i]
+		}
+	case "eth_getBalance":
+		var block string
+		json.Unmarshal(req.Params[1], &block)
+		if balance, ok := n.balances[block]; ok {
+			result = balance
+		} else {
+			result = n.balance
+		}
+	case "net_peerCount":
+		result = "0x5"
+	case "eth_sign":
+		result = "0x1"
+	case "eth_sendTransaction":
+		var tx map[string]string
+		json.Unmarshal(req.Params[0], &tx)
+		n.sent = append(n.sent, tx)
+		result = fmt.Sprintf("0x%064x", len(n.sent))
+	case "eth_getTransactionReceipt":
+		var hash string
+		json.Unmarshal(req.Params[0], &hash)
+		result = &rpc.TxReceipt{TxHash: hash, GasUsed: "0x5208"}
+	}
+	return result
+}
+
+func TestUnlockAndPay(t *testing.T) {
+	ctx := context.Background()
+	node := &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply), balance: "0x56bc75e2d63100000"}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	backend.WriteShare(ctx, "0xa", "rig", []string{"0x1", "0x0", "0x0"}, 2000, 100, 0)
+	backend.WriteShare(ctx, "0xb", "rig", []string{"0x2", "0x0", "0x0"}, 1000, 100, 0)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+	hash := fmt.Sprintf("0x%064x", 0xabc)
+	node.blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: hash, Nonce: "0x3"}
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16,
+		Daemon: server.URL, Timeout: "5s",
+	}, backend)
+
+	unlocker.unlockPendingBlocks()
+	if unlocker.halt {
+		t.Fatalf("Must not halt: %v", unlocker.lastFail)
+	}
+	immature, _ := backend.GetImmatureBlocks(ctx, 1000)
+	if len(immature) != 1 || immature[0].Hash != hash {
+		t.Fatalf("Must unlock immature block: %+v", immature)
+	}
+	finances, _ := backend.GetFinances(ctx)
+	if finances["immature"] <= 0 {
+		t.Fatalf("Must credit immature balances: %v", finances)
+	}
+
+	node.height = 140
+	unlocker.unlockAndCreditMiners()
+	if unlocker.halt {
+		t.Fatalf("Must not halt: %v", unlocker.lastFail)
+	}
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 1 {
+		t.Fatalf("Must mature block: %+v", matured)
+	}
+	balanceA, _ := backend.GetBalance(ctx, "0xa")
+	balanceB, _ := backend.GetBalance(ctx, "0xb")
+	if balanceA <= 0 || balanceA/balanceB != 3 {
+		t.Errorf("Must credit miners proportionally to shares: %v vs %v", balanceA, balanceB)
+	}
+	_, funds, _ := backend.SumMinersFunds(ctx)
+	finances, _ = backend.GetFinances(ctx)
+	if d := compareFunds(funds, finances); len(d) != 0 {
+		t.Errorf("Finances must match miners funds: %v vs %v", funds, finances)
+	}
+
+	payer := NewPayoutsProcessor(&PayoutsConfig{
+		RequirePeers: 1, Daemon: server.URL, Timeout: "5s", Address: "0xpool", Gas: "21000", GasPrice: "1", AutoGas: true, Threshold: 1,
+	}, backend)
+	payer.process()
+	if payer.halt {
+		t.Fatalf("Must not halt: %v", payer.lastFail)
+	}
+	if len(node.sent) != 2 {
+		t.Fatalf("Must send payment to each miner: %v", node.sent)
+	}
+	if balance, _ := backend.GetBalance(ctx, "0xa"); balance != 0 {
+		t.Errorf("Must debit paid balance: %v", balance)
+	}
+	finances, _ = backend.GetFinances(ctx)
+	if finances["paid"] != balanceA+balanceB || finances["pending"] != 0 {
+		t.Errorf("Must record payments: %v", finances)
+	}
+	if locked, _ := backend.IsPayoutsLocked(ctx); locked {
+		t.Error("Must unlock payouts")
+	}
+}
+
+func TestVerifyRewards(t *testing.T) {
+	ctx := context.Background()
+	node := &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply), balance: "0x0", balances: map[string]string{"0x63": "0x0", "0x64": "0x1"}}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+	node.blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: fmt.Sprintf("0x%064x", 0xabc), Nonce: "0x3"}
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16,
+		Coinbase: "0x2a42292799d49895a4c8d39411ae735e82987008", Daemon: server.URL, Timeout: "5s",
+	}, backend)
+	unlocker.unlockPendingBlocks()
+
+	node.height = 140
+	unlocker.unlockAndCreditMiners()
+	if unlocker.halt {
+		t.Fatalf("Must not halt on mismatch: %v", unlocker.lastFail)
+	}
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 0 {
+		t.Fatalf("Must hold block with mismatched reward: %+v", matured)
+	}
+	mismatches, _ := backend.GetRewardMismatches(ctx)
+	round := "100:" + fmt.Sprintf("0x%064x", 0xabc)
+	if m, ok := mismatches[round]; !ok || m.Actual != "1" || m.Expected != "1169418896691735179" {
+		t.Fatalf("Must record mismatch: %+v", mismatches)
+	}
+
+	unlocker.unlockAndCreditMiners()
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 0 {
+		t.Fatal("Must hold block until confirmed")
+	}
+
+	backend.ConfirmRewardMismatch(ctx, round, "1000000000000000000")
+	unlocker.unlockAndCreditMiners()
+	matured, _ := backend.GetMaturedBlocks(ctx, 10)
+	if len(matured) != 1 || matured[0].RewardString != "1000000000000000000" {
+		t.Fatalf("Must credit confirmed reward: %+v", matured)
+	}
+	if balance, _ := backend.GetBalance(ctx, "0xa"); balance != 990000000 {
+		t.Errorf("Must credit miner from confirmed reward: %v", balance)
+	}
+	if mismatches, _ := backend.GetRewardMismatches(ctx); len(mismatches) != 0 {
+		t.Errorf("Must remove confirmed mismatch: %+v", mismatches)
+	}
+}
+
+func TestVerifyRewardsHeldRound(t *testing.T) {
+	ctx := context.Background()
+	node := &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply), uncles: make(map[int64][]*rpc.GetBlockReply), balance: "0x0"}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x4", "0x0", "0x0"}, 1000, 4000, 99, 0, nil)
+	// Our block and our uncle are both included at height 100
+	blockHash, uncleHash := fmt.Sprintf("0x%064x", 0xabc), fmt.Sprintf("0x%064x", 0xabd)
+	node.blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: blockHash, Nonce: "0x3", Uncles: []string{uncleHash}}
+	node.uncles[100] = []*rpc.GetBlockReply{{Number: "0x63", Hash: uncleHash, Nonce: "0x4"}}
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16,
+		Coinbase: "0x2a42292799d49895a4c8d39411ae735e82987008", Daemon: server.URL, Timeout: "5s",
+	}, backend)
+	reward := new(big.Int).Add(GetBlockReward(100), getRewardForUncles(100, 1))
+	reward.Add(reward, getUncleReward(unlocker.config.UncleRules, 99, 100))
+	node.balances = map[string]string{"0x63": "0x0", "0x64": "0x" + reward.Text(16)}
+	unlocker.unlockPendingBlocks()
+
+	// Uncle is held by earlier mismatch, block must still be checked against both rewards
+	uncleRound := "100:" + uncleHash
+	backend.WriteRewardMismatch(ctx, &storage.RewardMismatch{Round: uncleRound, Height: 100, Hash: uncleHash})
+	node.height = 140
+	unlocker.unlockAndCreditMiners()
+	if unlocker.halt {
+		t.Fatalf("Must not halt: %v", unlocker.lastFail)
+	}
+	matured, _ := backend.GetMaturedBlocks(ctx, 10)
+	if len(matured) != 1 || matured[0].Hash != blockHash {
+		t.Fatalf("Must credit block with reward of held uncle counted: %+v", matured)
+	}
+	if mismatches, _ := backend.GetRewardMismatches(ctx); len(mismatches) != 1 {
+		t.Fatalf("Must not record mismatch of block: %+v", mismatches)
+	}
+
+	// Block is credited by now, uncle checked again must still be checked against both rewards
+	backend.RemoveRewardMismatch(ctx, uncleRound)
+	unlocker.unlockAndCreditMiners()
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 2 {
+		t.Fatalf("Must credit uncle with reward of credited block counted: %+v", matured)
+	}
+	if mismatches, _ := backend.GetRewardMismatches(ctx); len(mismatches) != 0 {
+		t.Errorf("Must not record mismatch of uncle: %+v", mismatches)
+	}
+}
+
+func TestUnlockCandidatesWrongHeight(t *testing.T) {
+	ctx := context.Background()
+	node := &testNode{height: 140, blocks: make(map[int64]*rpc.GetBlockReply), uncles: make(map[int64][]*rpc.GetBlockReply)}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	// Recorded round heights are off, blocks were actually mined few blocks back and forward
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x1", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x2", "0x0", "0x0"}, 1000, 4000, 101, 0, nil)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 102, 0, nil)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x4", "0x0", "0x0"}, 1000, 4000, 103, 0, nil)
+	node.blocks[97] = &rpc.GetBlockReply{Number: "0x61", Hash: fmt.Sprintf("0x%064x", 0xa1), Nonce: "0x1"}
+	node.blocks[110] = &rpc.GetBlockReply{Number: "0x6e", Hash: fmt.Sprintf("0x%064x", 0xa2), Nonce: "0x2"}
+	// Third one became uncle included by later block
+	node.blocks[104] = &rpc.GetBlockReply{Number: "0x68", Hash: fmt.Sprintf("0x%064x", 104), Uncles: []string{"0xu"}}
+	node.uncles[104] = []*rpc.GetBlockReply{{Number: "0x66", Hash: fmt.Sprintf("0x%064x", 0xa3), Nonce: "0x3"}}
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16,
+		Daemon: server.URL, Timeout: "5s",
+	}, backend)
+
+	candidates, _ := backend.GetCandidates(ctx, 120)
+	result, err := unlocker.unlockCandidates(candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.blocks != 2 || result.uncles != 1 || result.orphans != 1 {
+		t.Fatalf("Must find blocks at wrong height: %+v", result)
+	}
+	heights := make(map[string]*storage.BlockData)
+	for _, block := range result.maturedBlocks {
+		heights[block.Nonce] = block
+	}
+	if heights["0x1"].Height != 97 || heights["0x2"].Height != 110 {
+		t.Errorf("Must correct block height: %+v, %+v", heights["0x1"], heights["0x2"])
+	}
+	if b := heights["0x3"]; b.Height != 104 || b.UncleHeight != 102 {
+		t.Errorf("Must find uncle in later block: %+v", b)
+	}
+	if len(result.orphanedBlocks) != 1 || result.orphanedBlocks[0].Nonce != "0x4" {
+		t.Errorf("Must orphan block not found in window: %+v", result.orphanedBlocks)
+	}
+	// Blocks of all candidates in one batch, uncles in another, reused by next unmatched candidate
+	if node.requests != 2 {
+		t.Errorf("Must batch node requests: %v", node.requests)
+	}
+
+	node.height = 110
+	if _, err := unlocker.unlockCandidates(candidates); err == nil {
+		t.Error("Must fail if node is behind search window")
+	}
+}
+
+func TestGetExtraRewardForTx(t *testing.T) {
+	node := &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply)}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16,
+		Daemon: server.URL, Timeout: "5s",
+	}, storage.NewMemoryBackend())
+	unlocker.retryDelay = time.Millisecond
+
+	block := &rpc.GetBlockReply{Number: "0x64", Hash: fmt.Sprintf("0x%064x", 0xabc), Transactions: []rpc.Tx{
+		{Hash: "0x1", GasPrice: "0x1"}, {Hash: "0x2", GasPrice: "0x2"}, {Hash: "0x3", GasPrice: "0x3"},
+	}}
+	node.failRequests = 2
+	fee, err := unlocker.getExtraRewardForTx(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each receipt uses 21000 gas
+	if fee.Int64() != 126000 {
+		t.Errorf("Must sum fees of all txs: %v", fee)
+	}
+	if node.requests != 3 {
+		t.Errorf("Must fetch receipts in one batch after retries: %v", node.requests)
+	}
+
+	if fee, _ := unlocker.getExtraRewardForTx(block); fee.Int64() != 126000 || node.requests != 3 {
+		t.Errorf("Must reuse fees of the same block: %v, %v requests", fee, node.requests)
+	}
+
+	block.Hash = fmt.Sprintf("0x%064x", 0xabd)
+	node.failRequests = receiptRetries + 1
+	if _, err := unlocker.getExtraRewardForTx(block); err == nil {
+		t.Error("Must fail after retries")
+	}
+	if node.requests != 3+receiptRetries+1 {
+		t.Errorf("Must retry %v times: %v", receiptRetries, node.requests)
+	}
+}
+
+func TestUnlockerHalt(t *testing.T) {
+	ctx := context.Background()
+	node := &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply)}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	cfg := &UnlockerConfig{Enabled: true, PoolFee: 1.0, Depth: 32, ImmatureDepth: 16, Daemon: server.URL, Timeout: "5s"}
+	unlocker := NewBlockUnlocker(cfg, backend)
+
+	node.failRequests = 1
+	err := unlocker.unlockPendingBlocks()
+	if !isTransient(err) || unlocker.halt {
+		t.Fatalf("Must not halt on node failure: %v", err)
+	}
+	if delay := unlocker.nextRun(err, time.Minute); delay != passRetryDelay {
+		t.Errorf("Must retry failed pass sooner: %v", delay)
+	}
+	if delay := unlocker.nextRun(unlocker.unlockPendingBlocks(), time.Minute); delay != time.Minute || unlocker.failures != 0 {
+		t.Errorf("Must reset backoff after successful pass: %v", delay)
+	}
+
+	unlocker.fail(fmt.Errorf("broken ledger"))
+	if halt, _, _ := backend.GetModuleHalt(ctx, "unlocker"); halt != "broken ledger" {
+		t.Fatalf("Must persist halt reason: %v", halt)
+	}
+	unlocker = NewBlockUnlocker(cfg, backend)
+	if !unlocker.halt {
+		t.Fatal("Must stay halted after restart")
+	}
+
+	backend.ResumeModule(ctx, "unlocker")
+	if paused, _ := unlocker.isPaused(); paused || unlocker.halt {
+		t.Error("Must resume halted unlocker")
+	}
+	if halt, _, _ := backend.GetModuleHalt(ctx, "unlocker"); halt != "" {
+		t.Errorf("Must clear halt reason on resume: %v", halt)
+	}
+}
+
+type stateFailingBackend struct {
+	*storage.MemoryBackend
+}
+
+func (b *stateFailingBackend) GetModuleState(ctx context.Context, name string) (bool, int64, error) {
+	return false, 0, fmt.Errorf("connection refused")
+}
+
+func TestUnlockerUnknownState(t *testing.T) {
+	backend := &stateFailingBackend{storage.NewMemoryBackend()}
+	cfg := &UnlockerConfig{Enabled: true, PoolFee: 1.0, Depth: 32, ImmatureDepth: 16, Daemon: "http://127.0.0.1:1", Timeout: "1s"}
+	unlocker := NewBlockUnlocker(cfg, backend)
+
+	err := unlocker.unlock()
+	if !isTransient(err) || unlocker.halt {
+		t.Errorf("Must skip pass as transient if operator's pause is unknown: %v", err)
+	}
+}
+
+func TestUnlockerDaemons(t *testing.T) {
+	ctx := context.Background()
+	hash := fmt.Sprintf("0x%064x", 0xabc)
+	nodes := make([]*testNode, 2)
+	var daemons []*Daemon
+	for i := range nodes {
+		nodes[i] = &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply)}
+		nodes[i].blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: hash, Nonce: "0x3"}
+		server := httptest.NewServer(nodes[i])
+		defer server.Close()
+		daemons = append(daemons, &Daemon{Name: fmt.Sprintf("node%v", i), Url: server.URL, Timeout: "5s"})
+	}
+
+	backend := storage.NewMemoryBackend()
+	backend.WriteShare(ctx, "0xa", "rig", []string{"0x1", "0x0", "0x0"}, 2000, 100, 0)
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16, Daemons: daemons,
+	}, backend)
+	if unlocker.config.MinAgreement != 2 {
+		t.Fatalf("Must require agreement of two daemons by default: %v", unlocker.config.MinAgreement)
+	}
+
+	// First node is down, unlocker switches to the second one
+	nodes[0].failRequests = 1
+	unlocker.unlock()
+	if unlocker.rpc().Name != "BlockUnlocker:node1" {
+		t.Fatalf("Must switch to healthy daemon: %v", unlocker.rpc().Name)
+	}
+	if immature, _ := backend.GetImmatureBlocks(ctx, 1000); len(immature) != 1 {
+		t.Fatalf("Must unlock immature block: %+v", immature)
+	}
+
+	// Second node is on another fork now
+	nodes[1].blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: fmt.Sprintf("0x%064x", 0xdef), Nonce: "0x4"}
+	for _, node := range nodes {
+		node.height = 140
+	}
+	unlocker.unlock()
+	if unlocker.halt {
+		t.Fatalf("Must not halt: %v", unlocker.lastFail)
+	}
+	if unlocker.rpc().Name != "BlockUnlocker:node0" {
+		t.Fatalf("Must switch back to first healthy daemon: %v", unlocker.rpc().Name)
+	}
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 0 {
+		t.Fatalf("Must hold block which daemons disagree on: %+v", matured)
+	}
+
+	nodes[1].blocks[100] = nodes[0].blocks[100]
+	unlocker.unlock()
+	if matured, _ := backend.GetMaturedBlocks(ctx, 10); len(matured) != 1 || matured[0].Hash != hash {
+		t.Fatalf("Must mature block confirmed by both daemons: %+v", matured)
+	}
+}
+
+func TestUnlockerMinorityFork(t *testing.T) {
+	ctx := context.Background()
+	nodes := make([]*testNode, 2)
+	var daemons []*Daemon
+	for i := range nodes {
+		nodes[i] = &testNode{height: 120, blocks: make(map[int64]*rpc.GetBlockReply)}
+		server := httptest.NewServer(nodes[i])
+		defer server.Close()
+		daemons = append(daemons, &Daemon{Name: fmt.Sprintf("node%v", i), Url: server.URL, Timeout: "5s"})
+	}
+	// Current node is on a minority fork which doesn't have pool's block
+	nodes[1].blocks[100] = &rpc.GetBlockReply{Number: "0x64", Hash: fmt.Sprintf("0x%064x", 0xabc), Nonce: "0x3"}
+
+	backend := storage.NewMemoryBackend()
+	backend.WriteBlock(ctx, "0xa", "rig", []string{"0x3", "0x0", "0x0"}, 1000, 4000, 100, 0, nil)
+
+	noDonation := 0.0
+	unlocker := NewBlockUnlocker(&UnlockerConfig{
+		Enabled: true, PoolFee: 1.0, DevDonate: &noDonation, Depth: 32, ImmatureDepth: 16, Daemons: daemons,
+	}, backend)
+	unlocker.unlock()
+	if unlocker.halt || unlocker.rpc().Name != "BlockUnlocker:node0" {
+		t.Fatalf("Must stay on the first healthy daemon: %v %v", unlocker.rpc().Name, unlocker.lastFail)
+	}
+	if candidates, _ := backend.GetCandidates(ctx, 1000); len(candidates) != 1 || candidates[0].Orphan {
+		t.Fatalf("Must hold orphan which another daemon has: %+v", candidates)
+	}
+	if immature, _ := backend.GetImmatureBlocks(ctx, 1000); len(immature) != 0 {
+		t.Fatalf("Must not write orphan which another daemon has: %+v", immature)
+	}
+
+	delete(nodes[1].blocks, 100)
+	unlocker.unlock()
+	if candidates, _ := backend.GetCandidates(ctx, 1000); len(candidates) != 0 {
+		t.Fatalf("Must orphan block missed by both daemons: %+v", candidates)
+	}
+}
@@ -1,6 +1,8 @@
 package payouts
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -13,44 +15,93 @@ import (
 	"github.com/webchain-network/webchain-pool/rpc"
 	"github.com/webchain-network/webchain-pool/storage"
 	"github.com/webchain-network/webchain-pool/util"
-	"errors"
 )
 
 type UnlockerConfig struct {
 	Enabled        bool     `json:"enabled"`
 	PoolFee        float64  `json:"poolFee"`
 	PoolFeeAddress string   `json:"poolFeeAddress"`
+	// Replaces poolFee, poolFeeAddress and devDonate if set
+	FeeRecipients  []*storage.FeeRecipient `json:"feeRecipients"`
+	// Fees by average hashrate over tier window, per-miner overrides set with admin API take precedence
+	FeeTiers       []*storage.FeeTier      `json:"feeTiers"`
+	FeeTierWindow  string   `json:"feeTierWindow"`
 	Depth          int64    `json:"depth"`
 	DevDonate      *float64 `json:"devDonate,omitempty"`
+	// Percent of block reward credited to miner who found the block on top of his share
+	FinderBonus    float64  `json:"finderBonus"`
 	ImmatureDepth  int64    `json:"immatureDepth"`
 	KeepTxFees     bool     `json:"keepTxFees"`
+	// Dedicated coinbase of pool, matured rewards are verified against its balance change if set
+	Coinbase       string   `json:"coinbase"`
+	// Uncle reward rules of the chain: "ecip1017" (default) or "homestead"
+	UncleRules     string   `json:"uncleRules"`
 	Interval       string   `json:"interval"`
 	Daemon         string   `json:"daemon"`
 	Timeout        string   `json:"timeout"`
+	// Replaces daemon and timeout if set, first healthy node is used
+	Daemons        []*Daemon `json:"daemons"`
+	// Number of nodes which must agree on block hash before block is matured, 2 by default with several daemons
+	MinAgreement   int      `json:"minAgreement"`
 }
 
 const minDepth = 16
 
+// Receipts are requested in batches of receiptBatch, failed requests are retried
+// receiptRetries times with doubling delay before unlocking pass fails
+const (
+	receiptBatch   = 256
+	receiptRetries = 3
+	txFeeCacheSize = 1024
+)
+
+// First retry of unlocking pass after transient failure, doubled up to unlocking interval
+const passRetryDelay = 10 * time.Second
+
 var (
+	big8                     = big.NewInt(8)
 	big32                    = big.NewInt(32)
+	eraLength                = big.NewInt(100000)
 	DisinflationRateQuotient = big.NewInt(249)
 	DisinflationRateDivisor  = big.NewInt(250)
 )
 
+// ECIP-1017 rewards uncles depending on depth in the first era only and with 1/32 of era's block reward later,
+// homestead rewards uncles depending on depth in every era. Block winner gets 1/32 per included uncle in both.
+const (
+	uncleRulesECIP1017  = "ecip1017"
+	uncleRulesHomestead = "homestead"
+)
+
 const donationFee = 10.0
 const donationAccount = "0x2a42292799d49895a4c8d39411ae735e82987008"
 
 type BlockUnlocker struct {
-	config   *UnlockerConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config      *UnlockerConfig
+	backend     storage.Backend
+	nodes       *nodeSet
+	halt        bool
+	lastFail    error
+	resumedAt   int64
+	fees        *storage.FeeSchedule
+	tierWindow  time.Duration
+	// Tx fees by block hash, block is seen by both immature and matured passes
+	txFees      map[string]*big.Int
+	txFeesOrder []string
+	retryDelay  time.Duration
+	failures    int
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
-	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
-		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
+func NewBlockUnlocker(cfg *UnlockerConfig, backend storage.Backend) *BlockUnlocker {
+	ctx := context.Background()
+	fees := newFeeSchedule(cfg)
+	for _, r := range fees.Recipients {
+		if len(r.Address) != 0 && !util.IsValidHexAddress(r.Address) {
+			log.Fatalf("Invalid address of fee recipient %v: %v", r.Name, r.Address)
+		}
+		if r.Fee < 0 {
+			log.Fatalf("Fee of recipient %v can't be < 0, your fee is %v", r.Name, r.Fee)
+		}
 	}
 	if cfg.Depth < minDepth*2 {
 		log.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
@@ -58,34 +109,204 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
 	if cfg.ImmatureDepth < minDepth {
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
+	if len(cfg.Coinbase) != 0 && !util.IsValidHexAddress(cfg.Coinbase) {
+		log.Fatalln("Invalid coinbase", cfg.Coinbase)
+	}
+	switch cfg.UncleRules {
+	case "":
+		cfg.UncleRules = uncleRulesECIP1017
+	case uncleRulesECIP1017, uncleRulesHomestead:
+	default:
+		log.Fatalf("Unknown uncle rules: %v", cfg.UncleRules)
+	}
+	if fees.Fee >= 100 {
+		log.Fatalf("Total pool fee must be < 100, your fee is %v", fees.Fee)
+	}
+	if cfg.FinderBonus < 0 || fees.Fee+cfg.FinderBonus >= 100 {
+		log.Fatalf("Finder bonus must be >= 0 and < %v, your bonus is %v", 100-fees.Fee, cfg.FinderBonus)
+	}
+	for _, tier := range fees.Tiers {
+		if tier.Fee < 0 || tier.Fee+cfg.FinderBonus >= 100 {
+			log.Fatalf("Fee of tier %v must be >= 0 and < %v, your fee is %v", tier.Hashrate, 100-cfg.FinderBonus, tier.Fee)
+		}
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, fees: fees, txFees: make(map[string]*big.Int), retryDelay: time.Second}
+	if len(fees.Tiers) > 0 {
+		u.tierWindow = util.MustParseDuration(cfg.FeeTierWindow)
+	}
+	u.nodes = newNodeSet("BlockUnlocker", cfg.Daemons, cfg.Daemon, cfg.Timeout)
+	if cfg.MinAgreement == 0 {
+		cfg.MinAgreement = 1
+		if len(u.nodes.clients) > 1 {
+			cfg.MinAgreement = 2
+		}
+	}
+	if cfg.MinAgreement < 0 || cfg.MinAgreement > len(u.nodes.clients) {
+		log.Fatalf("Node agreement must be between 1 and number of daemons %v, your agreement is %v", len(u.nodes.clients), cfg.MinAgreement)
+	}
+	// Ignore resume requests made before start
+	_, u.resumedAt, _ = backend.GetModuleState(ctx, "unlocker")
+	if reason, _, _ := backend.GetModuleHalt(ctx, "unlocker"); len(reason) > 0 {
+		log.Println("Unlocking suspended due to critical error before restart:", reason)
+		u.halt = true
+		u.lastFail = errors.New(reason)
+	}
 	return u
 }
 
+// Legacy poolFee is split between pool and dev donation if no recipients configured
+func newFeeSchedule(cfg *UnlockerConfig) *storage.FeeSchedule {
+	fees := &storage.FeeSchedule{FinderBonus: cfg.FinderBonus, Recipients: cfg.FeeRecipients, Tiers: cfg.FeeTiers, TierWindow: cfg.FeeTierWindow}
+	if len(fees.Recipients) == 0 {
+		devdonate := donationFee
+		if cfg.DevDonate != nil && *cfg.DevDonate >= 0.0 && *cfg.DevDonate < 100.0 {
+			devdonate = *cfg.DevDonate
+		}
+		donation := cfg.PoolFee * devdonate / 100
+		fees.Recipients = []*storage.FeeRecipient{{Name: "pool", Address: cfg.PoolFeeAddress, Fee: cfg.PoolFee - donation}}
+		if donation > 0 {
+			fees.Recipients = append(fees.Recipients, &storage.FeeRecipient{Name: "dev", Address: donationAccount, Fee: donation})
+		}
+	}
+	for _, r := range fees.Recipients {
+		fees.Fee += r.Fee
+	}
+	return fees
+}
+
 func (u *BlockUnlocker) Start() {
 	log.Println("Starting block unlocker")
+	// Publish fee split for API
+	if err := u.backend.WriteFeeSchedule(context.Background(), u.fees); err != nil {
+		log.Printf("Failed to write fee schedule to backend: %v", err)
+	}
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
-	timer.Reset(intv)
+	timer.Reset(u.nextRun(u.unlock(), intv))
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
-				timer.Reset(intv)
+				timer.Reset(u.nextRun(u.unlock(), intv))
 			}
 		}
 	}()
 }
 
+func (u *BlockUnlocker) unlock() error {
+	paused, err := u.isPaused()
+	if err != nil {
+		// Operator may have paused unlocking, skip the pass until state is known
+		log.Printf("Failed to get unlocker state from backend: %v", err)
+		return transient(err)
+	}
+	if paused {
+		return nil
+	}
+	u.nodes.check()
+	if err := u.unlockPendingBlocks(); err != nil {
+		return err
+	}
+	return u.unlockAndCreditMiners()
+}
+
+func (u *BlockUnlocker) rpc() *rpc.RPCClient {
+	return u.nodes.rpc()
+}
+
+// Runs single unlocking pass, used by "blocks recheck" command
+func (u *BlockUnlocker) Recheck() error {
+	err := u.unlock()
+	if u.halt {
+		return u.lastFail
+	}
+	return err
+}
+
+// Pass failed by transient error is retried sooner, delay doubles with every failure in a row
+func (u *BlockUnlocker) nextRun(err error, intv time.Duration) time.Duration {
+	if !isTransient(err) {
+		u.failures = 0
+		return intv
+	}
+	u.failures++
+	delay := retryBackoff(u.failures, intv)
+	log.Printf("Retrying unlocking in %v after %v failures in a row", delay, u.failures)
+	return delay
+}
+
+func retryBackoff(failures int, max time.Duration) time.Duration {
+	delay := passRetryDelay
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// Node and backend read failures are expected to go away by themselves, unlocking is retried.
+// Any other error means that accounting may be inconsistent and halts unlocker until operator resumes it.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func transient(err error) error {
+	return &transientError{err}
+}
+
+func isTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// Halt reason is persisted in backend, so halt survives restart
+func (u *BlockUnlocker) fail(err error) error {
+	if isTransient(err) {
+		return err
+	}
+	u.halt = true
+	u.lastFail = err
+	if err := u.backend.HaltModule(context.Background(), "unlocker", err.Error()); err != nil {
+		log.Printf("Failed to persist unlocker halt in backend: %v", err)
+	}
+	return err
+}
+
+// Applies pause and resume requests made by operator through admin API
+func (u *BlockUnlocker) isPaused() (bool, error) {
+	ctx := context.Background()
+	paused, resumedAt, err := u.backend.GetModuleState(ctx, "unlocker")
+	if err != nil {
+		return false, err
+	}
+	if resumedAt > u.resumedAt {
+		u.resumedAt = resumedAt
+		if u.halt {
+			log.Println("Unlocking resumed by operator after critical error:", u.lastFail)
+			u.halt = false
+			u.lastFail = nil
+		}
+	}
+	if paused {
+		log.Println("Unlocking paused by operator")
+	}
+	return paused, nil
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -104,79 +325,65 @@ type UnlockResult struct {
 func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*UnlockResult, error) {
 	result := &UnlockResult{}
 
-	// Data row is: "height:nonce:powHash:mixDigest:timestamp:diff:totalShares"
+	// Windows of candidates mostly overlap, so blocks are fetched once for all of them
+	cache := newBlockCache(u.rpc())
+	var heights []int64
+	for _, candidate := range candidates {
+		heights = append(heights, searchWindow(candidate.Height)...)
+	}
+	if err := cache.fetchBlocks(heights); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
 	for _, candidate := range candidates {
 		orphan := true
+		window := searchWindow(candidate.Height)
 
-		/* Search for a normal block with wrong height here by traversing 16 blocks back and forward.
-		 * Also we are searching for a block that can include this one as uncle.
-		 */
-		var startBlock int64 = minDepth * -1
-		if startBlock < 0 {
-			startBlock = 0
-		}
-		for i := startBlock; i < minDepth; i++ {
-			height := candidate.Height + i
-			block, err := u.rpc.GetBlockByHeight(height)
-			if err != nil {
-				log.Printf("Error while retrieving block %v from node: %v", height, err)
-				return nil, err
-			}
-			if block == nil {
-				return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
+		// Search for a normal block with wrong height here
+		for _, height := range window {
+			block := cache.blocks[height]
+			if !matchCandidate(block, candidate) {
+				continue
 			}
+			orphan = false
+			result.blocks++
 
-			if matchCandidate(block, candidate) {
-				orphan = false
-				result.blocks++
-
-				err = u.handleBlock(block, candidate)
-				if err != nil {
-					u.halt = true
-					u.lastFail = err
-					return nil, err
-				}
-				result.maturedBlocks = append(result.maturedBlocks, candidate)
-				log.Printf("Mature block %v with %v tx, hash: %v", candidate.Height, len(block.Transactions), candidate.Hash[0:10])
-				break
+			err := u.handleBlock(block, candidate)
+			if err != nil {
+				return nil, err
 			}
+			result.maturedBlocks = append(result.maturedBlocks, candidate)
+			log.Printf("Mature block %v with %v tx, hash: %v", candidate.Height, len(block.Transactions), candidate.Hash[0:10])
+			break
+		}
 
-			if len(block.Uncles) == 0 {
-				continue
+		// Also we are searching for a block that included this one as uncle, uncles are fetched only if needed
+		if orphan {
+			if err := cache.fetchUncles(window); err != nil {
+				return nil, err
 			}
-
-			// Trying to find uncle in current block during our forward check
-			for uncleIndex, uncleHash := range block.Uncles {
-				uncle, err := u.rpc.GetUncleByBlockNumberAndIndex(height, uncleIndex)
-				if err != nil {
-					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node: %v", uncleHash, err)
-				}
-				if uncle == nil {
-					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node", height)
-				}
-
-				// Found uncle
-				if matchCandidate(uncle, candidate) {
+		search:
+			for _, height := range window {
+				for _, uncle := range cache.uncles[height] {
+					if !matchCandidate(uncle, candidate) {
+						continue
+					}
 					orphan = false
 					result.uncles++
 
-					err := handleUncle(height, uncle, candidate)
+					err := u.handleUncle(height, uncle, candidate)
 					if err != nil {
-						u.halt = true
-						u.lastFail = err
 						return nil, err
 					}
 					result.maturedBlocks = append(result.maturedBlocks, candidate)
 					log.Printf("Mature uncle %v/%v of reward %v with hash: %v", candidate.Height, candidate.UncleHeight,
 						util.FormatReward(candidate.Reward), uncle.Hash[0:10])
-					break
+					break search
 				}
 			}
-			// Found block or uncle
-			if !orphan {
-				break
-			}
 		}
+
 		// Block is lost, we didn't find any valid block or uncle matching our data in a blockchain
 		if orphan {
 			result.orphans++
@@ -188,6 +395,91 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 	return result, nil
 }
 
+// Heights within minDepth back and forward of round height, nearest first
+func searchWindow(height int64) []int64 {
+	window := []int64{height}
+	for i := int64(1); i < minDepth; i++ {
+		window = append(window, height+i)
+		if height-i >= 0 {
+			window = append(window, height-i)
+		}
+	}
+	return window
+}
+
+// Node is asked for this many blocks in a single batch request
+const blockBatch = 64
+
+// Blocks and uncles fetched during single unlocking pass
+type blockCache struct {
+	client *rpc.RPCClient
+	blocks map[int64]*rpc.GetBlockReply
+	uncles map[int64][]*rpc.GetBlockReply
+}
+
+func newBlockCache(client *rpc.RPCClient) *blockCache {
+	return &blockCache{
+		client: client,
+		blocks: make(map[int64]*rpc.GetBlockReply),
+		uncles: make(map[int64][]*rpc.GetBlockReply),
+	}
+}
+
+func (c *blockCache) fetchBlocks(heights []int64) error {
+	var missing []int64
+	seen := make(map[int64]bool)
+	for _, height := range heights {
+		if _, ok := c.blocks[height]; !ok && !seen[height] {
+			seen[height] = true
+			missing = append(missing, height)
+		}
+	}
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > blockBatch {
+			n = blockBatch
+		}
+		blocks, err := c.client.GetBlocksByHeight(missing[:n])
+		if err != nil {
+			return transient(fmt.Errorf("Error while retrieving blocks from node: %v", err))
+		}
+		for i, block := range blocks {
+			if block == nil {
+				return transient(fmt.Errorf("Error while retrieving block %v from node, wrong node height", missing[i]))
+			}
+			c.blocks[missing[i]] = block
+		}
+		missing = missing[n:]
+	}
+	return nil
+}
+
+// Blocks of given heights must be fetched already
+func (c *blockCache) fetchUncles(heights []int64) error {
+	counts := make(map[int64]int)
+	for _, height := range heights {
+		if _, ok := c.uncles[height]; !ok && len(c.blocks[height].Uncles) > 0 {
+			counts[height] = len(c.blocks[height].Uncles)
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	uncles, err := c.client.GetUnclesByBlockNumber(counts)
+	if err != nil {
+		return transient(fmt.Errorf("Error while retrieving uncles from node: %v", err))
+	}
+	for height := range counts {
+		for _, uncle := range uncles[height] {
+			if uncle == nil {
+				return transient(fmt.Errorf("Error while retrieving uncle of block %v from node", height))
+			}
+		}
+		c.uncles[height] = uncles[height]
+	}
+	return nil
+}
+
 func matchCandidate(block *rpc.GetBlockReply, candidate *storage.BlockData) bool {
 	// Just compare hash if block is unlocked as immature
 	if len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.Hash) {
@@ -237,6 +529,11 @@ func GetBlockWinnerRewardByEra(eraOrig *big.Int) *big.Int {
 	return r
 }
 
+// GetBlockReward gets a winner's reward of block at height, without fees and uncle inclusion rewards.
+func GetBlockReward(height int64) *big.Int {
+	return GetBlockWinnerRewardByEra(GetBlockEra(big.NewInt(height), eraLength))
+}
+
 // GetBlockEra gets which "Era" a given block is within, given an era length (100,000 blocks)
 // Returns a zero-index era number, so "Era 1": 0, "Era 2": 1, "Era 3": 2 ...
 func GetBlockEra(blockNum, eraLength *big.Int) *big.Int {
@@ -261,24 +558,23 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	}
 	candidate.Height = correctHeight
 
-	era := GetBlockEra(big.NewInt(candidate.Height), big.NewInt(100000))
+	era := GetBlockEra(big.NewInt(candidate.Height), eraLength)
 	reward := GetBlockWinnerRewardByEra(era)
 
 	// Add TX fees
 	extraTxReward, err := u.getExtraRewardForTx(block)
 	if err != nil {
-		return fmt.Errorf("Error while fetching TX receipt: %v", err)
+		return fmt.Errorf("Error while fetching TX receipt: %w", err)
 	}
 	if u.config.KeepTxFees {
 		candidate.ExtraReward = extraTxReward
 	} else {
+		candidate.ExtraReward = nil
 		reward.Add(reward, extraTxReward)
 	}
 
 	// Add reward for including uncles
-	uncleReward := getEraUncleBlockReward(era)
-	rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
-	reward.Add(reward, rewardForUncles)
+	reward.Add(reward, getRewardForUncles(candidate.Height, len(block.Uncles)))
 
 	candidate.Orphan = false
 	candidate.Hash = block.Hash
@@ -286,12 +582,12 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	return nil
 }
 
-func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.BlockData) error {
+func (u *BlockUnlocker) handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.BlockData) error {
 	uncleHeight, err := strconv.ParseInt(strings.Replace(uncle.Number, "0x", "", -1), 16, 64)
 	if err != nil {
 		return err
 	}
-	reward := getUncleReward(uncleHeight, height)
+	reward := getUncleReward(u.config.UncleRules, uncleHeight, height)
 	candidate.Height = height
 	candidate.UncleHeight = uncleHeight
 	candidate.Orphan = false
@@ -300,55 +596,48 @@ func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.Bloc
 	return nil
 }
 
-func (u *BlockUnlocker) unlockPendingBlocks() {
+func (u *BlockUnlocker) unlockPendingBlocks() error {
+	ctx := context.Background()
 	if u.halt {
 		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
+		return nil
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	current, err := u.rpc().GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Unable to get current blockchain height from node: %v", err)
-		return
+		return transient(err)
 	}
 	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Can't parse pending block number: %v", err)
-		return
+		return u.fail(err)
 	}
 
-	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
+	candidates, err := u.backend.GetCandidates(ctx, currentHeight - u.config.ImmatureDepth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Failed to get block candidates from backend: %v", err)
-		return
+		return transient(err)
 	}
 
 	if len(candidates) == 0 {
 		log.Println("No block candidates to unlock")
-		return
+		return nil
 	}
 
 	result, err := u.unlockCandidates(candidates)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Failed to unlock blocks: %v", err)
-		return
+		return u.fail(err)
 	}
 	log.Printf("Immature %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
 
-	err = u.backend.WritePendingOrphans(result.orphanedBlocks)
+	result.orphanedBlocks = u.confirmOrphans(result.orphanedBlocks)
+	result.orphans = len(result.orphanedBlocks)
+	err = u.backend.WritePendingOrphans(ctx, result.orphanedBlocks)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Failed to insert orphaned blocks into backend: %v", err)
-		return
+		return u.fail(err)
 	} else {
 		log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 	}
@@ -360,17 +649,13 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 	for _, block := range result.maturedBlocks {
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
 			log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
-			return
+			return u.fail(err)
 		}
-		err = u.backend.WriteImmatureBlock(block, roundRewards)
+		err = u.backend.WriteImmatureBlock(ctx, block, roundRewards)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
 			log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
-			return
+			return u.fail(err)
 		}
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
@@ -387,6 +672,9 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		for login, reward := range roundRewards {
 			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
 		}
+		if block.FinderBonus > 0 {
+			entries = append(entries, fmt.Sprintf("\tBONUS %v: %v: %v Shannon", block.RoundKey(), block.Finder, block.FinderBonus))
+		}
 		log.Println(strings.Join(entries, "\n"))
 	}
 
@@ -396,80 +684,96 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		util.FormatRatReward(totalMinersProfit),
 		util.FormatRatReward(totalPoolProfit),
 	)
+	return nil
 }
 
-func (u *BlockUnlocker) unlockAndCreditMiners() {
+func (u *BlockUnlocker) unlockAndCreditMiners() error {
+	ctx := context.Background()
 	if u.halt {
 		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
+		return nil
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	current, err := u.rpc().GetPendingBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Unable to get current blockchain height from node: %v", err)
-		return
+		return transient(err)
 	}
 	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Can't parse pending block number: %v", err)
-		return
+		return u.fail(err)
 	}
 
-	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
+	immature, err := u.backend.GetImmatureBlocks(ctx, currentHeight - u.config.Depth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Failed to get block candidates from backend: %v", err)
-		return
+		return transient(err)
 	}
 
 	if len(immature) == 0 {
 		log.Println("No immature blocks to credit miners")
-		return
+		return nil
 	}
 
 	result, err := u.unlockCandidates(immature)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
 		log.Printf("Failed to unlock blocks: %v", err)
-		return
+		return u.fail(err)
 	}
 	log.Printf("Unlocked %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
 
+	result.orphanedBlocks = u.confirmOrphans(result.orphanedBlocks)
+	result.orphans = len(result.orphanedBlocks)
 	for _, block := range result.orphanedBlocks {
-		err = u.backend.WriteOrphan(block)
+		err = u.backend.WriteOrphan(ctx, block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
 			log.Printf("Failed to insert orphaned block into backend: %v", err)
-			return
+			return u.fail(err)
 		}
 	}
 	log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 
+	held := u.checkAgreement(result.maturedBlocks)
+	var agreed []*storage.BlockData
+	for _, block := range result.maturedBlocks {
+		if !held[block.RoundKey()] {
+			agreed = append(agreed, block)
+		}
+	}
+	mismatched, err := u.verifyRewards(ctx, agreed, result.maturedBlocks)
+	if err != nil {
+		log.Printf("Failed to verify block rewards: %v", err)
+		return u.fail(err)
+	}
+	for round := range mismatched {
+		held[round] = true
+	}
+
 	totalRevenue := new(big.Rat)
 	totalMinersProfit := new(big.Rat)
 	totalPoolProfit := new(big.Rat)
 
 	for _, block := range result.maturedBlocks {
+		if held[block.RoundKey()] {
+			log.Printf("Crediting of round %v is held until reward is confirmed by operator", block.RoundKey())
+			continue
+		}
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
 			log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
-			return
+			return u.fail(err)
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		err = u.backend.WriteMaturedBlock(ctx, block, roundRewards)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
 			log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
-			return
+			return u.fail(err)
+		}
+		if block.RewardConfirmed {
+			err = u.backend.RemoveRewardMismatch(ctx, block.RoundKey())
+			if err != nil {
+				log.Printf("Failed to remove confirmed reward mismatch of round %v: %v", block.RoundKey(), err)
+			}
 		}
 		totalRevenue.Add(totalRevenue, revenue)
 		totalMinersProfit.Add(totalMinersProfit, minersProfit)
@@ -486,6 +790,9 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		for login, reward := range roundRewards {
 			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
 		}
+		if block.FinderBonus > 0 {
+			entries = append(entries, fmt.Sprintf("\tBONUS %v: %v: %v Shannon", block.RoundKey(), block.Finder, block.FinderBonus))
+		}
 		log.Println(strings.Join(entries, "\n"))
 	}
 
@@ -495,46 +802,368 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		util.FormatRatReward(totalMinersProfit),
 		util.FormatRatReward(totalPoolProfit),
 	)
+	return nil
+}
+
+// Blocks are credited only if enough nodes have them in their chain, so a node on minority fork
+// can't make pool credit orphans. Rounds without agreement stay immature until the next pass.
+func (u *BlockUnlocker) checkAgreement(blocks []*storage.BlockData) map[string]bool {
+	held := make(map[string]bool)
+	if u.config.MinAgreement < 2 || len(blocks) == 0 {
+		return held
+	}
+	var heights []int64
+	seen := make(map[int64]bool)
+	for _, block := range blocks {
+		if !seen[block.Height] {
+			seen[block.Height] = true
+			heights = append(heights, block.Height)
+		}
+	}
+
+	// Current node found these blocks already
+	agreed := make(map[string]int)
+	for _, block := range blocks {
+		agreed[block.RoundKey()] = 1
+	}
+	for _, client := range u.nodes.others() {
+		replies, err := client.GetBlocksByHeight(heights)
+		if err != nil {
+			log.Printf("Failed to confirm blocks with daemon %v: %v", client.Name, err)
+			continue
+		}
+		byHeight := make(map[int64]*rpc.GetBlockReply)
+		for i, reply := range replies {
+			byHeight[heights[i]] = reply
+		}
+		for _, block := range blocks {
+			if includesBlock(byHeight[block.Height], block) {
+				agreed[block.RoundKey()]++
+			}
+		}
+	}
+
+	for _, block := range blocks {
+		if n := agreed[block.RoundKey()]; n < u.config.MinAgreement {
+			log.Printf("Round %v is confirmed by %v of %v required daemons, crediting is held", block.RoundKey(), n, u.config.MinAgreement)
+			held[block.RoundKey()] = true
+		}
+	}
+	return held
+}
+
+// Current node may be on a minority fork, so block is orphaned only if enough nodes miss it.
+// Returns orphans confirmed by MinAgreement nodes, the rest is left as is until next pass.
+func (u *BlockUnlocker) confirmOrphans(orphans []*storage.BlockData) []*storage.BlockData {
+	if u.config.MinAgreement < 2 || len(orphans) == 0 {
+		return orphans
+	}
+	var heights []int64
+	for _, block := range orphans {
+		heights = append(heights, searchWindow(block.Height)...)
+	}
+
+	// Current node misses these blocks already
+	missed := make([]int, len(orphans))
+	for i := range missed {
+		missed[i] = 1
+	}
+	for _, client := range u.nodes.others() {
+		found, err := findCandidates(client, heights, orphans)
+		if err != nil {
+			log.Printf("Failed to confirm orphans with daemon %v: %v", client.Name, err)
+			continue
+		}
+		for i := range orphans {
+			if !found[i] {
+				missed[i]++
+			}
+		}
+	}
+
+	var confirmed []*storage.BlockData
+	for i, block := range orphans {
+		if missed[i] < u.config.MinAgreement {
+			log.Printf("Orphan %v:%v is confirmed by %v of %v required daemons, it's held", block.RoundHeight, block.Nonce, missed[i], u.config.MinAgreement)
+			continue
+		}
+		confirmed = append(confirmed, block)
+	}
+	return confirmed
+}
+
+// Looks candidates up among blocks and uncles of their search windows on given node
+func findCandidates(client *rpc.RPCClient, heights []int64, candidates []*storage.BlockData) ([]bool, error) {
+	cache := newBlockCache(client)
+	if err := cache.fetchBlocks(heights); err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(candidates))
+	for i, candidate := range candidates {
+		window := searchWindow(candidate.Height)
+		for _, height := range window {
+			if matchCandidate(cache.blocks[height], candidate) {
+				found[i] = true
+				break
+			}
+		}
+		if found[i] {
+			continue
+		}
+		if err := cache.fetchUncles(window); err != nil {
+			return nil, err
+		}
+	search:
+		for _, height := range window {
+			for _, uncle := range cache.uncles[height] {
+				if matchCandidate(uncle, candidate) {
+					found[i] = true
+					break search
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// Uncles are looked up by hash in uncles of including block
+func includesBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) bool {
+	if block == nil {
+		return false
+	}
+	if candidate.UncleHeight == 0 {
+		return strings.EqualFold(block.Hash, candidate.Hash)
+	}
+	for _, hash := range block.Uncles {
+		if strings.EqualFold(hash, candidate.Hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares computed rewards of blocks and uncles included at the same height with coinbase balance change
+// at that height. Rounds with mismatched rewards are held until operator confirms them. All of our rounds
+// included at the height add to computed reward, those unlocked in this pass and those credited before.
+func (u *BlockUnlocker) verifyRewards(ctx context.Context, blocks, unlocked []*storage.BlockData) (map[string]bool, error) {
+	held := make(map[string]bool)
+	if len(u.config.Coinbase) == 0 {
+		return held, nil
+	}
+	mismatches, err := u.backend.GetRewardMismatches(ctx)
+	if err != nil {
+		return nil, transient(err)
+	}
+
+	rounds := make(map[int64][]*storage.BlockData)
+	for _, block := range blocks {
+		if m, ok := mismatches[block.RoundKey()]; ok {
+			if !m.Confirmed {
+				held[block.RoundKey()] = true
+			} else if err := applyConfirmedReward(block, m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rounds[block.Height] = append(rounds[block.Height], block)
+	}
+
+	for height, checked := range rounds {
+		reward, err := u.includedReward(ctx, height, unlocked, mismatches)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := u.coinbaseDelta(height)
+		if err != nil {
+			return nil, transient(err)
+		}
+		if actual.Cmp(reward) == 0 {
+			continue
+		}
+		log.Printf("Reward mismatch at height %v: computed %v, coinbase balance changed by %v",
+			height, util.FormatReward(reward), util.FormatReward(actual))
+		for _, block := range checked {
+			m := &storage.RewardMismatch{
+				Round: block.RoundKey(), Height: height, Hash: block.Hash, Expected: reward.String(), Actual: actual.String(),
+				Timestamp: util.MakeTimestamp() / 1000,
+			}
+			// Nothing is credited yet, so it's safe to retry
+			if err := u.backend.WriteRewardMismatch(ctx, m); err != nil {
+				return nil, transient(err)
+			}
+			held[block.RoundKey()] = true
+		}
+	}
+	return held, nil
+}
+
+// Sum of rewards of our rounds included at height, rounds held in this pass count as well
+func (u *BlockUnlocker) includedReward(ctx context.Context, height int64, unlocked []*storage.BlockData, mismatches map[string]*storage.RewardMismatch) (*big.Int, error) {
+	sum := new(big.Int)
+	seen := make(map[string]bool)
+	for _, block := range unlocked {
+		if block.Height != height {
+			continue
+		}
+		seen[strings.ToLower(block.Hash)] = true
+		reward := block.Reward
+		// Operator's reward is credited instead of computed one
+		if m, ok := mismatches[block.RoundKey()]; ok && m.Confirmed && len(m.Reward) > 0 {
+			if r, ok := new(big.Int).SetString(m.Reward, 10); ok {
+				reward = r
+			}
+		}
+		sum.Add(sum, reward)
+		if block.ExtraReward != nil {
+			sum.Add(sum, block.ExtraReward)
+		}
+	}
+	credited, err := u.backend.GetMaturedBlocksAt(ctx, height)
+	if err != nil {
+		return nil, transient(err)
+	}
+	for _, block := range credited {
+		if block.Orphan || seen[strings.ToLower(block.Hash)] {
+			continue
+		}
+		reward, ok := new(big.Int).SetString(block.RewardString, 10)
+		if !ok {
+			return nil, fmt.Errorf("malformed reward of credited round %v: %v", block.RoundKey(), block.RewardString)
+		}
+		sum.Add(sum, reward)
+		if block.ExtraReward != nil {
+			sum.Add(sum, block.ExtraReward)
+		}
+	}
+	return sum, nil
+}
+
+// Operator may confirm computed reward as is or set reward to credit instead
+func applyConfirmedReward(block *storage.BlockData, m *storage.RewardMismatch) error {
+	block.RewardConfirmed = true
+	if len(m.Reward) == 0 {
+		return nil
+	}
+	reward, ok := new(big.Int).SetString(m.Reward, 10)
+	if !ok {
+		return fmt.Errorf("malformed confirmed reward of round %v: %v", m.Round, m.Reward)
+	}
+	block.Reward = reward
+	return nil
+}
+
+func (u *BlockUnlocker) coinbaseDelta(height int64) (*big.Int, error) {
+	after, err := u.rpc().GetBalanceAt(u.config.Coinbase, height)
+	if err != nil {
+		return nil, err
+	}
+	before, err := u.rpc().GetBalanceAt(u.config.Coinbase, height-1)
+	if err != nil {
+		return nil, err
+	}
+	return after.Sub(after, before), nil
 }
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
-	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
+	ctx := context.Background()
+	blockReward := new(big.Rat).SetInt(block.Reward)
+	revenue := new(big.Rat).Set(blockReward)
+	minersProfit, poolProfit := chargeFee(revenue, u.fees.Fee)
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+	shares, err := u.backend.GetRoundShares(ctx, block.RoundHeight, block.Nonce)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
+	// Bonus is taken from miners' profit, blocks found before finder was recorded have no bonus
+	var bonus *big.Rat
+	if u.config.FinderBonus > 0 && len(block.Finder) > 0 {
+		_, bonus = chargeFee(revenue, u.config.FinderBonus)
+		minersProfit.Sub(minersProfit, bonus)
+	}
+
 	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
 
+	// Fees are fixed by the immature pass, so that matured credit of the round charges the same fees
+	minerFees := block.MinerFees
+	if minerFees == nil {
+		minerFees, err = u.minerFees(ctx, shares)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		block.MinerFees = minerFees
+	}
+	// Miners with own fee get difference with pool fee on their part of block reward
+	defaultProfit := new(big.Rat).Set(poolProfit)
+	for login, fee := range minerFees {
+		part := new(big.Rat).Mul(blockReward, big.NewRat(shares[login], block.TotalShares))
+		_, diff := chargeFee(part, u.fees.Fee-fee)
+		rewards[login] += weiToShannonInt64(diff)
+		minersProfit.Add(minersProfit, diff)
+		poolProfit.Sub(poolProfit, diff)
+	}
+	// Recipients' fees are scaled by the part of pool fee actually charged
+	scale := new(big.Rat)
+	if defaultProfit.Sign() != 0 {
+		scale.Quo(poolProfit, defaultProfit)
+	}
+
+	block.FinderBonus = 0
+	if bonus != nil {
+		block.FinderBonus = weiToShannonInt64(bonus)
+		rewards[block.Finder] += block.FinderBonus
+	}
+
 	if block.ExtraReward != nil {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
 		poolProfit.Add(poolProfit, extraReward)
 		revenue.Add(revenue, extraReward)
 	}
 
-	if u.config.Enabled {
-		devdonate := donationFee
+	// Each recipient gets his percent of block reward, first one gets the rest of pool profit including kept tx fees
+	rest := new(big.Rat).Set(poolProfit)
+	for _, r := range u.fees.Recipients[1:] {
+		_, fee := chargeFee(blockReward, r.Fee)
+		fee.Mul(fee, scale)
+		rest.Sub(rest, fee)
+		creditFee(rewards, r, fee)
+	}
+	creditFee(rewards, u.fees.Recipients[0], rest)
 
-		if u.config.DevDonate != nil && *u.config.DevDonate >= 0.0 && *u.config.DevDonate < 100.0 {
-			devdonate = *u.config.DevDonate
-		}
+	return revenue, minersProfit, poolProfit, rewards, nil
+}
 
-		if devdonate > 0.0 {
-			var donation = new(big.Rat)
-			poolProfit, donation = chargeFee(poolProfit, devdonate)
-			login := strings.ToLower(donationAccount)
-			rewards[login] += weiToShannonInt64(donation)
+// Returns fees of miners paying other than pool fee
+func (u *BlockUnlocker) minerFees(ctx context.Context, shares map[string]int64) (map[string]float64, error) {
+	overrides, err := u.backend.GetFeeOverrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hashrates := make(map[string]int64)
+	if len(u.fees.Tiers) > 0 {
+		logins := make([]string, 0, len(shares))
+		for login := range shares {
+			logins = append(logins, login)
+		}
+		hashrates, err = u.backend.GetMinersHashrate(ctx, logins, u.tierWindow)
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	if len(u.config.PoolFeeAddress) != 0 {
-		address := strings.ToLower(u.config.PoolFeeAddress)
-		rewards[address] += weiToShannonInt64(poolProfit)
+	result := make(map[string]float64)
+	for login := range shares {
+		if fee := u.fees.MinerFee(overrides, login, hashrates[login]); fee != u.fees.Fee {
+			result[login] = fee
+		}
 	}
+	return result, nil
+}
 
-	return revenue, minersProfit, poolProfit, rewards, nil
+// Fee of recipient without address stays in pool's wallet
+func creditFee(rewards map[string]int64, r *storage.FeeRecipient, fee *big.Rat) {
+	if len(r.Address) != 0 {
+		rewards[strings.ToLower(r.Address)] += weiToShannonInt64(fee)
+	}
 }
 
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
@@ -562,29 +1191,86 @@ func weiToShannonInt64(wei *big.Rat) int64 {
 	return value
 }
 
-func getUncleReward(uHeight, height int64) *big.Int {
-	era := GetBlockEra(big.NewInt(height), big.NewInt(100000))
-	reward := getEraUncleBlockReward(era)
-	return reward
+// Reward of uncle miner, era of including block applies to the uncle as in consensus
+func getUncleReward(rules string, uHeight, height int64) *big.Int {
+	era := GetBlockEra(big.NewInt(height), eraLength)
+	if rules == uncleRulesHomestead || era.Sign() == 0 {
+		return getDepthUncleReward(GetBlockWinnerRewardByEra(era), uHeight, height)
+	}
+	return getEraUncleBlockReward(era)
+}
+
+// (uncleHeight + 8 - height) / 8 of block reward, nothing for uncles deeper than 7 blocks
+func getDepthUncleReward(blockReward *big.Int, uHeight, height int64) *big.Int {
+	r := big.NewInt(uHeight + 8 - height)
+	if r.Sign() <= 0 || uHeight >= height {
+		return new(big.Int)
+	}
+	r.Mul(r, blockReward)
+	return r.Div(r, big8)
+}
+
+// Reward of block winner for including uncles
+func getRewardForUncles(height int64, uncles int) *big.Int {
+	era := GetBlockEra(big.NewInt(height), eraLength)
+	return new(big.Int).Mul(getEraUncleBlockReward(era), big.NewInt(int64(uncles)))
 }
 
 func (u *BlockUnlocker) getExtraRewardForTx(block *rpc.GetBlockReply) (*big.Int, error) {
+	if amount, ok := u.txFees[block.Hash]; ok {
+		return new(big.Int).Set(amount), nil
+	}
+
+	delay := u.retryDelay
+	amount, err := u.sumTxFees(block)
+	for i := 0; err != nil && i < receiptRetries; i++ {
+		log.Printf("Failed to fetch receipts of block %v, retrying in %v: %v", block.Hash, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		amount, err = u.sumTxFees(block)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.txFeesOrder) >= txFeeCacheSize {
+		delete(u.txFees, u.txFeesOrder[0])
+		u.txFeesOrder = u.txFeesOrder[1:]
+	}
+	u.txFees[block.Hash] = amount
+	u.txFeesOrder = append(u.txFeesOrder, block.Hash)
+	return new(big.Int).Set(amount), nil
+}
+
+// Result is cached, so missing receipt is an error rather than zero fee
+func (u *BlockUnlocker) sumTxFees(block *rpc.GetBlockReply) (*big.Int, error) {
 	amount := new(big.Int)
 
-	for _, tx := range block.Transactions {
-		receipt, err := u.rpc.GetTxReceipt(tx.Hash)
+	for offset := 0; offset < len(block.Transactions); offset += receiptBatch {
+		txs := block.Transactions[offset:]
+		if len(txs) > receiptBatch {
+			txs = txs[:receiptBatch]
+		}
+		hashes := make([]string, len(txs))
+		for i, tx := range txs {
+			hashes[i] = tx.Hash
+		}
+		receipts, err := u.rpc().GetTxReceipts(hashes)
 		if err != nil {
-			return nil, err
+			return nil, transient(err)
 		}
-		if receipt != nil {
+		for i, receipt := range receipts {
+			if receipt == nil {
+				return nil, transient(fmt.Errorf("receipt of tx %v is not available", txs[i].Hash))
+			}
 			gasUsed, ok := new(big.Int).SetString(receipt.GasUsed, 0)
 			if !ok {
-				return nil, errors.New(fmt.Sprintf("malformed used gas: %s", receipt.GasUsed));
+				return nil, fmt.Errorf("malformed used gas: %s", receipt.GasUsed)
 			}
 
-			gasPrice, ok := new(big.Int).SetString(tx.GasPrice, 0)
+			gasPrice, ok := new(big.Int).SetString(txs[i].GasPrice, 0)
 			if !ok {
-				return nil, errors.New(fmt.Sprintf("malformed transaction gas price: %s", tx.GasPrice));
+				return nil, fmt.Errorf("malformed transaction gas price: %s", txs[i].GasPrice)
 			}
 
 			fee := new(big.Int).Mul(gasUsed, gasPrice)
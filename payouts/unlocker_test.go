@@ -1,9 +1,15 @@
 package payouts
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/webchain-network/webchain-pool/rpc"
 	"github.com/webchain-network/webchain-pool/storage"
@@ -35,6 +41,125 @@ func TestCalculateRewards(t *testing.T) {
 	}
 }
 
+type testShare struct {
+	login string
+	diff  int64
+}
+
+// Round of shares written in given order, the last one finds block of difficulty 4000 with 5 WEB reward
+func newTestRound(shares ...testShare) (*storage.MemoryBackend, *storage.BlockData) {
+	ctx := context.Background()
+	backend := storage.NewMemoryBackend()
+	last := len(shares) - 1
+	for i, share := range shares[:last] {
+		backend.WriteShare(ctx, share.login, "rig", []string{fmt.Sprintf("0x%x", i+1), "0x0", "0x0"}, share.diff, 100, 0)
+	}
+	finder := shares[last]
+	backend.WriteBlock(ctx, finder.login, "rig", []string{fmt.Sprintf("0x%x", last+1), "0x0", "0x0"}, finder.diff, 4000, 100, 0, nil)
+	candidates, _ := backend.GetCandidates(ctx, 100)
+	block := candidates[0]
+	block.Reward, _ = new(big.Int).SetString("5000000000000000000", 10)
+	return backend, block
+}
+
+func TestCalculateFinderBonus(t *testing.T) {
+	backend, block := newTestRound(testShare{"0xa", 1000}, testShare{"0xb", 1000})
+
+	noDonation := 0.0
+	cfg := &UnlockerConfig{PoolFee: 1.0, DevDonate: &noDonation, FinderBonus: 2.0}
+	u := &BlockUnlocker{config: cfg, backend: backend, fees: newFeeSchedule(cfg)}
+	_, minersProfit, _, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.FinderBonus != 100000000 {
+		t.Errorf("Bonus must be percent of block reward: %v", block.FinderBonus)
+	}
+	if weiToShannonInt64(minersProfit) != 4850000000 {
+		t.Errorf("Bonus must be taken from miners profit: %v", minersProfit.FloatString(0))
+	}
+	if rewards["0xa"] != 2425000000 || rewards["0xb"] != 2425000000+100000000 {
+		t.Errorf("Must credit bonus to finder: %v", rewards)
+	}
+
+	block.Finder = ""
+	if _, _, _, rewards, _ := u.calculateRewards(block); block.FinderBonus != 0 || rewards["0xb"] != 2475000000 {
+		t.Errorf("Must not credit bonus without finder: %v", rewards)
+	}
+}
+
+func TestCalculateFeeRecipients(t *testing.T) {
+	backend, block := newTestRound(testShare{"0xa", 1000})
+	block.ExtraReward, _ = new(big.Int).SetString("1000000000000000", 10)
+
+	cfg := &UnlockerConfig{FeeRecipients: []*storage.FeeRecipient{
+		{Name: "pool", Address: "0xB1", Fee: 1.0},
+		{Name: "hosting", Address: "0xb2", Fee: 0.5},
+		{Name: "reserve", Fee: 0.5},
+	}}
+	u := &BlockUnlocker{config: cfg, backend: backend, fees: newFeeSchedule(cfg)}
+	if u.fees.Fee != 2.0 {
+		t.Errorf("Total fee must be sum of recipients fees: %v", u.fees.Fee)
+	}
+	_, _, _, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"0xa": 4900000000, "0xb1": 51000000, "0xb2": 25000000}
+	if !reflect.DeepEqual(rewards, expected) {
+		t.Errorf("Must credit each recipient, first one with tx fees: %v", rewards)
+	}
+
+	donation := 10.0
+	legacy := newFeeSchedule(&UnlockerConfig{PoolFee: 1.0, PoolFeeAddress: "0xb1", DevDonate: &donation})
+	if len(legacy.Recipients) != 2 || legacy.Recipients[0].Address != "0xb1" || legacy.Recipients[1].Address != donationAccount {
+		t.Errorf("Must split legacy pool fee with dev donation: %+v", legacy.Recipients)
+	}
+	if legacy.Recipients[0].Fee != 0.9 || legacy.Recipients[1].Fee != 0.1 || legacy.Fee != 1.0 {
+		t.Errorf("Must keep legacy pool fee: %+v", legacy)
+	}
+}
+
+func TestCalculateMinerFees(t *testing.T) {
+	ctx := context.Background()
+	backend, block := newTestRound(testShare{"0xa", 1000}, testShare{"0xb", 5000}, testShare{"0xc", 4000})
+	backend.SetFeeOverride(ctx, "0xa", 0)
+
+	cfg := &UnlockerConfig{
+		FeeRecipients: []*storage.FeeRecipient{{Name: "pool", Address: "0xf1", Fee: 0.8}, {Name: "dev", Address: "0xf2", Fee: 0.2}},
+		FeeTiers:      []*storage.FeeTier{{Hashrate: 5000, Fee: 0.5}, {Hashrate: 100000, Fee: 0.1}},
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, fees: newFeeSchedule(cfg), tierWindow: time.Second}
+	_, _, _, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"0xa": 500000000, "0xb": 2487500000, "0xc": 1980000000, "0xf1": 26000000, "0xf2": 6500000}
+	if !reflect.DeepEqual(rewards, expected) {
+		t.Errorf("Must apply override and tier fees: %v", rewards)
+	}
+
+	// Matured pass reads the round back and must charge fees fixed by immature pass
+	backend.WriteImmatureBlock(ctx, block, rewards)
+	backend.RemoveFeeOverride(ctx, "0xa")
+	immature, _ := backend.GetImmatureBlocks(ctx, 100)
+	immature[0].Reward = block.Reward
+	if _, _, _, rewards, _ := u.calculateRewards(immature[0]); !reflect.DeepEqual(rewards, expected) {
+		t.Errorf("Must keep fees fixed for the round: %v", rewards)
+	}
+
+	fees := u.fees
+	if fee := fees.MinerFee(nil, "0xc", 200000); fee != 0.1 {
+		t.Errorf("Must apply highest reached tier: %v", fee)
+	}
+	if fee := fees.MinerFee(map[string]float64{"0xc": 2.0}, "0xc", 200000); fee != 2.0 {
+		t.Errorf("Override must take precedence over tiers: %v", fee)
+	}
+	if fee := fees.MinerFee(nil, "0xc", 10); fee != 1.0 {
+		t.Errorf("Must apply pool fee below tiers: %v", fee)
+	}
+}
+
 func TestChargeFee(t *testing.T) {
 	orig, _ := new(big.Rat).SetString("5000000000000000000")
 	value, _ := new(big.Rat).SetString("5000000000000000000")
@@ -67,21 +192,79 @@ func TestWeiToShannonInt64(t *testing.T) {
 }
 
 func TestGetUncleReward(t *testing.T) {
-	rewards := make(map[int64]string)
-	expectedRewards := map[int64]string{
-		1: "4375000000000000000",
-		2: "3750000000000000000",
-		3: "3125000000000000000",
-		4: "2500000000000000000",
-		5: "1875000000000000000",
-		6: "1250000000000000000",
-	}
-	for i := int64(1); i < 7; i++ {
-		rewards[i] = getUncleReward(1, i+1).String()
-	}
-	for i, reward := range rewards {
-		if expectedRewards[i] != rewards[i] {
-			t.Errorf("Incorrect uncle reward for %v, expected %v vs %v", i, expectedRewards[i], reward)
+	tests := []struct {
+		rules    string
+		uHeight  int64
+		height   int64
+		expected string
+	}{
+		// First era, reward depends on depth
+		{uncleRulesECIP1017, 1, 2, "1023241534605268281"},
+		{uncleRulesECIP1017, 1, 8, "146177362086466897"},
+		{uncleRulesECIP1017, 1, 9, "0"},
+		// Era of including block applies
+		{uncleRulesECIP1017, 99999, 100001, "36398163159530257"},
+		{uncleRulesECIP1017, 4999999, 5000001, "29907977841233030"},
+		{uncleRulesHomestead, 150000, 150002, "873555915828726179"},
+		{uncleRulesHomestead, 99998, 100001, "727963263190605149"},
+		{uncleRulesHomestead, 100001, 100001, "0"},
+	}
+	for _, tt := range tests {
+		if reward := getUncleReward(tt.rules, tt.uHeight, tt.height).String(); reward != tt.expected {
+			t.Errorf("Incorrect %v uncle reward for %v in %v, expected %v vs %v", tt.rules, tt.uHeight, tt.height, tt.expected, reward)
+		}
+	}
+}
+
+// Uncles observed on mainnet, reward is the one credited to uncle's miner in the including block.
+// Rows are exported from a synced node, both uncle rules and an era boundary must be covered.
+const mainnetUnclesFixture = "testdata/mainnet_uncles.json"
+
+type mainnetUncle struct {
+	Rules       string `json:"rules"`
+	Height      int64  `json:"height"`
+	UncleHeight int64  `json:"uncleHeight"`
+	Hash        string `json:"hash"`
+	Reward      string `json:"reward"`
+}
+
+func TestGetUncleRewardMainnet(t *testing.T) {
+	// Computed rewards are checked against chain only, so missing chain data fails the test
+	data, err := ioutil.ReadFile(mainnetUnclesFixture)
+	if err != nil {
+		t.Fatalf("Uncles exported from a synced node must be in %v: %v", mainnetUnclesFixture, err)
+	}
+	var uncles []mainnetUncle
+	if err := json.Unmarshal(data, &uncles); err != nil {
+		t.Fatal(err)
+	}
+	rules := make(map[string]bool)
+	eras := make(map[string]bool)
+	for _, u := range uncles {
+		rules[u.Rules] = true
+		eras[GetBlockEra(big.NewInt(u.Height), eraLength).String()] = true
+		if reward := getUncleReward(u.Rules, u.UncleHeight, u.Height).String(); reward != u.Reward {
+			t.Errorf("Incorrect %v uncle reward for %v at %v in %v, expected %v vs %v", u.Rules, u.Hash, u.UncleHeight, u.Height, u.Reward, reward)
+		}
+	}
+	if !rules[uncleRulesECIP1017] || !rules[uncleRulesHomestead] || len(eras) < 2 {
+		t.Errorf("Chain data must cover both uncle rules and an era boundary")
+	}
+}
+
+func TestGetRewardForUncles(t *testing.T) {
+	tests := []struct {
+		height   int64
+		uncles   int
+		expected string
+	}{
+		{2, 1, "36544340521616724"},
+		{100001, 2, "72796326319060514"},
+		{100001, 0, "0"},
+	}
+	for _, tt := range tests {
+		if reward := getRewardForUncles(tt.height, tt.uncles).String(); reward != tt.expected {
+			t.Errorf("Incorrect reward for %v uncles in %v, expected %v vs %v", tt.uncles, tt.height, tt.expected, reward)
 		}
 	}
 }
@@ -111,3 +294,11 @@ func TestMatchCandidate(t *testing.T) {
 		t.Error("Must match with hash")
 	}
 }
+
+func TestRetryBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 10: 5 * time.Minute} {
+		if delay := retryBackoff(failures, 5*time.Minute); delay != expected {
+			t.Errorf("Delay after %v failures must be %v: %v", failures, expected, delay)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package policy
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math"
 	"os/exec"
 	"strings"
 	"sync"
@@ -43,6 +45,7 @@ type Stats struct {
 	// so moving it before the rest in order to avoid alignment issue
 	LastBeat      int64
 	BannedAt      int64
+	BanExpiresAt  int64
 	ValidShares   int32
 	InvalidShares int32
 	Malformed     int32
@@ -61,16 +64,25 @@ type PolicyServer struct {
 	timeout    int64
 	blacklist  []string
 	whitelist  []string
-	storage    *storage.RedisClient
+	storage    storage.Backend
+	// Bans seen in backend, only these are lifted once removed from it
+	synced map[string]struct{}
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
+func Start(cfg *Config, storage storage.Backend) *PolicyServer {
 	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
 	s.banChannel = make(chan string, 64)
 	s.stats = make(map[string]*Stats)
+	s.synced = make(map[string]struct{})
 	s.storage = storage
+
+	for i := 0; i < s.config.Workers; i++ {
+		s.startPolicyWorker()
+	}
+	log.Printf("Running with %v policy workers", s.config.Workers)
+
 	s.refreshState()
 
 	timeout := util.MustParseDuration(s.config.ResetInterval)
@@ -97,10 +109,6 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
-		s.startPolicyWorker()
-	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
 	return s
 }
 
@@ -124,17 +132,23 @@ func (s *PolicyServer) resetStats() {
 
 	for key, m := range s.stats {
 		lastBeat := atomic.LoadInt64(&m.LastBeat)
-		bannedAt := atomic.LoadInt64(&m.BannedAt)
+		// Bans synced from backend expire with it, local bans after banning timeout
+		expiresAt := atomic.LoadInt64(&m.BannedAt) + banningTimeout
+		if e := atomic.LoadInt64(&m.BanExpiresAt); e > 0 {
+			expiresAt = e
+		}
 
-		if now-bannedAt >= banningTimeout {
+		if now >= expiresAt {
 			atomic.StoreInt64(&m.BannedAt, 0)
+			atomic.StoreInt64(&m.BanExpiresAt, 0)
 			if atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
 				log.Printf("Ban dropped for %v", key)
 				delete(s.stats, key)
 				total++
 			}
 		}
-		if now-lastBeat >= s.timeout {
+		// Banned peers are kept until ban expires, even if they stopped connecting
+		if now-lastBeat >= s.timeout && atomic.LoadInt32(&m.Banned) == 0 {
 			delete(s.stats, key)
 			total++
 		}
@@ -143,21 +157,58 @@ func (s *PolicyServer) resetStats() {
 }
 
 func (s *PolicyServer) refreshState() {
+	ctx := context.Background()
 	s.Lock()
 	defer s.Unlock()
 	var err error
 
-	s.blacklist, err = s.storage.GetBlacklist()
+	s.blacklist, err = s.storage.GetBlacklist(ctx)
 	if err != nil {
 		log.Printf("Failed to get blacklist from backend: %v", err)
 	}
-	s.whitelist, err = s.storage.GetWhitelist()
+	s.whitelist, err = s.storage.GetWhitelist(ctx)
 	if err != nil {
 		log.Printf("Failed to get whitelist from backend: %v", err)
 	}
+	bans, err := s.storage.GetBans(ctx)
+	if err != nil {
+		log.Printf("Failed to get bans from backend: %v", err)
+	} else {
+		s.syncBans(bans)
+	}
 	log.Println("Policy state refresh complete")
 }
 
+// Applies bans added by operator and lifts bans removed from backend, bans are kept until their expiry in backend.
+// Local bans which never reached backend, e.g. because writing them failed, are kept.
+func (s *PolicyServer) syncBans(bans map[string]int64) {
+	if !s.config.Banning.Enabled {
+		return
+	}
+	for ip, expiry := range bans {
+		s.synced[ip] = struct{}{}
+		x := s.Get(ip)
+		atomic.StoreInt64(&x.BanExpiresAt, banExpiresAt(expiry))
+		if atomic.LoadInt32(&x.Banned) == 0 {
+			s.applyBan(x, ip)
+		}
+	}
+	for ip := range s.synced {
+		if _, ok := bans[ip]; !ok {
+			delete(s.synced, ip)
+			s.liftBan(ip)
+		}
+	}
+}
+
+// Backend keeps expiry in seconds and 0 for permanent bans
+func banExpiresAt(expiry int64) int64 {
+	if expiry == 0 {
+		return math.MaxInt64
+	}
+	return expiry * 1000
+}
+
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
 		ConnLimit: s.config.Limits.Limit,
@@ -258,9 +309,20 @@ func (x *Stats) resetShares() {
 }
 
 func (s *PolicyServer) forceBan(x *Stats, ip string) {
+	ctx := context.Background()
 	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
+	if s.applyBan(x, ip) {
+		// Keep track of bans in backend, so they can be listed and lifted by operator
+		err := s.storage.AddBan(ctx, ip, s.config.Banning.Timeout)
+		if err != nil {
+			log.Printf("Failed to write ban of %v to backend: %v", ip, err)
+		}
+	}
+}
+
+func (s *PolicyServer) applyBan(x *Stats, ip string) bool {
 	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
@@ -269,7 +331,26 @@ func (s *PolicyServer) forceBan(x *Stats, ip string) {
 		} else {
 			log.Println("Banned peer", ip)
 		}
+		return true
+	}
+	return false
+}
+
+func (s *PolicyServer) liftBan(ip string) {
+	s.statsMu.Lock()
+	x, ok := s.stats[ip]
+	if ok {
+		delete(s.stats, ip)
+	}
+	s.statsMu.Unlock()
+
+	if !ok || !atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+		return
+	}
+	if len(s.config.Banning.IPSet) > 0 {
+		s.doUnban(ip)
 	}
+	log.Printf("Ban lifted for %v", ip)
 }
 
 func (x *Stats) incrLimit(n int32) {
@@ -298,6 +379,16 @@ func (s *PolicyServer) InWhiteList(ip string) bool {
 
 func (s *PolicyServer) doBan(ip string) {
 	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
+	// Ban synced from backend lasts until its expiry there, 0 is permanent for ipset
+	s.statsMu.Lock()
+	if x, ok := s.stats[ip]; ok {
+		if e := atomic.LoadInt64(&x.BanExpiresAt); e == math.MaxInt64 {
+			timeout = 0
+		} else if e > 0 {
+			timeout = (e-util.MakeTimestamp())/1000 + 1
+		}
+	}
+	s.statsMu.Unlock()
 	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
 	args := strings.Fields(cmd)
 	head := args[0]
@@ -311,6 +402,17 @@ func (s *PolicyServer) doBan(ip string) {
 	}
 }
 
+func (s *PolicyServer) doUnban(ip string) {
+	set := s.config.Banning.IPSet
+	cmd := fmt.Sprintf("sudo ipset del %s %s -!", set, ip)
+	args := strings.Fields(cmd)
+
+	_, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		log.Printf("CMD Error: %s", err)
+	}
+}
+
 func (x *Stats) heartbeat() {
 	now := util.MakeTimestamp()
 	atomic.StoreInt64(&x.LastBeat, now)
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"math/big"
 	"strconv"
@@ -18,6 +19,8 @@ const maxBacklog = 3
 type heightDiffPair struct {
 	diff   *big.Int
 	height uint64
+	// Name of upstream which served this job
+	upstream string
 }
 
 type BlockTemplate struct {
@@ -75,8 +78,9 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	}
 	// Copy job backlog and add current one
 	newTemplate.headers[reply[0]] = heightDiffPair{
-		diff:   util.TargetHexToDiff(reply[2]),
-		height: height,
+		diff:     util.TargetHexToDiff(reply[2]),
+		height:   height,
+		upstream: rpc.Name,
 	}
 	if t != nil {
 		for k, v := range t.headers {
@@ -87,6 +91,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	}
 	s.blockTemplate.Store(&newTemplate)
 	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	s.measureDelays(height)
 
 	// Stratum
 	if s.config.Proxy.Stratum.Enabled {
@@ -94,6 +99,54 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	}
 }
 
+// Submitted block waits for the node to move past its height, delay isn't measured if it takes longer than this
+const submissionTimeout = 60 * 1000
+
+type blockSubmission struct {
+	height      uint64
+	nonce       string
+	submittedAt int64
+}
+
+func (s *ProxyServer) trackSubmission(height uint64, nonce string, submittedAt int64) {
+	s.submissionsMu.Lock()
+	defer s.submissionsMu.Unlock()
+	s.submissions = append(s.submissions, &blockSubmission{height: height, nonce: nonce, submittedAt: submittedAt})
+}
+
+// Delay of a block is estimated as time between submit and the first job above its height,
+// it's written to candidate apart from job refresh, so that slow backend does not delay miners
+func (s *ProxyServer) measureDelays(height uint64) {
+	now := util.MakeTimestamp()
+	var due []*blockSubmission
+	s.submissionsMu.Lock()
+	waiting := s.submissions[:0]
+	for _, b := range s.submissions {
+		if b.height < height {
+			due = append(due, b)
+		} else if now-b.submittedAt < submissionTimeout {
+			waiting = append(waiting, b)
+		}
+	}
+	s.submissions = waiting
+	s.submissionsMu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+	go func() {
+		for _, b := range due {
+			delay := now - b.submittedAt
+			if delay < 1 {
+				delay = 1
+			}
+			if err := s.backend.WriteBlockDelay(context.Background(), b.height, b.nonce, delay); err != nil {
+				log.Printf("Failed to write delay of block %v to backend: %v", b.height, err)
+			}
+		}
+	}()
+}
+
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, int64, error) {
 	rpc := s.rpc()
 	reply, err := rpc.GetPendingBlock()
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"github.com/webchain-network/webchain-pool/api"
+	"github.com/webchain-network/webchain-pool/archive"
 	"github.com/webchain-network/webchain-pool/payouts"
 	"github.com/webchain-network/webchain-pool/policy"
 	"github.com/webchain-network/webchain-pool/storage"
@@ -16,11 +17,15 @@ type Config struct {
 
 	Threads int `json:"threads"`
 
-	Coin  string         `json:"coin"`
-	Redis storage.Config `json:"redis"`
+	Coin     string                 `json:"coin"`
+	Backend  string                 `json:"backend"`
+	Redis    storage.Config         `json:"redis"`
+	Postgres storage.PostgresConfig `json:"postgres"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
+	LedgerAudit   payouts.AuditConfig    `json:"ledgerAudit"`
+	Archive       archive.Config         `json:"archive"`
 
 	NewrelicName    string `json:"newrelicName"`
 	NewrelicKey     string `json:"newrelicKey"`
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/hex"
 	"log"
 	"math/big"
@@ -8,6 +9,9 @@ import (
 	"strings"
 
 	"github.com/webchain-network/cryptonight"
+
+	"github.com/webchain-network/webchain-pool/storage"
+	"github.com/webchain-network/webchain-pool/util"
 )
 
 var lyra2_block uint64 = 0
@@ -32,6 +36,7 @@ func (s *ProxyServer) checkHash(hash *big.Int, difficulty *big.Int) bool {
 }
 
 func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, shareDiff int64) (bool, bool) {
+	ctx := context.Background()
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
@@ -58,6 +63,7 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	}
 
 	if s.checkHash(hash, h.diff) {
+		submittedAt := util.MakeTimestamp()
 		ok, err := s.rpc().SubmitBlock(params)
 		if err != nil {
 			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
@@ -65,8 +71,13 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
 			return false, false
 		} else {
+			submit := &storage.BlockSubmit{Upstream: h.upstream}
+			exist, err := s.backend.WriteBlock(ctx, login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration, submit)
+			if !exist && err == nil {
+				s.trackSubmission(h.height, nonceHex, submittedAt)
+			}
+			// Miners must not keep hashing solved height, refresh also measures delay of the block
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
 			if exist {
 				return true, false
 			}
@@ -78,7 +89,7 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
 		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, params, shareDiff, h.height, s.hashrateExpiration)
+		exist, err := s.backend.WriteShare(ctx, login, id, params, shareDiff, h.height, s.hashrateExpiration)
 		if exist {
 			return true, false
 		}
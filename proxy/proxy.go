@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -24,11 +25,15 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
+	backend            storage.Backend
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
 
+	// Found blocks waiting for delay measurement
+	submissionsMu sync.Mutex
+	submissions   []*blockSubmission
+
 	// Stratum
 	sessionsMu sync.RWMutex
 	sessions   map[*Session]struct{}
@@ -50,7 +55,8 @@ type Session struct {
 	lastShareTime time.Time
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Backend) *ProxyServer {
+	ctx := context.Background()
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
@@ -110,7 +116,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 			case <-stateUpdateTimer.C:
 				t := proxy.currentBlockTemplate()
 				if t != nil {
-					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
+					err := backend.WriteNodeState(ctx, cfg.Name, t.Height, t.Difficulty)
 					if err != nil {
 						log.Printf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -116,6 +116,56 @@ func (r *RPCClient) GetUncleByBlockNumberAndIndex(height int64, index int) (*Get
 	return r.getBlockBy("eth_getUncleByBlockNumberAndIndex", params)
 }
 
+// Blocks are requested in a single batch, missing blocks are nil
+func (r *RPCClient) GetBlocksByHeight(heights []int64) ([]*GetBlockReply, error) {
+	calls := make([]rpcCall, len(heights))
+	for i, height := range heights {
+		calls[i] = rpcCall{"eth_getBlockByNumber", []interface{}{fmt.Sprintf("0x%x", height), true}}
+	}
+	return r.getBlocksBy(calls)
+}
+
+// Takes number of uncles by block height and requests all of them in a single batch
+func (r *RPCClient) GetUnclesByBlockNumber(counts map[int64]int) (map[int64][]*GetBlockReply, error) {
+	var calls []rpcCall
+	var heights []int64
+	for height, count := range counts {
+		for index := 0; index < count; index++ {
+			calls = append(calls, rpcCall{"eth_getUncleByBlockNumberAndIndex", []interface{}{fmt.Sprintf("0x%x", height), fmt.Sprintf("0x%x", index)}})
+			heights = append(heights, height)
+		}
+	}
+	blocks, err := r.getBlocksBy(calls)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64][]*GetBlockReply)
+	for i, block := range blocks {
+		result[heights[i]] = append(result[heights[i]], block)
+	}
+	return result, nil
+}
+
+func (r *RPCClient) getBlocksBy(calls []rpcCall) ([]*GetBlockReply, error) {
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	rpcResps, err := r.doBatch(r.Url, calls)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*GetBlockReply, len(rpcResps))
+	for i, rpcResp := range rpcResps {
+		if rpcResp.Result == nil {
+			continue
+		}
+		if err := json.Unmarshal(*rpcResp.Result, &result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
 func (r *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockReply, error) {
 	rpcResp, err := r.doPost(r.Url, method, params)
 	if err != nil {
@@ -142,6 +192,31 @@ func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
 	return nil, nil
 }
 
+// Receipts are requested in a single batch, missing receipts are nil
+func (r *RPCClient) GetTxReceipts(hashes []string) ([]*TxReceipt, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	calls := make([]rpcCall, len(hashes))
+	for i, hash := range hashes {
+		calls[i] = rpcCall{"eth_getTransactionReceipt", []string{hash}}
+	}
+	rpcResps, err := r.doBatch(r.Url, calls)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*TxReceipt, len(rpcResps))
+	for i, rpcResp := range rpcResps {
+		if rpcResp.Result == nil {
+			continue
+		}
+		if err := json.Unmarshal(*rpcResp.Result, &result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
 func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
 	rpcResp, err := r.doPost(r.Url, "eth_submitWork", params[:3])
 	if err != nil {
@@ -153,7 +228,16 @@ func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
 }
 
 func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getBalance", []string{address, "latest"})
+	return r.getBalance(address, "latest")
+}
+
+// Requires node keeping state of given block, e.g. archive node for old blocks
+func (r *RPCClient) GetBalanceAt(address string, height int64) (*big.Int, error) {
+	return r.getBalance(address, fmt.Sprintf("0x%x", height))
+}
+
+func (r *RPCClient) getBalance(address, block string) (*big.Int, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getBalance", []string{address, block})
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +249,7 @@ func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
 
 	balance, ok := new(big.Int).SetString(reply, 0)
 	if !ok {
-		return nil, errors.New(fmt.Sprintf("malformed balance: %d", reply));
+		return nil, errors.New(fmt.Sprintf("malformed balance: %s", reply));
 	}
 
 	return balance, err
@@ -252,6 +336,63 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 	return rpcResp, err
 }
 
+type rpcCall struct {
+	method string
+	params interface{}
+}
+
+// Sends calls in a single JSON-RPC batch, replies are returned in order of calls
+func (r *RPCClient) doBatch(url string, calls []rpcCall) ([]*JSONRpcResp, error) {
+	jsonReq := make([]map[string]interface{}, len(calls))
+	for i, call := range calls {
+		jsonReq[i] = map[string]interface{}{"jsonrpc": "2.0", "method": call.method, "params": call.params, "id": i}
+	}
+	data, _ := json.Marshal(jsonReq)
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		r.markSick()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rpcResps []*JSONRpcResp
+	err = json.NewDecoder(resp.Body).Decode(&rpcResps)
+	if err != nil {
+		r.markSick()
+		return nil, err
+	}
+
+	// Batch replies may come in any order
+	result := make([]*JSONRpcResp, len(calls))
+	for _, rpcResp := range rpcResps {
+		var id int
+		if rpcResp == nil || rpcResp.Id == nil || json.Unmarshal(*rpcResp.Id, &id) != nil || id < 0 || id >= len(calls) {
+			r.markSick()
+			return nil, errors.New("malformed batch reply id")
+		}
+		if rpcResp.Error != nil {
+			r.markSick()
+			return nil, fmt.Errorf("%s: %v", calls[id].method, rpcResp.Error["message"])
+		}
+		result[id] = rpcResp
+	}
+	for i, rpcResp := range result {
+		if rpcResp == nil {
+			r.markSick()
+			return nil, fmt.Errorf("no reply for %s in batch", calls[i].method)
+		}
+	}
+	return result, nil
+}
+
 func (r *RPCClient) Check() bool {
 	_, err := r.GetWork()
 	if err != nil {
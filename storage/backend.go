@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"math/big"
+	"time"
+)
+
+// Methods used by proxy, policy, unlocker, payer and API modules
+type Backend interface {
+	Check(ctx context.Context) (string, error)
+	BgSave(ctx context.Context) (string, error)
+
+	// Policy
+	GetBlacklist(ctx context.Context) ([]string, error)
+	GetWhitelist(ctx context.Context) ([]string, error)
+	AddToBlacklist(ctx context.Context, address string) error
+	RemoveFromBlacklist(ctx context.Context, address string) error
+	AddToWhitelist(ctx context.Context, ip string) error
+	RemoveFromWhitelist(ctx context.Context, ip string) error
+	AddBan(ctx context.Context, ip string, timeout int64) error
+	RemoveBan(ctx context.Context, ip string) error
+	GetBans(ctx context.Context) (map[string]int64, error)
+
+	// Operator's control of unlocker and payouts
+	PauseModule(ctx context.Context, name string) error
+	ResumeModule(ctx context.Context, name string) error
+	GetModuleState(ctx context.Context, name string) (bool, int64, error)
+	HaltModule(ctx context.Context, name, reason string) error
+	GetModuleHalt(ctx context.Context, name string) (string, int64, error)
+	WriteAuditEntry(ctx context.Context, entry *AuditEntry) error
+	SetFeeOverride(ctx context.Context, login string, fee float64) error
+	RemoveFeeOverride(ctx context.Context, login string) error
+	ConfirmRewardMismatch(ctx context.Context, round, reward string) (bool, error)
+	GetAuditLog(ctx context.Context, offset, limit int64) ([]*AuditEntry, error)
+
+	// Proxy
+	WriteNodeState(ctx context.Context, id string, height uint64, diff *big.Int) error
+	GetNodeStates(ctx context.Context) ([]map[string]interface{}, error)
+	WriteShare(ctx context.Context, login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error)
+	WriteBlock(ctx context.Context, login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, submit *BlockSubmit) (bool, error)
+	WriteBlockDelay(ctx context.Context, height uint64, nonce string, delay int64) error
+
+	// Unlocker
+	GetCandidates(ctx context.Context, maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(ctx context.Context, maxHeight int64) ([]*BlockData, error)
+	GetMaturedBlocks(ctx context.Context, maxBlocks int64) ([]*BlockData, error)
+	GetMaturedBlocksAt(ctx context.Context, height int64) ([]*BlockData, error)
+	GetRoundShares(ctx context.Context, height int64, nonce string) (map[string]int64, error)
+	WriteImmatureBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error
+	WriteMaturedBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error
+	WriteOrphan(ctx context.Context, block *BlockData) error
+	WritePendingOrphans(ctx context.Context, blocks []*BlockData) error
+	WriteFeeSchedule(ctx context.Context, fees *FeeSchedule) error
+	GetFeeOverrides(ctx context.Context) (map[string]float64, error)
+	GetMinersHashrate(ctx context.Context, logins []string, window time.Duration) (map[string]int64, error)
+	WriteRewardMismatch(ctx context.Context, m *RewardMismatch) error
+	GetRewardMismatches(ctx context.Context) (map[string]*RewardMismatch, error)
+	RemoveRewardMismatch(ctx context.Context, round string) error
+
+	// Payouts
+	GetPayees(ctx context.Context) ([]string, error)
+	GetBalance(ctx context.Context, login string) (int64, error)
+	LockPayouts(ctx context.Context, login string, amount int64) error
+	UnlockPayouts(ctx context.Context) error
+	IsPayoutsLocked(ctx context.Context) (bool, error)
+	GetPendingPayments(ctx context.Context) []*PendingPayment
+	UpdateBalance(ctx context.Context, login string, amount int64) error
+	RollbackBalance(ctx context.Context, login string, amount int64) error
+	WritePayment(ctx context.Context, login, txHash string, amount int64) error
+	AdjustBalance(ctx context.Context, login string, amount int64, reason string) error
+
+	// Accounting audit
+	GetLedger(ctx context.Context, login string, offset, limit int64) ([]*LedgerEntry, error)
+	GetFinances(ctx context.Context) (map[string]int64, error)
+	SumMinersFunds(ctx context.Context) (int64, map[string]int64, error)
+	WriteConsistencyReport(ctx context.Context, report *ConsistencyReport) error
+	GetConsistencyReport(ctx context.Context) (*ConsistencyReport, error)
+
+	// Archiver
+	GetHistory(ctx context.Context, key string, offset, limit int64) ([]*HistoryEntry, int64, error)
+	GetOldestHistory(ctx context.Context, key string, limit int64) ([]*HistoryEntry, error)
+	RemoveHistory(ctx context.Context, key string, entries []*HistoryEntry) error
+	GetArchivedCount(ctx context.Context, key string) (int64, bool, error)
+	SetArchivedCount(ctx context.Context, key string, n int64) error
+
+	// Maintenance
+	MigrateRecords(ctx context.Context) (int64, error)
+
+	// API
+	IsMinerExists(ctx context.Context, login string) (bool, error)
+	GetMinerStats(ctx context.Context, login string, maxPayments int64) (map[string]interface{}, error)
+	FlushStaleStats(ctx context.Context, window, largeWindow time.Duration) (int64, error)
+	CollectStats(ctx context.Context, smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	GetFeeSchedule(ctx context.Context) (*FeeSchedule, error)
+	CollectWorkersStats(ctx context.Context, sWindow, lWindow time.Duration, login string, showTotalHashes bool) (map[string]interface{}, error)
+	CollectLuckStats(ctx context.Context, windows []int) (map[string]interface{}, error)
+	CollectBlockStats(ctx context.Context, days int) (*BlockStats, error)
+	WriteHashrateSnapshot(ctx context.Context, window, interval time.Duration) (bool, error)
+	GetHashrateChart(ctx context.Context, login string, period time.Duration) ([]*ChartPoint, error)
+	WriteNetworkStats(ctx context.Context, stats *NetworkStats) error
+	GetNetworkHistory(ctx context.Context, period time.Duration) ([]*NetworkStats, error)
+}
+
+var _ Backend = (*RedisClient)(nil)
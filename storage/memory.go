@@ -0,0 +1,1075 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/webchain-network/webchain-pool/util"
+)
+
+// Keeps everything in process memory using the same keys and encodings as Redis backend.
+// Intended for tests and local development, all modules must run in a single process.
+type MemoryBackend struct {
+	mu     sync.Mutex
+	sets   map[string]map[string]struct{}
+	hashes map[string]map[string]string
+	zsets  map[string]zset
+	lists  map[string][]string
+	values map[string]string
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		sets:   make(map[string]map[string]struct{}),
+		hashes: make(map[string]map[string]string),
+		zsets:  make(map[string]zset),
+		lists:  make(map[string][]string),
+		values: make(map[string]string),
+	}
+}
+
+// Sorted set ordered by score, then by member like in Redis
+type zset map[string]float64
+
+func (z zset) sorted() []redis.Z {
+	result := make([]redis.Z, 0, len(z))
+	for member, score := range z {
+		result = append(result, redis.Z{Score: score, Member: member})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score < result[j].Score
+		}
+		return result[i].Member.(string) < result[j].Member.(string)
+	})
+	return result
+}
+
+func (z zset) rangeByScore(min, max float64) []redis.Z {
+	var result []redis.Z
+	for _, v := range z.sorted() {
+		if v.Score >= min && v.Score <= max {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Same as ZREVRANGE, negative stop means end of set
+func (z zset) revRange(start, stop int64) []redis.Z {
+	rows := z.sorted()
+	result := make([]redis.Z, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		result = append(result, rows[i])
+	}
+	return sliceRange(result, start, stop)
+}
+
+// Removes members with score less than max
+func (z zset) removeBelow(max float64) int64 {
+	n := int64(0)
+	for member, score := range z {
+		if score < max {
+			delete(z, member)
+			n++
+		}
+	}
+	return n
+}
+
+func sliceRange(rows []redis.Z, start, stop int64) []redis.Z {
+	size := int64(len(rows))
+	if stop < 0 || stop >= size {
+		stop = size - 1
+	}
+	if start >= size || start > stop {
+		return []redis.Z{}
+	}
+	return rows[start : stop+1]
+}
+
+func (m *MemoryBackend) set(args ...interface{}) map[string]struct{} {
+	key := join(args...)
+	if _, ok := m.sets[key]; !ok {
+		m.sets[key] = make(map[string]struct{})
+	}
+	return m.sets[key]
+}
+
+func (m *MemoryBackend) hash(args ...interface{}) map[string]string {
+	key := join(args...)
+	if _, ok := m.hashes[key]; !ok {
+		m.hashes[key] = make(map[string]string)
+	}
+	return m.hashes[key]
+}
+
+func (m *MemoryBackend) zset(args ...interface{}) zset {
+	key := join(args...)
+	if _, ok := m.zsets[key]; !ok {
+		m.zsets[key] = make(zset)
+	}
+	return m.zsets[key]
+}
+
+func (m *MemoryBackend) hincrBy(key string, field string, n int64) {
+	h := m.hash(key)
+	v, _ := strconv.ParseInt(h[field], 10, 64)
+	h[field] = strconv.FormatInt(v+n, 10)
+}
+
+func (m *MemoryBackend) hgetInt(key string, field string) int64 {
+	v, _ := strconv.ParseInt(m.hashes[key][field], 10, 64)
+	return v
+}
+
+func (m *MemoryBackend) lpush(key string, value string) {
+	m.lists[key] = append([]string{value}, m.lists[key]...)
+}
+
+func (m *MemoryBackend) lrange(key string, offset, limit int64) []string {
+	list := m.lists[key]
+	if offset >= int64(len(list)) {
+		return []string{}
+	}
+	end := offset + limit
+	if end > int64(len(list)) {
+		end = int64(len(list))
+	}
+	return list[offset:end]
+}
+
+func (m *MemoryBackend) Check(ctx context.Context) (string, error) {
+	return "PONG", nil
+}
+
+func (m *MemoryBackend) BgSave(ctx context.Context) (string, error) {
+	return "Background saving is not supported by memory backend", nil
+}
+
+func members(set map[string]struct{}) []string {
+	result := make([]string, 0, len(set))
+	for v := range set {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *MemoryBackend) GetBlacklist(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return members(m.sets["blacklist"]), nil
+}
+
+func (m *MemoryBackend) GetWhitelist(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return members(m.sets["whitelist"]), nil
+}
+
+func (m *MemoryBackend) AddToBlacklist(ctx context.Context, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set("blacklist")[address] = struct{}{}
+	return nil
+}
+
+func (m *MemoryBackend) RemoveFromBlacklist(ctx context.Context, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.set("blacklist"), address)
+	return nil
+}
+
+func (m *MemoryBackend) AddToWhitelist(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set("whitelist")[ip] = struct{}{}
+	return nil
+}
+
+func (m *MemoryBackend) RemoveFromWhitelist(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.set("whitelist"), ip)
+	return nil
+}
+
+func (m *MemoryBackend) AddBan(ctx context.Context, ip string, timeout int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	score := float64(math.MaxInt64)
+	if timeout > 0 {
+		score = float64(util.MakeTimestamp()/1000 + timeout)
+	}
+	m.zset("bans")[ip] = score
+	return nil
+}
+
+func (m *MemoryBackend) RemoveBan(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.zset("bans"), ip)
+	return nil
+}
+
+func (m *MemoryBackend) GetBans(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans := m.zset("bans")
+	bans.removeBelow(float64(util.MakeTimestamp() / 1000))
+	return convertBans(bans.sorted()), nil
+}
+
+func (m *MemoryBackend) PauseModule(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hash("control")[join(name, "paused")] = "1"
+	return nil
+}
+
+func (m *MemoryBackend) ResumeModule(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hash("control"), join(name, "paused"))
+	delete(m.hash("control"), join(name, "halt"))
+	delete(m.hash("control"), join(name, "haltedAt"))
+	m.hash("control")[join(name, "resumedAt")] = strconv.FormatInt(util.MakeTimestamp(), 10)
+	return nil
+}
+
+func (m *MemoryBackend) GetModuleState(ctx context.Context, name string) (bool, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, paused := m.hash("control")[join(name, "paused")]
+	return paused, m.hgetInt("control", join(name, "resumedAt")), nil
+}
+
+func (m *MemoryBackend) HaltModule(ctx context.Context, name, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hash("control")[join(name, "halt")] = reason
+	m.hash("control")[join(name, "haltedAt")] = strconv.FormatInt(util.MakeTimestamp()/1000, 10)
+	return nil
+}
+
+func (m *MemoryBackend) GetModuleHalt(ctx context.Context, name string) (string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hash("control")[join(name, "halt")], m.hgetInt("control", join(name, "haltedAt")), nil
+}
+
+func (m *MemoryBackend) WriteAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry.Timestamp == 0 {
+		entry.Timestamp = util.MakeTimestamp() / 1000
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.lpush("audit", string(data))
+	return nil
+}
+
+func (m *MemoryBackend) GetAuditLog(ctx context.Context, offset, limit int64) ([]*AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.lrange("audit", offset, limit)
+	result := make([]*AuditEntry, 0, len(rows))
+	for _, v := range rows {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(v), entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteNodeState(ctx context.Context, id string, height uint64, diff *big.Int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nodes := m.hash("nodes")
+	nodes[join(id, "name")] = id
+	nodes[join(id, "height")] = strconv.FormatUint(height, 10)
+	nodes[join(id, "difficulty")] = diff.String()
+	nodes[join(id, "lastBeat")] = strconv.FormatInt(util.MakeTimestamp()/1000, 10)
+	return nil
+}
+
+func (m *MemoryBackend) GetNodeStates(ctx context.Context) ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertNodeStates(m.hash("nodes")), nil
+}
+
+func (m *MemoryBackend) checkPoWExist(height uint64, params []string) bool {
+	pow := m.zset("pow")
+	// Same unsigned arithmetic as in Redis backend
+	pow.removeBelow(float64(height - 8))
+	key := strings.Join(params, ":")
+	_, exist := pow[key]
+	pow[key] = float64(height)
+	return exist
+}
+
+func (m *MemoryBackend) WriteShare(ctx context.Context, login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	m.writeShare(ms, ms/1000, login, id, diff)
+	m.hincrBy("stats", "roundShares", diff)
+	// The first round starts with the first share
+	if _, ok := m.hash("stats")["roundStart"]; !ok {
+		m.hash("stats")["roundStart"] = strconv.FormatInt(ms/1000, 10)
+	}
+	return false, nil
+}
+
+func (m *MemoryBackend) WriteBlock(ctx context.Context, login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, submit *BlockSubmit) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, diff)
+	m.hash("stats")["lastBlockFound"] = strconv.FormatInt(ts, 10)
+	m.hash("stats")["roundStart"] = strconv.FormatInt(ts, 10)
+	delete(m.hash("stats"), "roundShares")
+	m.zset("finders")[login]++
+	m.hincrBy(join("miners", login), "blocksFound", 1)
+
+	roundKey := m.formatRound(int64(height), params[0])
+	m.hashes[roundKey] = m.hash("shares", "roundCurrent")
+	delete(m.hashes, join("shares", "roundCurrent"))
+
+	totalShares := int64(0)
+	for _, v := range m.hashes[roundKey] {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		totalShares += n
+	}
+	s := encodeCandidate(login, id, params, ts, roundDiff, totalShares, submit)
+	m.zset("blocks", "candidates")[s] = float64(height)
+	return false, nil
+}
+
+func (m *MemoryBackend) writeShare(ms, ts int64, login, id string, diff int64) {
+	m.hincrBy(join("shares", "total"), login+"."+id, diff)
+	m.hincrBy(join("shares", "roundCurrent"), login, diff)
+	m.zset("hashrate")[join(diff, login, id, ms)] = float64(ts)
+	m.zset("hashrate", login)[join(diff, id, ms)] = float64(ts)
+	m.hash("miners", login)["lastShare"] = strconv.FormatInt(ts, 10)
+}
+
+func (m *MemoryBackend) formatRound(height int64, nonce string) string {
+	return join("shares", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (m *MemoryBackend) WriteBlockDelay(ctx context.Context, height uint64, nonce string, delay int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	candidates := m.zset("blocks", "candidates")
+	for _, member := range candidates.rangeByScore(float64(height), float64(height)) {
+		key := member.Member.(string)
+		rec := parseCandidate(key)
+		if !isRecord(key) || rec.Nonce != nonce {
+			continue
+		}
+		rec.Delay = delay
+		delete(candidates, key)
+		candidates[encodeRecord(rec)] = float64(height)
+		return nil
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetCandidates(ctx context.Context, maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertCandidateResults(m.zset("blocks", "candidates").rangeByScore(0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetImmatureBlocks(ctx context.Context, maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertBlockResults(m.zset("blocks", "immature").rangeByScore(0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetMaturedBlocks(ctx context.Context, maxBlocks int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertBlockResults(m.zset("blocks", "matured").revRange(0, maxBlocks-1)), nil
+}
+
+func (m *MemoryBackend) GetMaturedBlocksAt(ctx context.Context, height int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertBlockResults(m.zset("blocks", "matured").rangeByScore(float64(height), float64(height))), nil
+}
+
+func (m *MemoryBackend) GetRoundShares(ctx context.Context, height int64, nonce string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]int64)
+	for login, v := range m.hashes[m.formatRound(height, nonce)] {
+		result[login], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetPayees(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []string
+	for key := range m.hashes {
+		if strings.HasPrefix(key, "miners:") {
+			result = append(result, strings.TrimPrefix(key, "miners:"))
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetBalance(ctx context.Context, login string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hgetInt(join("miners", login), "balance"), nil
+}
+
+func (m *MemoryBackend) LockPayouts(ctx context.Context, login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := join("payments", "lock")
+	if _, ok := m.values[key]; ok {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+	m.values[key] = join(login, amount)
+	return nil
+}
+
+func (m *MemoryBackend) UnlockPayouts(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, join("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryBackend) IsPayoutsLocked(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.values[join("payments", "lock")]
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetPendingPayments(ctx context.Context) []*PendingPayment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertPendingPayments(m.zset("payments", "pending").revRange(0, -1))
+}
+
+func (m *MemoryBackend) writeLedgerEntry(login string, entry *LedgerEntry) {
+	if len(entry.Reason) == 0 {
+		entry.Reason = ledgerReasons[entry.Kind]
+	}
+	data, _ := json.Marshal(entry)
+	m.lpush(join("ledger", login), string(data))
+}
+
+func (m *MemoryBackend) UpdateBalance(ctx context.Context, login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := util.MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "balance", amount*-1)
+	m.hincrBy(join("miners", login), "pending", amount)
+	m.hincrBy("finances", "balance", amount*-1)
+	m.hincrBy("finances", "pending", amount)
+	m.zset("payments", "pending")[join(login, amount)] = float64(ts)
+	m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "debit", Amount: amount})
+	return nil
+}
+
+func (m *MemoryBackend) RollbackBalance(ctx context.Context, login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := util.MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "balance", amount)
+	m.hincrBy(join("miners", login), "pending", amount*-1)
+	m.hincrBy("finances", "balance", amount)
+	m.hincrBy("finances", "pending", amount*-1)
+	delete(m.zset("payments", "pending"), join(login, amount))
+	m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "rollback", Amount: amount})
+	return nil
+}
+
+func (m *MemoryBackend) WritePayment(ctx context.Context, login, txHash string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := util.MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "pending", amount*-1)
+	m.hincrBy(join("miners", login), "paid", amount)
+	m.hincrBy("finances", "pending", amount*-1)
+	m.hincrBy("finances", "paid", amount)
+	m.zset("payments", "all")[encodePayment(txHash, login, amount)] = float64(ts)
+	m.zset("payments", login)[encodePayment(txHash, "", amount)] = float64(ts)
+	delete(m.zset("payments", "pending"), join(login, amount))
+	delete(m.values, join("payments", "lock"))
+	m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "payment", Amount: amount, Tx: txHash})
+	return nil
+}
+
+func (m *MemoryBackend) AdjustBalance(ctx context.Context, login string, amount int64, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := util.MakeTimestamp() / 1000
+	if m.hgetInt(join("miners", login), "balance")+amount < 0 {
+		return ErrInsufficientBalance
+	}
+	m.hincrBy(join("miners", login), "balance", amount)
+	m.hincrBy("finances", "balance", amount)
+	m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "adjust", Amount: amount, Reason: reason})
+	return nil
+}
+
+func (m *MemoryBackend) WriteImmatureBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := util.MakeTimestamp() / 1000
+	round := join(block.Height, block.Hash)
+
+	m.writeImmatureBlock(block)
+	total := int64(0)
+	credits := m.hash("credits", "immature", block.Height, block.Hash)
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(join("miners", login), "immature", amount)
+		if _, ok := credits[login]; !ok {
+			credits[login] = strconv.FormatInt(amount, 10)
+		}
+		m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "immature", Amount: amount, Round: round})
+	}
+	m.hincrBy("finances", "immature", total)
+	return nil
+}
+
+func (m *MemoryBackend) WriteMaturedBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	creditKey := join("credits", "immature", block.RoundHeight, block.Hash)
+	ts := util.MakeTimestamp() / 1000
+	round := join(block.RoundHeight, block.Hash)
+
+	m.writeMaturedBlock(block)
+	m.zset("credits", "all")[encodeCredit(block, ts)] = float64(block.Height)
+
+	totalImmature := int64(0)
+	for login, amountString := range m.hashes[creditKey] {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.hincrBy(join("miners", login), "immature", amount*-1)
+	}
+
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(join("miners", login), "balance", amount)
+		m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "credit", Amount: amount, Round: round})
+	}
+	delete(m.hashes, creditKey)
+	m.hincrBy("finances", "balance", total)
+	m.hincrBy("finances", "immature", totalImmature*-1)
+	m.hash("finances")["lastCreditHeight"] = strconv.FormatInt(block.Height, 10)
+	m.hash("finances")["lastCreditHash"] = block.Hash
+	m.hincrBy("finances", "totalMined", block.RewardInShannon())
+	return nil
+}
+
+func (m *MemoryBackend) WriteOrphan(ctx context.Context, block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	creditKey := join("credits", "immature", block.RoundHeight, block.Hash)
+	ts := util.MakeTimestamp() / 1000
+	round := join(block.RoundHeight, block.Hash)
+
+	m.writeMaturedBlock(block)
+
+	totalImmature := int64(0)
+	for login, amountString := range m.hashes[creditKey] {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.hincrBy(join("miners", login), "immature", amount*-1)
+		m.writeLedgerEntry(login, &LedgerEntry{Timestamp: ts, Kind: "orphan", Amount: amount, Round: round})
+	}
+	delete(m.hashes, creditKey)
+	m.hincrBy("finances", "immature", totalImmature*-1)
+	return nil
+}
+
+func (m *MemoryBackend) WritePendingOrphans(ctx context.Context, blocks []*BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, block := range blocks {
+		m.writeImmatureBlock(block)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) writeImmatureBlock(block *BlockData) {
+	if block.Height != block.RoundHeight {
+		from := m.formatRound(block.RoundHeight, block.Nonce)
+		m.hashes[m.formatRound(block.Height, block.Nonce)] = m.hashes[from]
+		delete(m.hashes, from)
+	}
+	delete(m.zset("blocks", "candidates"), block.candidateKey)
+	m.zset("blocks", "immature")[block.key()] = float64(block.Height)
+}
+
+func (m *MemoryBackend) writeMaturedBlock(block *BlockData) {
+	delete(m.hashes, m.formatRound(block.RoundHeight, block.Nonce))
+	delete(m.zset("blocks", "immature"), block.immatureKey)
+	m.zset("blocks", "matured")[block.key()] = float64(block.Height)
+}
+
+func (m *MemoryBackend) IsMinerExists(ctx context.Context, login string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.hashes[join("miners", login)]
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetMinerStats(ctx context.Context, login string, maxPayments int64) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]interface{})
+	stats["stats"] = convertStringMap(m.hashes[join("miners", login)])
+	payments := m.zset("payments", login)
+	stats["payments"] = convertPaymentsResults(payments.revRange(0, maxPayments-1))
+	stats["paymentsTotal"] = int64(len(payments))
+	stats["roundShares"] = m.hgetInt(join("shares", "roundCurrent"), login)
+	return stats, nil
+}
+
+func (m *MemoryBackend) FlushStaleStats(ctx context.Context, window, largeWindow time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := util.MakeTimestamp() / 1000
+	total := m.zset("hashrate").removeBelow(float64(now - int64(window/time.Second)))
+	for key, z := range m.zsets {
+		if strings.HasPrefix(key, "hashrate:") {
+			total += z.removeBelow(float64(now - int64(largeWindow/time.Second)))
+		}
+	}
+	return total, nil
+}
+
+func (m *MemoryBackend) CollectStats(ctx context.Context, smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	window := int64(smallWindow / time.Second)
+	stats := make(map[string]interface{})
+	now := util.MakeTimestamp() / 1000
+
+	hashrate := m.zset("hashrate")
+	hashrate.removeBelow(float64(now - window))
+	stats["stats"] = convertStringMap(m.hash("stats"))
+
+	candidates := m.zset("blocks", "candidates")
+	stats["candidates"] = convertCandidateResults(candidates.revRange(0, -1))
+	stats["candidatesTotal"] = int64(len(candidates))
+
+	immature := m.zset("blocks", "immature")
+	stats["immature"] = convertBlockResults(immature.revRange(0, -1))
+	stats["immatureTotal"] = int64(len(immature))
+
+	matured := m.zset("blocks", "matured")
+	stats["matured"] = convertBlockResults(matured.revRange(0, maxBlocks-1))
+	stats["maturedTotal"] = int64(len(matured))
+
+	payments := m.zset("payments", "all")
+	stats["payments"] = convertPaymentsResults(payments.revRange(0, maxPayments-1))
+	stats["paymentsTotal"] = int64(len(payments))
+
+	totalHashrate, miners := convertMinersStats(window, hashrate.sorted())
+	stats["miners"] = miners
+	stats["minersTotal"] = len(miners)
+	stats["hashrate"] = totalHashrate
+	return stats, nil
+}
+
+func (m *MemoryBackend) CollectWorkersStats(ctx context.Context, sWindow, lWindow time.Duration, login string, showTotalHashes bool) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	smallWindow := int64(sWindow / time.Second)
+	largeWindow := int64(lWindow / time.Second)
+	now := util.MakeTimestamp() / 1000
+
+	hashrate := m.zset("hashrate", login)
+	hashrate.removeBelow(float64(now - largeWindow))
+	workers := convertWorkersStats(smallWindow, hashrate.sorted())
+	stats := summarizeWorkersStats(now, smallWindow, largeWindow, workers, func(id string) int64 {
+		if !showTotalHashes {
+			return 0
+		}
+		return m.hgetInt(join("shares", "total"), login+"."+id)
+	})
+	return stats, nil
+}
+
+func (m *MemoryBackend) CollectLuckStats(ctx context.Context, windows []int) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	max := int64(windows[len(windows)-1])
+	immature := m.zset("blocks", "immature").revRange(0, -1)
+	matured := m.zset("blocks", "matured").revRange(0, max-1)
+	return convertLuckStats(windows, convertBlockResults(immature, matured)), nil
+}
+
+func (m *MemoryBackend) CollectBlockStats(ctx context.Context, days int) (*BlockStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	immature := m.zset("blocks", "immature").revRange(0, -1)
+	matured := m.zset("blocks", "matured").revRange(0, blockStatsLimit-1)
+	return convertBlockStats(days, util.MakeTimestamp()/1000, convertBlockResults(immature, matured)), nil
+}
+
+func (m *MemoryBackend) WriteHashrateSnapshot(ctx context.Context, window, interval time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := util.MakeTimestamp() / 1000
+	step := int64(interval / time.Second)
+	ts := now - now%step
+	if len(m.zset(chartKey("raw", "")).rangeByScore(float64(ts), math.Inf(1))) > 0 {
+		return false, nil
+	}
+	raw := m.zset("hashrate").rangeByScore(float64(now-int64(window/time.Second)), math.Inf(1))
+	pool, miners := convertHashrateSnapshot(now, int64(window/time.Second), step, raw)
+
+	series := chartSeriesList[0]
+	oldest := chartSeriesList[len(chartSeriesList)-1]
+	m.writeChartPoint(series, "", pool)
+	for login, miner := range miners {
+		m.writeChartPoint(series, login, miner)
+		m.zset("charts", "miners")[login] = float64(ts)
+	}
+	m.zset("charts", "miners").removeBelow(float64(ts - oldest.keep()))
+	for i := 1; i < len(chartSeriesList); i++ {
+		m.compactChart(chartSeriesList[i-1], chartSeriesList[i], now)
+	}
+	return true, nil
+}
+
+func (m *MemoryBackend) writeChartPoint(s *chartSeries, login string, p *ChartPoint) {
+	points := m.zset(chartKey(s.name, login))
+	for member, score := range points {
+		if int64(score) == p.Timestamp {
+			delete(points, member)
+		}
+	}
+	points[encodeChartPoint(p)] = float64(p.Timestamp)
+	points.removeBelow(float64(p.Timestamp - s.keep()))
+}
+
+func (m *MemoryBackend) compactChart(from, to *chartSeries, now int64) {
+	last := m.hgetInt(join("charts", "compacted"), to.name)
+	start, end := compactRange(last, now, from, to)
+	if start >= end {
+		return
+	}
+	logins := []string{""}
+	for _, v := range m.zset("charts", "miners").rangeByScore(float64(start), math.Inf(1)) {
+		logins = append(logins, v.Member.(string))
+	}
+	for _, login := range logins {
+		var raw []string
+		for _, v := range m.zset(chartKey(from.name, login)).rangeByScore(float64(start), float64(end-1)) {
+			raw = append(raw, v.Member.(string))
+		}
+		for _, p := range downsampleChart(to.step, convertChartPoints(raw)) {
+			m.writeChartPoint(to, login, p)
+		}
+	}
+	m.hash("charts", "compacted")[to.name] = strconv.FormatInt(end, 10)
+}
+
+func (m *MemoryBackend) GetHashrateChart(ctx context.Context, login string, period time.Duration) ([]*ChartPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := chartSeriesFor(period)
+	var raw []string
+	for _, v := range m.zset(chartKey(s.name, login)).rangeByScore(float64(util.MakeTimestamp()/1000-int64(period/time.Second)), math.Inf(1)) {
+		raw = append(raw, v.Member.(string))
+	}
+	return convertChartPoints(raw), nil
+}
+
+func (m *MemoryBackend) WriteNetworkStats(ctx context.Context, stats *NetworkStats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := stats.Timestamp - stats.Timestamp%networkHistoryStep
+	history := m.zset("network")
+	for member, score := range history {
+		if int64(score) >= ts {
+			delete(history, member)
+		}
+	}
+	history[encodeNetworkStats(stats)] = float64(ts)
+	history.removeBelow(float64(ts - networkHistoryKeep))
+	return nil
+}
+
+func (m *MemoryBackend) GetNetworkHistory(ctx context.Context, period time.Duration) ([]*NetworkStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var raw []string
+	for _, v := range m.zset("network").rangeByScore(float64(util.MakeTimestamp()/1000-int64(period/time.Second)), math.Inf(1)) {
+		raw = append(raw, v.Member.(string))
+	}
+	return convertNetworkHistory(raw), nil
+}
+
+func (m *MemoryBackend) GetLedger(ctx context.Context, login string, offset, limit int64) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.lrange(join("ledger", login), offset, limit)
+	result := make([]*LedgerEntry, 0, len(rows))
+	for _, v := range rows {
+		entry := &LedgerEntry{}
+		if err := json.Unmarshal([]byte(v), entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetFinances(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]int64)
+	for _, field := range append(fundsFields, "totalMined") {
+		result[field] = m.hgetInt("finances", field)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) SumMinersFunds(ctx context.Context) (int64, map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := int64(0)
+	result := make(map[string]int64)
+	for _, field := range fundsFields {
+		result[field] = 0
+	}
+	for key := range m.hashes {
+		if !strings.HasPrefix(key, "miners:") {
+			continue
+		}
+		for _, field := range fundsFields {
+			result[field] += m.hgetInt(key, field)
+		}
+		count++
+	}
+	return count, result, nil
+}
+
+func (m *MemoryBackend) WriteConsistencyReport(ctx context.Context, report *ConsistencyReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	m.values["consistency"] = string(data)
+	return nil
+}
+
+func (m *MemoryBackend) GetConsistencyReport(ctx context.Context) (*ConsistencyReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.values["consistency"]
+	if !ok {
+		return nil, nil
+	}
+	report := &ConsistencyReport{}
+	err := json.Unmarshal([]byte(data), report)
+	return report, err
+}
+
+func (m *MemoryBackend) WriteFeeSchedule(ctx context.Context, fees *FeeSchedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(fees)
+	if err != nil {
+		return err
+	}
+	m.values["fees"] = string(data)
+	return nil
+}
+
+func (m *MemoryBackend) GetFeeSchedule(ctx context.Context) (*FeeSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.values["fees"]
+	if !ok {
+		return nil, nil
+	}
+	fees := &FeeSchedule{}
+	err := json.Unmarshal([]byte(data), fees)
+	return fees, err
+}
+
+func (m *MemoryBackend) SetFeeOverride(ctx context.Context, login string, fee float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hash("fees", "overrides")[login] = strconv.FormatFloat(fee, 'f', -1, 64)
+	return nil
+}
+
+func (m *MemoryBackend) RemoveFeeOverride(ctx context.Context, login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hash("fees", "overrides"), login)
+	return nil
+}
+
+func (m *MemoryBackend) GetFeeOverrides(ctx context.Context) (map[string]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertFeeOverrides(m.hash("fees", "overrides")), nil
+}
+
+func (m *MemoryBackend) GetMinersHashrate(ctx context.Context, logins []string, window time.Duration) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := int64(window / time.Second)
+	min := float64(util.MakeTimestamp()/1000 - seconds)
+	result := make(map[string]int64)
+	for _, login := range logins {
+		var members []string
+		for _, v := range m.zset("hashrate", login).rangeByScore(min, math.Inf(1)) {
+			members = append(members, v.Member.(string))
+		}
+		result[login] = sumHashrate(members) / seconds
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteRewardMismatch(ctx context.Context, mismatch *RewardMismatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(mismatch)
+	if err != nil {
+		return err
+	}
+	m.hash("rewards", "mismatches")[mismatch.Round] = string(data)
+	return nil
+}
+
+func (m *MemoryBackend) GetRewardMismatches(ctx context.Context) (map[string]*RewardMismatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertRewardMismatches(m.hash("rewards", "mismatches"))
+}
+
+func (m *MemoryBackend) ConfirmRewardMismatch(ctx context.Context, round, reward string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.hash("rewards", "mismatches")[round]
+	if !ok {
+		return false, nil
+	}
+	mismatch := &RewardMismatch{}
+	if err := json.Unmarshal([]byte(data), mismatch); err != nil {
+		return true, err
+	}
+	mismatch.Confirmed = true
+	mismatch.Reward = reward
+	result, _ := json.Marshal(mismatch)
+	m.hash("rewards", "mismatches")[round] = string(result)
+	return true, nil
+}
+
+func (m *MemoryBackend) RemoveRewardMismatch(ctx context.Context, round string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hash("rewards", "mismatches"), round)
+	return nil
+}
+
+func (m *MemoryBackend) GetHistory(ctx context.Context, key string, offset, limit int64) ([]*HistoryEntry, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	z := m.zsets[key]
+	return convertHistoryEntries(key, z.revRange(offset, offset+limit-1)), int64(len(z)), nil
+}
+
+func (m *MemoryBackend) GetOldestHistory(ctx context.Context, key string, limit int64) ([]*HistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertHistoryEntries(key, sliceRange(m.zsets[key].sorted(), 0, limit-1)), nil
+}
+
+func (m *MemoryBackend) RemoveHistory(ctx context.Context, key string, entries []*HistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		if _, ok := m.zsets[key][e.Member]; ok {
+			delete(m.zsets[key], e.Member)
+			m.hincrBy(join("history", "archived"), key, 1)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetArchivedCount(ctx context.Context, key string) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.hash("history", "archived")[key]
+	return m.hgetInt(join("history", "archived"), key), ok, nil
+}
+
+func (m *MemoryBackend) SetArchivedCount(ctx context.Context, key string, n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.hash("history", "archived")[key]; !ok {
+		m.hash("history", "archived")[key] = strconv.FormatInt(n, 10)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) MigrateRecords(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := int64(0)
+	for key, z := range m.zsets {
+		if !isRecordKey(key) {
+			continue
+		}
+		remove, add := migrateRows(key, z.sorted())
+		for i := range add {
+			delete(z, remove[i].(string))
+			z[add[i].Member.(string)] = add[i].Score
+		}
+		total += int64(len(add))
+	}
+	return total, nil
+}
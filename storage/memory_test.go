@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryWriteShareCheckExist(t *testing.T) {
+	m := NewMemoryBackend()
+
+	exist, _ := m.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = m.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = m.WriteShare(ctx, "z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
+	if !exist {
+		t.Error("PoW must exist")
+	}
+	exist, _ = m.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+}
+
+func TestMemoryBlockLifecycle(t *testing.T) {
+	m := NewMemoryBackend()
+
+	m.WriteShare(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 300, 100, 0)
+	m.WriteShare(ctx, "z", "rig", []string{"0x2", "0x0", "0x0"}, 100, 100, 0)
+	m.WriteBlock(ctx, "x", "rig", []string{"0x3", "0x0", "0x0"}, 100, 5000, 100, 0, nil)
+
+	candidates, _ := m.GetCandidates(ctx, 100)
+	if len(candidates) != 1 || candidates[0].Nonce != "0x3" || candidates[0].TotalShares != 500 {
+		t.Fatalf("Must write block candidate: %+v", candidates)
+	}
+	if candidates[0].Finder != "x" || candidates[0].Worker != "rig" {
+		t.Errorf("Must write block finder: %+v", candidates[0])
+	}
+	shares, _ := m.GetRoundShares(ctx, 100, "0x3")
+	if !reflect.DeepEqual(shares, map[string]int64{"x": 400, "z": 100}) {
+		t.Errorf("Must close round with shares: %v", shares)
+	}
+	if stats, _ := m.GetMinerStats(ctx, "x", 10); stats["roundShares"] != int64(0) {
+		t.Errorf("Must start new round: %v", stats["roundShares"])
+	}
+
+	block := candidates[0]
+	block.Height = 101
+	block.Hash = "0xabc"
+	block.Reward = big.NewInt(5e18)
+	m.WriteImmatureBlock(ctx, block, map[string]int64{"x": 4000000000, "z": 1000000000})
+
+	if candidates, _ := m.GetCandidates(ctx, 1000); len(candidates) != 0 {
+		t.Error("Must remove candidate")
+	}
+	immature, _ := m.GetImmatureBlocks(ctx, 1000)
+	if len(immature) != 1 || immature[0].Height != 101 || immature[0].Finder != "x" {
+		t.Fatalf("Must write immature block: %+v", immature)
+	}
+	if shares, _ := m.GetRoundShares(ctx, 101, "0x3"); len(shares) != 2 {
+		t.Error("Must move round shares to correct height")
+	}
+
+	block = immature[0]
+	block.Reward = big.NewInt(5e18)
+	m.WriteMaturedBlock(ctx, block, map[string]int64{"x": 4000000000, "z": 1000000000})
+
+	if immature, _ := m.GetImmatureBlocks(ctx, 1000); len(immature) != 0 {
+		t.Error("Must remove immature block")
+	}
+	if matured, _ := m.GetMaturedBlocks(ctx, 10); len(matured) != 1 || matured[0].Finder != "x" || matured[0].Worker != "rig" {
+		t.Error("Must write matured block with finder")
+	}
+	finances, _ := m.GetFinances(ctx)
+	if finances["balance"] != 5000000000 || finances["immature"] != 0 || finances["totalMined"] != 5000000000 {
+		t.Errorf("Must credit finances: %v", finances)
+	}
+	if balance, _ := m.GetBalance(ctx, "x"); balance != 4000000000 {
+		t.Errorf("Must credit miner: %v", balance)
+	}
+	_, funds, _ := m.SumMinersFunds(ctx)
+	if funds["balance"] != finances["balance"] || funds["immature"] != 0 {
+		t.Errorf("Miners funds must match finances: %v", funds)
+	}
+}
+
+func TestMemoryPayout(t *testing.T) {
+	m := NewMemoryBackend()
+	m.AdjustBalance(ctx, "x", 1000, "test")
+
+	if err := m.LockPayouts(ctx, "x", 1000); err != nil {
+		t.Fatal("Must lock payouts")
+	}
+	if err := m.LockPayouts(ctx, "x", 1000); err == nil {
+		t.Error("Must not overwrite lock")
+	}
+	m.UpdateBalance(ctx, "x", 1000)
+	pending := m.GetPendingPayments(ctx)
+	if len(pending) != 1 || pending[0].Address != "x" || pending[0].Amount != 1000 {
+		t.Fatalf("Must have pending payment: %v", pending)
+	}
+
+	m.WritePayment(ctx, "x", "0x0", 1000)
+	if locked, _ := m.IsPayoutsLocked(ctx); locked {
+		t.Error("Must release lock")
+	}
+	if len(m.GetPendingPayments(ctx)) != 0 {
+		t.Error("Must remove pending payment")
+	}
+	stats, _ := m.GetMinerStats(ctx, "x", 10)
+	if stats["paymentsTotal"] != int64(1) {
+		t.Errorf("Must write payment: %v", stats)
+	}
+	finances, _ := m.GetFinances(ctx)
+	if finances["balance"] != 0 || finances["pending"] != 0 || finances["paid"] != 1000 {
+		t.Errorf("Must update finances: %v", finances)
+	}
+	ledger, _ := m.GetLedger(ctx, "x", 0, 10)
+	if len(ledger) != 3 || ledger[0].Kind != "payment" || ledger[2].Kind != "adjust" {
+		t.Errorf("Must record ledger: %v", ledger)
+	}
+}
+
+func TestZsetRange(t *testing.T) {
+	z := zset{"b": 1, "a": 1, "c": 2, "d": 0}
+
+	rows := z.revRange(0, 1)
+	if len(rows) != 2 || rows[0].Member != "c" || rows[1].Member != "b" {
+		t.Errorf("Must order by score then member: %v", rows)
+	}
+	if rows := z.revRange(0, -1); len(rows) != 4 {
+		t.Errorf("Must return all rows: %v", rows)
+	}
+	if rows := z.rangeByScore(1, 2); len(rows) != 3 || rows[0].Member != "a" {
+		t.Errorf("Must return rows in score range: %v", rows)
+	}
+	if n := z.removeBelow(1); n != 1 || len(z) != 3 {
+		t.Error("Must remove rows below score")
+	}
+}
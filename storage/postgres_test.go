@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Journal tests need PostgreSQL, database is wiped by them
+func newTestPostgres(t *testing.T) *PostgresClient {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if len(url) == 0 {
+		t.Skip("POSTGRES_TEST_URL is not set")
+	}
+	p, err := NewPostgresClient(&PostgresConfig{Url: url}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.db.Exec(`TRUNCATE blocks, ledger, audit, journal RESTART IDENTITY`); err != nil {
+		t.Fatal(err)
+	}
+	reset()
+	return p
+}
+
+func journalStates(t *testing.T, p *PostgresClient) []string {
+	rows, err := p.db.Query(`SELECT state FROM journal ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var states []string
+	for rows.Next() {
+		var state string
+		rows.Scan(&state)
+		states = append(states, state)
+	}
+	return states
+}
+
+// Moves journal records back in time, so that they are old enough to be reconciled
+func ageJournal(t *testing.T, p *PostgresClient) {
+	if _, err := p.db.Exec(`UPDATE journal SET timestamp = timestamp - $1`, journalReconcileAge*2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	p := newTestPostgres(t)
+
+	if err := p.AdjustBalance(ctx, "x", 1000, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if states := journalStates(t, p); !reflect.DeepEqual(states, []string{journalApplied}) {
+		t.Fatalf("Must mark journal record applied: %v", states)
+	}
+	var journal int64
+	if err := p.db.QueryRow(`SELECT journal_id FROM ledger WHERE login = 'x'`).Scan(&journal); err != nil || journal != 1 {
+		t.Errorf("Must tag ledger row with journal record: %v, %v", journal, err)
+	}
+	if ledger, _ := r.GetLedger(ctx, "x", 0, 10); len(ledger) != 1 || ledger[0].Journal != 1 {
+		t.Errorf("Must tag Redis ledger with journal record: %+v", ledger)
+	}
+
+	// Record is committed before Redis is changed and stays pending if Redis fails
+	if err := p.AdjustBalance(ctx, "x", -5000, "test"); err != ErrInsufficientBalance {
+		t.Fatalf("Must return Redis error: %v", err)
+	}
+	if states := journalStates(t, p); !reflect.DeepEqual(states, []string{journalApplied, journalPending}) {
+		t.Errorf("Must keep journal record pending: %v", states)
+	}
+
+	// Nothing is journaled nor applied if journal can't be written
+	failed := errors.New("failed")
+	applied := false
+	err := p.journal(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		return failed
+	}, func(ctx context.Context) error {
+		applied = true
+		return nil
+	})
+	if err != failed || applied {
+		t.Errorf("Must not apply change without journal record: %v, %v", err, applied)
+	}
+	if states := journalStates(t, p); len(states) != 2 {
+		t.Errorf("Must roll back journal record: %v", states)
+	}
+}
+
+func TestReconcileJournal(t *testing.T) {
+	p := newTestPostgres(t)
+
+	// Applied to Redis, but crashed before marking record applied
+	p.AdjustBalance(ctx, "x", 1000, "test")
+	p.setJournalState(ctx, 1, journalPending)
+	// Rejected by Redis
+	p.AdjustBalance(ctx, "y", -1000, "test")
+	// Audit record has no ledger entries to check
+	p.journal(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		return nil
+	}, func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	ageJournal(t, p)
+	// Recent record may still be applied by running module
+	p.AdjustBalance(ctx, "z", -1000, "test")
+
+	n, err := p.ReconcileJournal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Must resolve old pending records only: %v", n)
+	}
+	expected := []string{journalApplied, journalFailed, journalUnverified, journalPending}
+	if states := journalStates(t, p); !reflect.DeepEqual(states, expected) {
+		t.Errorf("Must resolve records by Redis ledger: %v", states)
+	}
+}
+
+func TestRestoreBalances(t *testing.T) {
+	p := newTestPostgres(t)
+
+	p.AdjustBalance(ctx, "x", 1000, "test")
+	p.UpdateBalance(ctx, "x", 400)
+	p.WritePayment(ctx, "x", "0x1", 300)
+	p.RollbackBalance(ctx, "x", 100)
+	p.AdjustBalance(ctx, "y", 200, "test")
+	// Failed change must not be restored
+	p.AdjustBalance(ctx, "y", -1000, "test")
+
+	if _, err := p.RestoreBalances(ctx); err == nil {
+		t.Fatal("Must refuse to restore with pending journal records")
+	}
+	ageJournal(t, p)
+	if _, err := p.ReconcileJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r.client.HSet(ctx, r.formatKey("miners", "x"), "balance", 0, "paid", 0)
+	r.client.Del(ctx, r.formatKey("finances"))
+	n, err := p.RestoreBalances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Must restore funds of every miner: %v", n)
+	}
+	miner := r.client.HGetAll(ctx, r.formatKey("miners", "x")).Val()
+	if miner["balance"] != "700" || miner["pending"] != "0" || miner["paid"] != "300" {
+		t.Errorf("Must restore miner's funds: %v", miner)
+	}
+	finances := r.client.HGetAll(ctx, r.formatKey("finances")).Val()
+	if finances["balance"] != "900" || finances["pending"] != "0" || finances["paid"] != "300" {
+		t.Errorf("Must restore pool's finances: %v", finances)
+	}
+}
+
+func TestReplayLedger(t *testing.T) {
+	rows := []*ledgerRow{
+		{"x", &LedgerEntry{Kind: "immature", Amount: 300, Round: "101:0xa"}},
+		{"y", &LedgerEntry{Kind: "immature", Amount: 200, Round: "101:0xa"}},
+		{"x", &LedgerEntry{Kind: "immature", Amount: 50, Round: "105:0xb"}},
+		// Credit is keyed by round height, which differs from block height
+		{"x", &LedgerEntry{Kind: "credit", Amount: 300, Round: "100:0xa"}},
+		{"y", &LedgerEntry{Kind: "credit", Amount: 200, Round: "100:0xa"}},
+		{"x", &LedgerEntry{Kind: "orphan", Amount: 50, Round: "104:0xb"}},
+		{"x", &LedgerEntry{Kind: "debit", Amount: 250}},
+		{"x", &LedgerEntry{Kind: "rollback", Amount: 250}},
+		{"x", &LedgerEntry{Kind: "debit", Amount: 250}},
+		{"x", &LedgerEntry{Kind: "payment", Amount: 200}},
+		{"y", &LedgerEntry{Kind: "debit", Amount: 150}},
+		{"y", &LedgerEntry{Kind: "adjust", Amount: -20}},
+		{"z", &LedgerEntry{Kind: "immature", Amount: 70, Round: "110:0xc"}},
+	}
+	funds := replayLedger(rows)
+	expected := map[string]*restoredFunds{
+		"x": {Balance: 50, Pending: 50, Paid: 200},
+		"y": {Balance: 30, Pending: 150},
+		"z": {Immature: 70},
+	}
+	if !reflect.DeepEqual(funds, expected) {
+		for login, f := range funds {
+			t.Logf("%s: %+v", login, f)
+		}
+		t.Error("Must restore funds from ledger")
+	}
+}
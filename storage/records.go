@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Blocks, credits and payments are stored in sorted sets as JSON records.
+// New fields may be added to records freely, version is bumped only if meaning of existing field changes.
+// Records written before versioning are colon-joined strings, they are still parsed and can be
+// rewritten with "storage migrate" command.
+const recordVersion = 1
+
+type blockRecord struct {
+	Version     int     `json:"v"`
+	Nonce       string  `json:"nonce"`
+	Finder      string  `json:"finder,omitempty"`
+	Worker      string  `json:"worker,omitempty"`
+	Upstream    string  `json:"upstream,omitempty"`
+	Delay       int64   `json:"delay,omitempty"`
+	PowHash     string  `json:"powHash,omitempty"`
+	MixDigest   string  `json:"mixDigest,omitempty"`
+	Hash        string  `json:"hash,omitempty"`
+	UncleHeight int64   `json:"uncleHeight,omitempty"`
+	Orphan      bool    `json:"orphan,omitempty"`
+	Timestamp   int64   `json:"timestamp"`
+	Difficulty  int64   `json:"difficulty"`
+	Shares      int64   `json:"shares"`
+	Effort      float64 `json:"effort,omitempty"`
+	Reward      string  `json:"reward,omitempty"`
+	// Tx fees kept by pool apart from reward
+	ExtraReward string `json:"extraReward,omitempty"`
+	// Fees of miners are fixed once round is credited, even if none differs from pool fee
+	MinerFees map[string]float64 `json:"minerFees,omitempty"`
+	FeesFixed bool               `json:"feesFixed,omitempty"`
+}
+
+type creditRecord struct {
+	Version   int    `json:"v"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+	Reward    string `json:"reward"`
+	// Finder's bonus in Shannon, included into his credit
+	Finder string `json:"finder,omitempty"`
+	Bonus  int64  `json:"bonus,omitempty"`
+}
+
+type paymentRecord struct {
+	Version int    `json:"v"`
+	Tx      string `json:"tx"`
+	Login   string `json:"login,omitempty"`
+	Amount  int64  `json:"amount"`
+}
+
+type chartRecord struct {
+	Version int `json:"v"`
+	ChartPoint
+}
+
+type networkRecord struct {
+	Version int `json:"v"`
+	NetworkStats
+}
+
+func isRecord(member string) bool {
+	return strings.HasPrefix(member, "{")
+}
+
+func encodeRecord(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func formatReward(reward *big.Int) string {
+	if reward == nil {
+		return "0"
+	}
+	return reward.String()
+}
+
+func roundEffort(shares, difficulty int64) float64 {
+	if difficulty <= 0 {
+		return 0
+	}
+	return float64(shares) / float64(difficulty)
+}
+
+// Effort is computed for records written before it was stored
+func (r *blockRecord) effort() float64 {
+	if r.Effort > 0 {
+		return r.Effort
+	}
+	return roundEffort(r.Shares, r.Difficulty)
+}
+
+func encodeCandidate(login, id string, params []string, ts, roundDiff, totalShares int64, submit *BlockSubmit) string {
+	r := &blockRecord{
+		Version: recordVersion, Nonce: params[0], Finder: login, Worker: id, PowHash: params[1], MixDigest: params[2],
+		Timestamp: ts, Difficulty: roundDiff, Shares: totalShares, Effort: roundEffort(totalShares, roundDiff),
+	}
+	if submit != nil {
+		r.Upstream, r.Delay = submit.Upstream, submit.Delay
+	}
+	return encodeRecord(r)
+}
+
+func encodeBlock(b *BlockData) string {
+	r := &blockRecord{
+		Version: recordVersion, Nonce: b.Nonce, Finder: b.Finder, Worker: b.Worker, Upstream: b.Upstream, Delay: b.Delay,
+		Hash: b.serializeHash(), UncleHeight: b.UncleHeight, Orphan: b.Orphan,
+		Timestamp: b.Timestamp, Difficulty: b.Difficulty, Shares: b.TotalShares, Effort: b.Effort, Reward: formatReward(b.Reward),
+		MinerFees: b.MinerFees, FeesFixed: b.MinerFees != nil,
+	}
+	if b.ExtraReward != nil {
+		r.ExtraReward = b.ExtraReward.String()
+	}
+	return encodeRecord(r)
+}
+
+func encodeCredit(b *BlockData, ts int64) string {
+	r := &creditRecord{Version: recordVersion, Hash: b.Hash, Timestamp: ts, Reward: formatReward(b.Reward)}
+	if b.FinderBonus > 0 {
+		r.Finder, r.Bonus = b.Finder, b.FinderBonus
+	}
+	return encodeRecord(r)
+}
+
+// Login is omitted in per-miner payments
+func encodePayment(txHash, login string, amount int64) string {
+	return encodeRecord(&paymentRecord{Version: recordVersion, Tx: txHash, Login: login, Amount: amount})
+}
+
+func encodeChartPoint(p *ChartPoint) string {
+	return encodeRecord(&chartRecord{Version: recordVersion, ChartPoint: *p})
+}
+
+func encodeNetworkStats(stats *NetworkStats) string {
+	return encodeRecord(&networkRecord{Version: recordVersion, NetworkStats: *stats})
+}
+
+// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+func parseLegacyCandidate(member string) *blockRecord {
+	fields := strings.Split(member, ":")
+	if len(fields) < 6 {
+		return &blockRecord{}
+	}
+	r := &blockRecord{Nonce: fields[0], PowHash: fields[1], MixDigest: fields[2]}
+	r.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+	r.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+	r.Shares, _ = strconv.ParseInt(fields[5], 10, 64)
+	return r
+}
+
+// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+func parseLegacyBlock(member string) *blockRecord {
+	fields := strings.Split(member, ":")
+	if len(fields) < 8 {
+		return &blockRecord{}
+	}
+	r := &blockRecord{Nonce: fields[2], Hash: fields[3], Reward: fields[7]}
+	r.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
+	r.Orphan, _ = strconv.ParseBool(fields[1])
+	r.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
+	r.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
+	r.Shares, _ = strconv.ParseInt(fields[6], 10, 64)
+	return r
+}
+
+// "blockHash:timestamp:rewardInWei"
+func parseLegacyCredit(member string) *creditRecord {
+	fields := strings.Split(member, ":")
+	if len(fields) < 3 {
+		return &creditRecord{}
+	}
+	r := &creditRecord{Hash: fields[0], Reward: fields[2]}
+	r.Timestamp, _ = strconv.ParseInt(fields[1], 10, 64)
+	return r
+}
+
+// "txHash:login:amount" for pool's payments or "txHash:amount" for miner's payments
+func parseLegacyPayment(member string) *paymentRecord {
+	fields := strings.Split(member, ":")
+	r := &paymentRecord{Tx: fields[0]}
+	if len(fields) == 2 {
+		r.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+	} else if len(fields) > 2 {
+		r.Login = fields[1]
+		r.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+	}
+	return r
+}
+
+func parseCandidate(member string) *blockRecord {
+	if !isRecord(member) {
+		return parseLegacyCandidate(member)
+	}
+	r := &blockRecord{}
+	json.Unmarshal([]byte(member), r)
+	return r
+}
+
+func parseBlock(member string) *blockRecord {
+	if !isRecord(member) {
+		return parseLegacyBlock(member)
+	}
+	r := &blockRecord{}
+	json.Unmarshal([]byte(member), r)
+	return r
+}
+
+func parseCredit(member string) *creditRecord {
+	if !isRecord(member) {
+		return parseLegacyCredit(member)
+	}
+	r := &creditRecord{}
+	json.Unmarshal([]byte(member), r)
+	return r
+}
+
+func parsePayment(member string) *paymentRecord {
+	if !isRecord(member) {
+		return parseLegacyPayment(member)
+	}
+	r := &paymentRecord{}
+	json.Unmarshal([]byte(member), r)
+	return r
+}
+
+// Charts were introduced with records, there are no legacy points
+func parseChartPoint(member string) *ChartPoint {
+	r := &chartRecord{}
+	json.Unmarshal([]byte(member), r)
+	return &r.ChartPoint
+}
+
+func parseNetworkStats(member string) *NetworkStats {
+	r := &networkRecord{}
+	json.Unmarshal([]byte(member), r)
+	return &r.NetworkStats
+}
+
+// Sorted sets holding records, per-miner payments are migrated as well
+var recordKeys = []string{"blocks:candidates", "blocks:immature", "blocks:matured", "credits:all", "payments:all"}
+
+// Per-miner payments are kept in "payments:<login>", pending payments and locks are not records
+func isRecordKey(key string) bool {
+	for _, k := range recordKeys {
+		if k == key {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, "payments:") && key != "payments:pending"
+}
+
+// Returns record for legacy member of given sorted set, false if member is a record already
+func migrateMember(key, member string) (string, bool) {
+	if isRecord(member) {
+		return member, false
+	}
+	switch key {
+	case "blocks:candidates":
+		r := parseLegacyCandidate(member)
+		r.Version = recordVersion
+		return encodeRecord(r), true
+	case "blocks:immature", "blocks:matured":
+		r := parseLegacyBlock(member)
+		r.Version = recordVersion
+		return encodeRecord(r), true
+	case "credits:all":
+		r := parseLegacyCredit(member)
+		r.Version = recordVersion
+		return encodeRecord(r), true
+	}
+	r := parseLegacyPayment(member)
+	r.Version = recordVersion
+	return encodeRecord(r), true
+}
+
+// Members are rewritten in batches, each batch in a transaction
+const migrateBatch = 100
+
+func migrateRows(key string, rows []redis.Z) (remove []interface{}, add []redis.Z) {
+	for _, z := range rows {
+		if member, ok := migrateMember(key, z.Member.(string)); ok {
+			remove = append(remove, z.Member)
+			add = append(add, redis.Z{Score: z.Score, Member: member})
+		}
+	}
+	return remove, add
+}
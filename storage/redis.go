@@ -1,49 +1,86 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/webchain-network/webchaind/common"
-	"gopkg.in/redis.v3"
+	"github.com/redis/go-redis/v9"
 
 	"github.com/webchain-network/webchain-pool/util"
 )
 
 type Config struct {
-	Endpoint string `json:"endpoint"`
-	Password string `json:"password"`
-	Database int64  `json:"database"`
-	PoolSize int    `json:"poolSize"`
+	Endpoint string         `json:"endpoint"`
+	Password string         `json:"password"`
+	Database int64          `json:"database"`
+	PoolSize int            `json:"poolSize"`
+	// Deadline of a single storage call, 5s by default
+	Timeout  string         `json:"timeout"`
+	Sentinel SentinelConfig `json:"sentinel"`
+}
+
+// Master is discovered through sentinels and client reconnects to a new master on failover
+type SentinelConfig struct {
+	MasterName string   `json:"masterName"`
+	Addrs      []string `json:"addrs"`
+	Password   string   `json:"password"`
 }
 
 type RedisClient struct {
-	client *redis.Client
-	prefix string
+	client redis.UniversalClient
+	prefix  string
+	timeout time.Duration
 }
 
+const defaultTimeout = 5 * time.Second
+
+// Attempts of optimistic transaction before giving up on concurrent changes of watched keys
+const maxWatchRetries = 5
+
 type BlockData struct {
-	Height         int64    `json:"height"`
-	Timestamp      int64    `json:"timestamp"`
-	Difficulty     int64    `json:"difficulty"`
-	TotalShares    int64    `json:"shares"`
-	Uncle          bool     `json:"uncle"`
-	UncleHeight    int64    `json:"uncleHeight"`
-	Orphan         bool     `json:"orphan"`
-	Hash           string   `json:"hash"`
-	Nonce          string   `json:"-"`
-	PowHash        string   `json:"-"`
-	MixDigest      string   `json:"-"`
-	Reward         *big.Int `json:"-"`
-	ExtraReward    *big.Int `json:"-"`
-	ImmatureReward string   `json:"-"`
-	RewardString   string   `json:"reward"`
-	RoundHeight    int64    `json:"-"`
-	candidateKey   string
-	immatureKey    string
+	Height          int64    `json:"height"`
+	Timestamp       int64    `json:"timestamp"`
+	Difficulty      int64    `json:"difficulty"`
+	TotalShares     int64    `json:"shares"`
+	Effort          float64  `json:"effort"`
+	Uncle           bool     `json:"uncle"`
+	UncleHeight     int64    `json:"uncleHeight"`
+	Orphan          bool     `json:"orphan"`
+	Hash            string   `json:"hash"`
+	Finder          string   `json:"finder,omitempty"`
+	Worker          string   `json:"worker,omitempty"`
+	Upstream        string   `json:"upstream,omitempty"`
+	Delay           int64    `json:"delay,omitempty"`
+	Nonce           string   `json:"-"`
+	PowHash         string   `json:"-"`
+	MixDigest       string   `json:"-"`
+	Reward          *big.Int `json:"-"`
+	ExtraReward     *big.Int `json:"-"`
+	FinderBonus     int64    `json:"-"`
+	// Fees of miners paying other than pool fee, fixed when round is credited as immature, nil until then
+	MinerFees       map[string]float64 `json:"-"`
+	RewardConfirmed bool     `json:"-"`
+	ImmatureReward  string   `json:"-"`
+	RewardString    string   `json:"reward"`
+	RoundHeight     int64    `json:"-"`
+	candidateKey    string
+	immatureKey     string
+}
+
+// Details of block submission recorded with candidate
+type BlockSubmit struct {
+	// Upstream node which served the job and accepted the block
+	Upstream string
+	// Milliseconds between submit and block appearing on the node, 0 until measured by WriteBlockDelay
+	Delay int64
 }
 
 func (b *BlockData) RewardInShannon() int64 {
@@ -64,7 +101,7 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+	return encodeBlock(b)
 }
 
 type Miner struct {
@@ -81,30 +118,56 @@ type Worker struct {
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.Endpoint,
-		Password: cfg.Password,
-		DB:       cfg.Database,
-		PoolSize: cfg.PoolSize,
-	})
-	return &RedisClient{client: client, prefix: prefix}
+	r := &RedisClient{prefix: prefix, timeout: defaultTimeout}
+	if len(cfg.Timeout) > 0 {
+		r.timeout = util.MustParseDuration(cfg.Timeout)
+	}
+	if len(cfg.Sentinel.MasterName) > 0 {
+		r.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.Sentinel.MasterName,
+			SentinelAddrs:    cfg.Sentinel.Addrs,
+			SentinelPassword: cfg.Sentinel.Password,
+			Password:         cfg.Password,
+			DB:               int(cfg.Database),
+			PoolSize:         cfg.PoolSize,
+
+			ContextTimeoutEnabled: true,
+		})
+	} else {
+		r.client = redis.NewClient(&redis.Options{
+			Addr:     cfg.Endpoint,
+			Password: cfg.Password,
+			DB:       int(cfg.Database),
+			PoolSize: cfg.PoolSize,
+
+			ContextTimeoutEnabled: true,
+		})
+	}
+	return r
 }
 
-func (r *RedisClient) Client() *redis.Client {
+func (r *RedisClient) Client() redis.UniversalClient {
 	return r.client
 }
 
-func (r *RedisClient) Check() (string, error) {
-	return r.client.Ping().Result()
+func (r *RedisClient) Check(ctx context.Context) (string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.Ping(ctx).Result()
 }
 
-func (r *RedisClient) BgSave() (string, error) {
-	return r.client.BgSave().Result()
+func (r *RedisClient) BgSave(ctx context.Context) (string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.BgSave(ctx).Result()
 }
 
 // Always returns list of addresses. If Redis fails it will return empty list.
-func (r *RedisClient) GetBlacklist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("blacklist"))
+func (r *RedisClient) GetBlacklist(ctx context.Context) ([]string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.SMembers(ctx, r.formatKey("blacklist"))
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
@@ -112,37 +175,190 @@ func (r *RedisClient) GetBlacklist() ([]string, error) {
 }
 
 // Always returns list of IPs. If Redis fails it will return empty list.
-func (r *RedisClient) GetWhitelist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("whitelist"))
+func (r *RedisClient) GetWhitelist(ctx context.Context) ([]string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.SMembers(ctx, r.formatKey("whitelist"))
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
 	return cmd.Val(), nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) AddToBlacklist(ctx context.Context, address string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.SAdd(ctx, r.formatKey("blacklist"), address).Err()
+}
+
+func (r *RedisClient) RemoveFromBlacklist(ctx context.Context, address string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.SRem(ctx, r.formatKey("blacklist"), address).Err()
+}
+
+func (r *RedisClient) AddToWhitelist(ctx context.Context, ip string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.SAdd(ctx, r.formatKey("whitelist"), ip).Err()
+}
+
+func (r *RedisClient) RemoveFromWhitelist(ctx context.Context, ip string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.SRem(ctx, r.formatKey("whitelist"), ip).Err()
+}
+
+// Bans are stored with expiration time as a score, zero timeout means permanent ban
+func (r *RedisClient) AddBan(ctx context.Context, ip string, timeout int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	score := float64(math.MaxInt64)
+	if timeout > 0 {
+		score = float64(util.MakeTimestamp()/1000 + timeout)
+	}
+	return r.client.ZAdd(ctx, r.formatKey("bans"), redis.Z{Score: score, Member: ip}).Err()
+}
+
+func (r *RedisClient) RemoveBan(ctx context.Context, ip string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.ZRem(ctx, r.formatKey("bans"), ip).Err()
+}
+
+// Returns IPs with active bans and their expiry in seconds, 0 for permanent bans, expired bans are purged
+func (r *RedisClient) GetBans(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	now := util.MakeTimestamp() / 1000
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRemRangeByScore(ctx, r.formatKey("bans"), "-inf", fmt.Sprint("(", now))
+		tx.ZRangeWithScores(ctx, r.formatKey("bans"), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return map[string]int64{}, err
+	}
+	return convertBans(cmds[1].(*redis.ZSliceCmd).Val()), nil
+}
+
+func convertBans(raw []redis.Z) map[string]int64 {
+	bans := make(map[string]int64)
+	for _, v := range raw {
+		expiry := int64(0)
+		if v.Score < float64(math.MaxInt64) {
+			expiry = int64(v.Score)
+		}
+		bans[v.Member.(string)] = expiry
+	}
+	return bans
+}
+
+// Pause flag is checked by module on every run
+func (r *RedisClient) PauseModule(ctx context.Context, name string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.HSet(ctx, r.formatKey("control"), join(name, "paused"), "1").Err()
+}
+
+// Resume clears pause flag and requests module to leave halted state
+func (r *RedisClient) ResumeModule(ctx context.Context, name string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	now := util.MakeTimestamp()
+
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HDel(ctx, r.formatKey("control"), join(name, "paused"), join(name, "halt"), join(name, "haltedAt"))
+		tx.HSet(ctx, r.formatKey("control"), join(name, "resumedAt"), strconv.FormatInt(now, 10))
+		return nil
+	})
+	return err
+}
+
+// Returns pause flag and time of last resume request in milliseconds
+func (r *RedisClient) GetModuleState(ctx context.Context, name string) (bool, int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HExists(ctx, r.formatKey("control"), join(name, "paused"))
+		tx.HGet(ctx, r.formatKey("control"), join(name, "resumedAt"))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, 0, err
+	}
+	paused := cmds[0].(*redis.BoolCmd).Val()
+	resumedAt, _ := cmds[1].(*redis.StringCmd).Int64()
+	return paused, resumedAt, nil
+}
+
+// Halt survives restart of module until resumed by operator
+func (r *RedisClient) HaltModule(ctx context.Context, name, reason string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	now := util.MakeTimestamp() / 1000
+
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HSet(ctx, r.formatKey("control"), join(name, "halt"), reason)
+		tx.HSet(ctx, r.formatKey("control"), join(name, "haltedAt"), strconv.FormatInt(now, 10))
+		return nil
+	})
+	return err
+}
+
+// Returns reason and time of halt in seconds, empty reason if module is not halted
+func (r *RedisClient) GetModuleHalt(ctx context.Context, name string) (string, int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HGet(ctx, r.formatKey("control"), join(name, "halt"))
+		tx.HGet(ctx, r.formatKey("control"), join(name, "haltedAt"))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return "", 0, err
+	}
+	haltedAt, _ := cmds[1].(*redis.StringCmd).Int64()
+	return cmds[0].(*redis.StringCmd).Val(), haltedAt, nil
+}
+
+func (r *RedisClient) WriteNodeState(ctx context.Context, id string, height uint64, diff *big.Int) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
 	now := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
-		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
-		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
-		tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "name"), id)
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "difficulty"), diff.String())
+		tx.HSet(ctx, r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
-	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
+func (r *RedisClient) GetNodeStates(ctx context.Context) ([]map[string]interface{}, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.HGetAll(ctx, r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
+	return convertNodeStates(cmd.Val()), nil
+}
+
+func convertNodeStates(raw map[string]string) []map[string]interface{} {
 	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
+	for key, value := range raw {
 		parts := strings.Split(key, ":")
 		if val, ok := m[parts[0]]; ok {
 			val[parts[1]] = value
@@ -158,18 +374,25 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 		v[i] = value
 		i++
 	}
-	return v, nil
+	return v
 }
 
-func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
-	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
-	return val == 0, err
+func (r *RedisClient) checkPoWExist(ctx context.Context, height uint64, params []string) (bool, error) {
+	var added *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
+		pipe.ZRemRangeByScore(ctx, r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
+		added = pipe.ZAdd(ctx, r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")})
+		return nil
+	})
+	return added.Val() == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
+func (r *RedisClient) WriteShare(ctx context.Context, login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	exist, err := r.checkPoWExist(ctx, height, params)
 	if err != nil {
 		return false, err
 	}
@@ -177,22 +400,24 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
-	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeShare(ctx, tx, ms, ts, login, id, diff, window)
+		tx.HIncrBy(ctx, r.formatKey("stats"), "roundShares", diff)
+		// The first round starts with the first share
+		tx.HSetNX(ctx, r.formatKey("stats"), "roundStart", strconv.FormatInt(ts, 10))
 		return nil
 	})
 	return false, err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
+func (r *RedisClient) WriteBlock(ctx context.Context, login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration, submit *BlockSubmit) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	exist, err := r.checkPoWExist(ctx, height, params)
 	if err != nil {
 		return false, err
 	}
@@ -200,51 +425,116 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeShare(ctx, tx, ms, ts, login, id, diff, window)
+		tx.HSet(ctx, r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+		tx.HSet(ctx, r.formatKey("stats"), "roundStart", strconv.FormatInt(ts, 10))
+		tx.HDel(ctx, r.formatKey("stats"), "roundShares")
+		tx.ZIncrBy(ctx, r.formatKey("finders"), 1, login)
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "blocksFound", 1)
+		tx.Rename(ctx, r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
+		tx.HGetAll(ctx, r.formatRound(int64(height), params[0]))
 		return nil
 	})
 	if err != nil {
 		return false, err
 	} else {
-		sharesMap, _ := cmds[len(cmds) - 1].(*redis.StringStringMapCmd).Result()
+		sharesMap, _ := cmds[len(cmds) - 1].(*redis.MapStringStringCmd).Result()
 		totalShares := int64(0)
 		for _, v := range sharesMap {
 			n, _ := strconv.ParseInt(v, 10, 64)
 			totalShares += n
 		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+		s := encodeCandidate(login, id, params, ts, roundDiff, totalShares, submit)
+		cmd := r.client.ZAdd(ctx, r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
 		return false, cmd.Err()
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "total"), login + "." + id, diff)
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+// Delay is measured after candidate is written, candidate which is already unlocked is left as is
+func (r *RedisClient) WriteBlockDelay(ctx context.Context, height uint64, nonce string, delay int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	key := r.formatKey("blocks", "candidates")
+	score := strconv.FormatUint(height, 10)
+	return r.watch(ctx, func(wtx *redis.Tx) error {
+		members, err := wtx.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			rec := parseCandidate(member)
+			if !isRecord(member) || rec.Nonce != nonce {
+				continue
+			}
+			rec.Delay = delay
+			_, err = wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+				tx.ZRem(ctx, key, member)
+				tx.ZAdd(ctx, key, redis.Z{Score: float64(height), Member: encodeRecord(rec)})
+				return nil
+			})
+			return err
+		}
+		return nil
+	}, key)
+}
+
+func (r *RedisClient) writeShare(ctx context.Context, tx redis.Pipeliner, ms, ts int64, login, id string, diff int64, expire time.Duration) {
+	tx.HIncrBy(ctx, r.formatKey("shares", "total"), login + "." + id, diff)
+	tx.HIncrBy(ctx, r.formatKey("shares", "roundCurrent"), login, diff)
+	tx.ZAdd(ctx, r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
+	tx.ZAdd(ctx, r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
+	tx.Expire(ctx, r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
+	tx.HSet(ctx, r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
 	return join(r.prefix, join(args...))
 }
 
+// Runs optimistic transaction, fn is repeated if watched keys were changed before EXEC
+func (r *RedisClient) watch(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxWatchRetries; i++ {
+		err := r.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("Transaction on %v failed after %v attempts due to concurrent changes", keys, maxWatchRetries)
+}
+
+// Bounds call with configured timeout unless caller has set an earlier deadline
+func (r *RedisClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.timeout)
+}
+
+// Iterates over keys matching pattern.
+// Scan may take long on large databases, so timeout is applied to every batch instead of the whole call.
+func (r *RedisClient) scan(ctx context.Context, match string, fn func(ctx context.Context, keys []string) error) error {
+	var c uint64
+	for {
+		batchCtx, cancel := r.withTimeout(ctx)
+		keys, next, err := r.client.Scan(batchCtx, c, match, 100).Result()
+		if err == nil {
+			err = fn(batchCtx, keys)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		if c = next; c == 0 {
+			return nil
+		}
+	}
+}
+
 func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
@@ -281,27 +571,60 @@ func join(args ...interface{}) string {
 	return strings.Join(s, ":")
 }
 
-func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
-	option := redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
-	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "candidates"), option)
+func (r *RedisClient) GetCandidates(ctx context.Context, maxHeight int64) ([]*BlockData, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	option := &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
+	cmd := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("blocks", "candidates"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertCandidateResults(cmd.Val()), nil
+}
+
+func (r *RedisClient) GetImmatureBlocks(ctx context.Context, maxHeight int64) ([]*BlockData, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	option := &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
+	cmd := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("blocks", "immature"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBlockResults(cmd.Val()), nil
+}
+
+func (r *RedisClient) GetMaturedBlocks(ctx context.Context, maxBlocks int64) ([]*BlockData, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, maxBlocks-1)
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertCandidateResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
 }
 
-func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
-	option := redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
-	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "immature"), option)
+// Matured and orphaned blocks included at height
+func (r *RedisClient) GetMaturedBlocksAt(ctx context.Context, height int64) ([]*BlockData, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	h := strconv.FormatInt(height, 10)
+	cmd := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("blocks", "matured"), &redis.ZRangeBy{Min: h, Max: h})
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertBlockResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
 }
 
-func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+func (r *RedisClient) GetRoundShares(ctx context.Context, height int64, nonce string) (map[string]int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	result := make(map[string]int64)
-	cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
+	cmd := r.client.HGetAll(ctx, r.formatRound(height, nonce))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
@@ -313,25 +636,19 @@ func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int
 	return result, nil
 }
 
-func (r *RedisClient) GetPayees() ([]string, error) {
+func (r *RedisClient) GetPayees(ctx context.Context) ([]string, error) {
 	payees := make(map[string]struct{})
 	var result []string
-	var c int64
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
-		if err != nil {
-			return nil, err
-		}
+	err := r.scan(ctx, r.formatKey("miners", "*"), func(ctx context.Context, keys []string) error {
 		for _, row := range keys {
 			login := strings.Split(row, ":")[2]
 			payees[login] = struct{}{}
 		}
-		if c == 0 {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	for login, _ := range payees {
 		result = append(result, login)
@@ -339,8 +656,11 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	return result, nil
 }
 
-func (r *RedisClient) GetBalance(login string) (int64, error) {
-	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
+func (r *RedisClient) GetBalance(ctx context.Context, login string) (int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.HGet(ctx, r.formatKey("miners", login), "balance")
 	if cmd.Err() == redis.Nil {
 		return 0, nil
 	} else if cmd.Err() != nil {
@@ -349,23 +669,32 @@ func (r *RedisClient) GetBalance(login string) (int64, error) {
 	return cmd.Int64()
 }
 
-func (r *RedisClient) LockPayouts(login string, amount int64) error {
+func (r *RedisClient) LockPayouts(ctx context.Context, login string, amount int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	key := r.formatKey("payments", "lock")
-	result := r.client.SetNX(key, join(login, amount), 0).Val()
+	result := r.client.SetNX(ctx, key, join(login, amount), 0).Val()
 	if !result {
 		return fmt.Errorf("Unable to acquire lock '%s'", key)
 	}
 	return nil
 }
 
-func (r *RedisClient) UnlockPayouts() error {
+func (r *RedisClient) UnlockPayouts(ctx context.Context) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	key := r.formatKey("payments", "lock")
-	_, err := r.client.Del(key).Result()
+	_, err := r.client.Del(ctx, key).Result()
 	return err
 }
 
-func (r *RedisClient) IsPayoutsLocked() (bool, error) {
-	_, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+func (r *RedisClient) IsPayoutsLocked(ctx context.Context) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.client.Get(ctx, r.formatKey("payments", "lock")).Result()
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -381,10 +710,17 @@ type PendingPayment struct {
 	Address   string `json:"login"`
 }
 
-func (r *RedisClient) GetPendingPayments() []*PendingPayment {
-	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
+func (r *RedisClient) GetPendingPayments(ctx context.Context) []*PendingPayment {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	raw := r.client.ZRevRangeWithScores(ctx, r.formatKey("payments", "pending"), 0, -1)
+	return convertPendingPayments(raw.Val())
+}
+
+func convertPendingPayments(raw []redis.Z) []*PendingPayment {
 	var result []*PendingPayment
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		// timestamp -> "address:amount"
 		payment := PendingPayment{}
 		payment.Timestamp = int64(v.Score)
@@ -397,197 +733,249 @@ func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 }
 
 // Deduct miner's balance for payment
-func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) UpdateBalance(ctx context.Context, login string, amount int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "balance", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "pending", amount)
+		tx.HIncrBy(ctx, r.formatKey("finances"), "balance", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("finances"), "pending", amount)
+		tx.ZAdd(ctx, r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+		r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "debit", Amount: amount})
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) RollbackBalance(ctx context.Context, login string, amount int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "balance", amount)
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("finances"), "balance", amount)
+		tx.HIncrBy(ctx, r.formatKey("finances"), "pending", (amount * -1))
+		tx.ZRem(ctx, r.formatKey("payments", "pending"), join(login, amount))
+		r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "rollback", Amount: amount})
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) WritePayment(ctx context.Context, login, txHash string, amount int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
-		tx.Del(r.formatKey("payments", "lock"))
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("miners", login), "paid", amount)
+		tx.HIncrBy(ctx, r.formatKey("finances"), "pending", (amount * -1))
+		tx.HIncrBy(ctx, r.formatKey("finances"), "paid", amount)
+		tx.ZAdd(ctx, r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: encodePayment(txHash, login, amount)})
+		tx.ZAdd(ctx, r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: encodePayment(txHash, "", amount)})
+		tx.ZRem(ctx, r.formatKey("payments", "pending"), join(login, amount))
+		tx.Del(ctx, r.formatKey("payments", "lock"))
+		r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "payment", Amount: amount, Tx: txHash})
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+// Debit would drive miner's balance negative
+var ErrInsufficientBalance = errors.New("Debit exceeds miner's balance")
 
-	_, err := tx.Exec(func() error {
-		r.writeImmatureBlock(tx, block)
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
-			tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+// Manual credit or debit of miner's balance, debit is rejected if balance doesn't cover it
+func (r *RedisClient) AdjustBalance(ctx context.Context, login string, amount int64, reason string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	ts := util.MakeTimestamp() / 1000
+	key := r.formatKey("miners", login)
+
+	return r.watch(ctx, func(wtx *redis.Tx) error {
+		balance, err := wtx.HGet(ctx, key, "balance").Int64()
+		if err != nil && err != redis.Nil {
+			return err
 		}
-		tx.HIncrBy(r.formatKey("finances"), "immature", total)
-		return nil
-	})
-	return err
+		if balance+amount < 0 {
+			return ErrInsufficientBalance
+		}
+		_, err = wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			tx.HIncrBy(ctx, key, "balance", amount)
+			tx.HIncrBy(ctx, r.formatKey("finances"), "balance", amount)
+			r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "adjust", Amount: amount, Reason: reason})
+			return nil
+		})
+		return err
+	}, key)
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
-	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
-	if err != nil {
-		return err
-	}
-	defer tx.Close()
+func (r *RedisClient) WriteImmatureBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
 	ts := util.MakeTimestamp() / 1000
-	value := join(block.Hash, ts, block.Reward)
+	round := join(block.Height, block.Hash)
 
-	_, err = tx.Exec(func() error {
-		r.writeMaturedBlock(tx, block)
-		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
-
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
-		}
-
-		// Increment balances
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeImmatureBlock(ctx, tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
 			total += amount
-			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		}
-		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "balance", total)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
-		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
-		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
-		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
+			tx.HIncrBy(ctx, r.formatKey("miners", login), "immature", amount)
+			tx.HSetNX(ctx, r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "immature", Amount: amount, Round: round})
+		}
+		tx.HIncrBy(ctx, r.formatKey("finances"), "immature", total)
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WriteOrphan(block *BlockData) error {
+func (r *RedisClient) WriteMaturedBlock(ctx context.Context, block *BlockData, roundRewards map[string]int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
-	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
-	if err != nil {
+	ts := util.MakeTimestamp() / 1000
+	value := encodeCredit(block, ts)
+	round := join(block.RoundHeight, block.Hash)
+
+	return r.watch(ctx, func(wtx *redis.Tx) error {
+		// Must decrement immatures using existing log entry
+		immatureCredits := wtx.HGetAll(ctx, creditKey)
+		if err := immatureCredits.Err(); err != nil {
+			return err
+		}
+		_, err := wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			r.writeMaturedBlock(ctx, tx, block)
+			tx.ZAdd(ctx, r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
+
+			// Decrement immature balances
+			totalImmature := int64(0)
+			for login, amountString := range immatureCredits.Val() {
+				amount, _ := strconv.ParseInt(amountString, 10, 64)
+				totalImmature += amount
+				tx.HIncrBy(ctx, r.formatKey("miners", login), "immature", (amount * -1))
+			}
+
+			// Increment balances
+			total := int64(0)
+			for login, amount := range roundRewards {
+				total += amount
+				tx.HIncrBy(ctx, r.formatKey("miners", login), "balance", amount)
+				r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "credit", Amount: amount, Round: round})
+			}
+			tx.Del(ctx, creditKey)
+			tx.HIncrBy(ctx, r.formatKey("finances"), "balance", total)
+			tx.HIncrBy(ctx, r.formatKey("finances"), "immature", (totalImmature * -1))
+			tx.HSet(ctx, r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+			tx.HSet(ctx, r.formatKey("finances"), "lastCreditHash", block.Hash)
+			tx.HIncrBy(ctx, r.formatKey("finances"), "totalMined", block.RewardInShannon())
+			return nil
+		})
 		return err
-	}
-	defer tx.Close()
+	}, creditKey)
+}
+
+func (r *RedisClient) WriteOrphan(ctx context.Context, block *BlockData) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
-	_, err = tx.Exec(func() error {
-		r.writeMaturedBlock(tx, block)
+	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	ts := util.MakeTimestamp() / 1000
+	round := join(block.RoundHeight, block.Hash)
 
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+	return r.watch(ctx, func(wtx *redis.Tx) error {
+		// Must decrement immatures using existing log entry
+		immatureCredits := wtx.HGetAll(ctx, creditKey)
+		if err := immatureCredits.Err(); err != nil {
+			return err
 		}
-		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
-		return nil
-	})
-	return err
+		_, err := wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			r.writeMaturedBlock(ctx, tx, block)
+
+			// Decrement immature balances
+			totalImmature := int64(0)
+			for login, amountString := range immatureCredits.Val() {
+				amount, _ := strconv.ParseInt(amountString, 10, 64)
+				totalImmature += amount
+				tx.HIncrBy(ctx, r.formatKey("miners", login), "immature", (amount * -1))
+				r.writeLedgerEntry(ctx, tx, login, &LedgerEntry{Timestamp: ts, Kind: "orphan", Amount: amount, Round: round})
+			}
+			tx.Del(ctx, creditKey)
+			tx.HIncrBy(ctx, r.formatKey("finances"), "immature", (totalImmature * -1))
+			return nil
+		})
+		return err
+	}, creditKey)
 }
 
-func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) WritePendingOrphans(ctx context.Context, blocks []*BlockData) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
-	_, err := tx.Exec(func() error {
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
 		for _, block := range blocks {
-			r.writeImmatureBlock(tx, block)
+			r.writeImmatureBlock(ctx, tx, block)
 		}
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
+func (r *RedisClient) writeImmatureBlock(ctx context.Context, tx redis.Pipeliner, block *BlockData) {
 	// Redis 2.8.x returns "ERR source and destination objects are the same"
 	if block.Height != block.RoundHeight {
-		tx.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
+		tx.Rename(ctx, r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
 	}
-	tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
-	tx.ZAdd(r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
+	tx.ZRem(ctx, r.formatKey("blocks", "candidates"), block.candidateKey)
+	tx.ZAdd(ctx, r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
-func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
-	tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
-	tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
-	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
+func (r *RedisClient) writeMaturedBlock(ctx context.Context, tx redis.Pipeliner, block *BlockData) {
+	tx.Del(ctx, r.formatRound(block.RoundHeight, block.Nonce))
+	tx.ZRem(ctx, r.formatKey("blocks", "immature"), block.immatureKey)
+	tx.ZAdd(ctx, r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
-func (r *RedisClient) IsMinerExists(login string) (bool, error) {
-	return r.client.Exists(r.formatKey("miners", login)).Result()
+func (r *RedisClient) IsMinerExists(ctx context.Context, login string) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	n, err := r.client.Exists(ctx, r.formatKey("miners", login)).Result()
+	return n > 0, err
 }
 
-func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+func (r *RedisClient) GetMinerStats(ctx context.Context, login string, maxPayments int64) (map[string]interface{}, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
-	tx := r.client.Multi()
-	defer tx.Close()
+	stats := make(map[string]interface{})
 
-	cmds, err := tx.Exec(func() error {
-		tx.HGetAllMap(r.formatKey("miners", login))
-		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
-		tx.ZCard(r.formatKey("payments", login))
-		tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.HGetAll(ctx, r.formatKey("miners", login))
+		tx.ZRevRangeWithScores(ctx, r.formatKey("payments", login), 0, maxPayments-1)
+		tx.ZCard(ctx, r.formatKey("payments", login))
+		tx.HGet(ctx, r.formatKey("shares", "roundCurrent"), login)
 		return nil
 	})
 
 	if err != nil && err != redis.Nil {
 		return nil, err
 	} else {
-		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+		result, _ := cmds[0].(*redis.MapStringStringCmd).Result()
 		stats["stats"] = convertStringMap(result)
-		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
+		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd).Val())
 		stats["payments"] = payments
 		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
 		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
@@ -611,64 +999,62 @@ func convertStringMap(m map[string]string) map[string]interface{} {
 }
 
 // WARNING: Must run it periodically to flush out of window hashrate entries
-func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
+func (r *RedisClient) FlushStaleStats(ctx context.Context, window, largeWindow time.Duration) (int64, error) {
 	now := util.MakeTimestamp() / 1000
 	max := fmt.Sprint("(", now-int64(window/time.Second))
-	total, err := r.client.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", max).Result()
+	flushCtx, cancel := r.withTimeout(ctx)
+	total, err := r.client.ZRemRangeByScore(flushCtx, r.formatKey("hashrate"), "-inf", max).Result()
+	cancel()
 	if err != nil {
 		return total, err
 	}
 
-	var c int64
 	miners := make(map[string]struct{})
 	max = fmt.Sprint("(", now-int64(largeWindow/time.Second))
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
-		if err != nil {
-			return total, err
-		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			if _, ok := miners[login]; !ok {
-				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
-				if err != nil {
-					return total, err
+	err = r.scan(ctx, r.formatKey("hashrate", "*"), func(ctx context.Context, keys []string) error {
+		cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, row := range keys {
+				login := strings.Split(row, ":")[2]
+				if _, ok := miners[login]; !ok {
+					pipe.ZRemRangeByScore(ctx, r.formatKey("hashrate", login), "-inf", max)
+					miners[login] = struct{}{}
 				}
-				miners[login] = struct{}{}
-				total += n
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		if c == 0 {
-			break
+		for _, cmd := range cmds {
+			total += cmd.(*redis.IntCmd).Val()
 		}
-	}
-	return total, nil
+		return nil
+	})
+	return total, err
 }
 
-func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+func (r *RedisClient) CollectStats(ctx context.Context, smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	now := util.MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-		tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
-		tx.HGetAllMap(r.formatKey("stats"))
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, maxBlocks-1)
-		tx.ZCard(r.formatKey("blocks", "candidates"))
-		tx.ZCard(r.formatKey("blocks", "immature"))
-		tx.ZCard(r.formatKey("blocks", "matured"))
-		tx.ZCard(r.formatKey("payments", "all"))
-		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRemRangeByScore(ctx, r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
+		tx.ZRangeWithScores(ctx, r.formatKey("hashrate"), 0, -1)
+		tx.HGetAll(ctx, r.formatKey("stats"))
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "candidates"), 0, -1)
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "immature"), 0, -1)
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, maxBlocks-1)
+		tx.ZCard(ctx, r.formatKey("blocks", "candidates"))
+		tx.ZCard(ctx, r.formatKey("blocks", "immature"))
+		tx.ZCard(ctx, r.formatKey("blocks", "matured"))
+		tx.ZCard(ctx, r.formatKey("payments", "all"))
+		tx.ZRevRangeWithScores(ctx, r.formatKey("payments", "all"), 0, maxPayments-1)
 		return nil
 	})
 
@@ -676,44 +1062,43 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		return nil, err
 	}
 
-	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	result, _ := cmds[2].(*redis.MapStringStringCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd).Val())
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd).Val())
 	stats["immature"] = immature
 	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd).Val())
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd).Val())
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd).Val())
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
 	return stats, nil
 }
 
-func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string, showTotalHashes bool) (map[string]interface{}, error) {
+func (r *RedisClient) CollectWorkersStats(ctx context.Context, sWindow, lWindow time.Duration, login string, showTotalHashes bool) (map[string]interface{}, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	smallWindow := int64(sWindow / time.Second)
 	largeWindow := int64(lWindow / time.Second)
-	stats := make(map[string]interface{})
-
-	tx := r.client.Multi()
-	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+	cmds, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRemRangeByScore(ctx, r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
+		tx.ZRangeWithScores(ctx, r.formatKey("hashrate", login), 0, -1)
 		return nil
 	})
 
@@ -721,11 +1106,23 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		return nil, err
 	}
 
+	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd).Val())
+	stats := summarizeWorkersStats(now, smallWindow, largeWindow, workers, func(id string) int64 {
+		if !showTotalHashes {
+			return 0
+		}
+		n, _ := r.client.HGet(ctx, r.formatKey("shares", "total"), login+"."+id).Int64()
+		return n
+	})
+	return stats, nil
+}
+
+func summarizeWorkersStats(now, smallWindow, largeWindow int64, workers map[string]Worker, totalHashes func(id string) int64) map[string]interface{} {
+	stats := make(map[string]interface{})
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -755,16 +1152,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
 
-		worker.TotalHashes = 0
-		if showTotalHashes {
-			cmds, err := tx.Exec(func() error {
-				tx.HGet(r.formatKey("shares", "total"), login + "." + id)
-				return nil
-			})
-			if err == nil || err == redis.Nil {
-				worker.TotalHashes, _ = cmds[0].(*redis.StringCmd).Int64()
-			}
-		}
+		worker.TotalHashes = totalHashes(id)
 		workers[id] = worker
 	}
 	stats["workers"] = workers
@@ -773,26 +1161,31 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
-	return stats, nil
+	return stats
 }
 
-func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+func (r *RedisClient) CollectLuckStats(ctx context.Context, windows []int) (map[string]interface{}, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
-	tx := r.client.Multi()
-	defer tx.Close()
+	stats := make(map[string]interface{})
 
 	max := int64(windows[len(windows)-1])
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, max-1)
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "immature"), 0, -1)
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, max-1)
 		return nil
 	})
 	if err != nil {
 		return stats, err
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+	return convertLuckStats(windows, blocks), nil
+}
+
+func convertLuckStats(windows []int, blocks []*BlockData) map[string]interface{} {
+	stats := make(map[string]interface{})
 
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
@@ -827,75 +1220,545 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 			break
 		}
 	}
-	return stats, nil
+	return stats
 }
 
-func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
-	var result []*BlockData
-	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
-		block := BlockData{}
-		block.Height = int64(v.Score)
-		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.Nonce = fields[0]
-		block.PowHash = fields[1]
-		block.MixDigest = fields[2]
-		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
-		block.candidateKey = v.Member.(string)
-		result = append(result, &block)
+// Matured blocks older than this many are left out of block stats
+const blockStatsLimit = 10000
+
+func (r *RedisClient) CollectBlockStats(ctx context.Context, days int) (*BlockStats, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "immature"), 0, -1)
+		tx.ZRevRangeWithScores(ctx, r.formatKey("blocks", "matured"), 0, blockStatsLimit-1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return result
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+	return convertBlockStats(days, util.MakeTimestamp()/1000, blocks), nil
 }
 
-func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
-	var result []*BlockData
-	for _, row := range rows {
-		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
-			block := BlockData{}
-			block.Height = int64(v.Score)
-			block.RoundHeight = block.Height
-			fields := strings.Split(v.Member.(string), ":")
-			block.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
-			block.Uncle = block.UncleHeight > 0
-			block.Orphan, _ = strconv.ParseBool(fields[1])
-			block.Nonce = fields[2]
-			block.Hash = fields[3]
-			block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-			block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
-			block.RewardString = fields[7]
-			block.ImmatureReward = fields[7]
-			block.immatureKey = v.Member.(string)
-			result = append(result, &block)
-		}
-	}
-	return result
+// Orphan and uncle rates of blocks found by the pool, in total and by upstream which served the job
+type BlockRateStats struct {
+	Blocks     int64   `json:"blocks"`
+	Uncles     int64   `json:"uncles"`
+	Orphans    int64   `json:"orphans"`
+	UncleRate  float64 `json:"uncleRate"`
+	OrphanRate float64 `json:"orphanRate"`
+	// Average delay between submit and block appearing on the node in milliseconds, blocks with unknown delay are skipped
+	Delay      int64 `json:"delay"`
+	delaySum   int64
+	delayCount int64
 }
 
-// Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
-// TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
-	now := util.MakeTimestamp() / 1000
-	workers := make(map[string]Worker)
+type BlockDayStats struct {
+	// Start of UTC day in seconds
+	Day int64 `json:"day"`
+	BlockRateStats
+	Upstreams map[string]*BlockRateStats `json:"upstreams"`
+}
 
-	for _, v := range raw.Val() {
-		parts := strings.Split(v.Member.(string), ":")
-		share, _ := strconv.ParseInt(parts[0], 10, 64)
-		id := parts[1]
-		score := int64(v.Score)
-		worker := workers[id]
+type BlockStats struct {
+	// Oldest day first, days without blocks are included
+	Days      []*BlockDayStats           `json:"days"`
+	Upstreams map[string]*BlockRateStats `json:"upstreams"`
+}
 
-		// Add for large window
-		worker.TotalHR += share
+func (s *BlockRateStats) add(block *BlockData) {
+	s.Blocks++
+	if block.Uncle {
+		s.Uncles++
+	}
+	if block.Orphan {
+		s.Orphans++
+	}
+	if block.Delay > 0 {
+		s.delaySum += block.Delay
+		s.delayCount++
+	}
+}
 
-		// Add for small window if matches
-		if score >= now-window {
-			worker.HR += share
-		}
+func (s *BlockRateStats) finish() {
+	if s.Blocks > 0 {
+		s.UncleRate = float64(s.Uncles) / float64(s.Blocks)
+		s.OrphanRate = float64(s.Orphans) / float64(s.Blocks)
+	}
+	if s.delayCount > 0 {
+		s.Delay = s.delaySum / s.delayCount
+	}
+}
+
+func addUpstreamStats(upstreams map[string]*BlockRateStats, block *BlockData) {
+	// Blocks found before upstreams were recorded
+	name := block.Upstream
+	if len(name) == 0 {
+		name = "unknown"
+	}
+	if upstreams[name] == nil {
+		upstreams[name] = &BlockRateStats{}
+	}
+	upstreams[name].add(block)
+}
+
+func convertBlockStats(days int, now int64, blocks []*BlockData) *BlockStats {
+	const day = 86400
+	first := now - now%day - int64(days-1)*day
+	stats := &BlockStats{Upstreams: make(map[string]*BlockRateStats)}
+	for i := 0; i < days; i++ {
+		stats.Days = append(stats.Days, &BlockDayStats{Day: first + int64(i)*day, Upstreams: make(map[string]*BlockRateStats)})
+	}
+	for _, block := range blocks {
+		if block.Timestamp < first || block.Timestamp >= first+int64(days)*day {
+			continue
+		}
+		d := stats.Days[(block.Timestamp-first)/day]
+		d.add(block)
+		addUpstreamStats(d.Upstreams, block)
+		addUpstreamStats(stats.Upstreams, block)
+	}
+	for _, d := range stats.Days {
+		d.finish()
+		for _, s := range d.Upstreams {
+			s.finish()
+		}
+	}
+	for _, s := range stats.Upstreams {
+		s.finish()
+	}
+	return stats
+}
+
+// Hashrate of pool or miner at the time of snapshot, hourly and daily points average snapshots of their bucket
+type ChartPoint struct {
+	Timestamp int64 `json:"ts"`
+	Hashrate  int64 `json:"hashrate"`
+	// Shares submitted since previous snapshot, summed up in hourly and daily points
+	Shares        int64 `json:"shares"`
+	WorkersOnline int64 `json:"workersOnline"`
+	// Pool points only
+	Miners int64 `json:"miners,omitempty"`
+	// Miner points only
+	Workers map[string]*WorkerPoint `json:"workers,omitempty"`
+}
+
+type WorkerPoint struct {
+	Hashrate int64 `json:"hashrate"`
+	Shares   int64 `json:"shares"`
+}
+
+// Chart points of one resolution, step of 0 means raw snapshots
+type chartSeries struct {
+	name   string
+	step   int64
+	period int64
+}
+
+// Points are kept one day longer than their period so that the next series can be compacted from them
+func (s *chartSeries) keep() int64 {
+	return s.period + 86400
+}
+
+// Raw snapshots cover last day, hourly points a week and daily points a month
+var chartSeriesList = []*chartSeries{
+	{name: "raw", step: 0, period: 86400},
+	{name: "hourly", step: 3600, period: 7 * 86400},
+	{name: "daily", step: 86400, period: 30 * 86400},
+}
+
+// The finest series which covers period
+func chartSeriesFor(period time.Duration) *chartSeries {
+	for _, s := range chartSeriesList {
+		if int64(period/time.Second) <= s.period {
+			return s
+		}
+	}
+	return chartSeriesList[len(chartSeriesList)-1]
+}
+
+// Pool's series are kept in charts:<series>, miner's in charts:<series>:<login>
+func chartKey(series, login string) string {
+	if len(login) == 0 {
+		return join("charts", series)
+	}
+	return join("charts", series, login)
+}
+
+// Buckets of target series not compacted yet and still kept in source series, end is exclusive
+func compactRange(last, now int64, from, to *chartSeries) (int64, int64) {
+	end := now - now%to.step
+	start := last
+	if oldest := now - from.keep(); start < oldest {
+		start = oldest - oldest%to.step + to.step
+	}
+	return start, end
+}
+
+// Hashrate of pool, miners and their workers over the window, the same way as in miners and workers stats.
+// Shares are counted since previous snapshot.
+func convertHashrateSnapshot(now, window, interval int64, raw []redis.Z) (*ChartPoint, map[string]*ChartPoint) {
+	ts := now - now%interval
+	pool := &ChartPoint{Timestamp: ts}
+	miners := make(map[string]*ChartPoint)
+	startedAt := make(map[string]int64)
+	started := func(key string, score int64) {
+		if s, ok := startedAt[key]; !ok || score < s {
+			startedAt[key] = score
+		}
+	}
+
+	for _, v := range raw {
+		parts := strings.Split(v.Member.(string), ":")
+		share, _ := strconv.ParseInt(parts[0], 10, 64)
+		login, id := parts[1], parts[2]
+		score := int64(v.Score)
+		miner := miners[login]
+		if miner == nil {
+			miner = &ChartPoint{Timestamp: ts, Workers: make(map[string]*WorkerPoint)}
+			miners[login] = miner
+		}
+		worker := miner.Workers[id]
+		if worker == nil {
+			worker = &WorkerPoint{}
+			miner.Workers[id] = worker
+		}
+		miner.Hashrate += share
+		worker.Hashrate += share
+		if score > now-interval {
+			miner.Shares++
+			worker.Shares++
+		}
+		started(login, score)
+		started(join(login, id), score)
+	}
+
+	for login, miner := range miners {
+		miner.Hashrate /= hashrateBoundary(now, startedAt[login], window)
+		for id, worker := range miner.Workers {
+			worker.Hashrate /= hashrateBoundary(now, startedAt[join(login, id)], window)
+		}
+		miner.WorkersOnline = int64(len(miner.Workers))
+		pool.Hashrate += miner.Hashrate
+		pool.Shares += miner.Shares
+		pool.WorkersOnline += miner.WorkersOnline
+	}
+	pool.Miners = int64(len(miners))
+	return pool, miners
+}
+
+// Seconds of window the hashes are averaged over, not less than 10 minutes for miners just started
+func hashrateBoundary(now, startedAt, window int64) int64 {
+	timeOnline := now - startedAt
+	if timeOnline < 600 {
+		timeOnline = 600
+	}
+	if timeOnline >= window {
+		return window
+	}
+	return timeOnline
+}
+
+// Groups points sorted by time into buckets of step seconds, hashrate is averaged and shares are summed
+func downsampleChart(step int64, points []*ChartPoint) []*ChartPoint {
+	var result []*ChartPoint
+	var bucket []*ChartPoint
+	for i, p := range points {
+		bucket = append(bucket, p)
+		ts := p.Timestamp - p.Timestamp%step
+		if i+1 < len(points) && points[i+1].Timestamp-points[i+1].Timestamp%step == ts {
+			continue
+		}
+		result = append(result, averageChart(ts, bucket))
+		bucket = nil
+	}
+	return result
+}
+
+func averageChart(ts int64, points []*ChartPoint) *ChartPoint {
+	result := &ChartPoint{Timestamp: ts}
+	n := int64(len(points))
+	for _, p := range points {
+		result.Hashrate += p.Hashrate
+		result.Shares += p.Shares
+		result.WorkersOnline += p.WorkersOnline
+		result.Miners += p.Miners
+		for id, w := range p.Workers {
+			if result.Workers == nil {
+				result.Workers = make(map[string]*WorkerPoint)
+			}
+			if result.Workers[id] == nil {
+				result.Workers[id] = &WorkerPoint{}
+			}
+			result.Workers[id].Hashrate += w.Hashrate
+			result.Workers[id].Shares += w.Shares
+		}
+	}
+	// Worker missing from a snapshot was offline, so it counts as zero hashrate
+	result.Hashrate /= n
+	result.WorkersOnline /= n
+	result.Miners /= n
+	for _, w := range result.Workers {
+		w.Hashrate /= n
+	}
+	return result
+}
+
+func convertChartPoints(raw []string) []*ChartPoint {
+	result := make([]*ChartPoint, 0, len(raw))
+	for _, v := range raw {
+		result = append(result, parseChartPoint(v))
+	}
+	return result
+}
+
+// Writes snapshot of hashrate of pool, miners and workers, then downsamples completed hours and days.
+// Snapshots are aligned to interval, so it's false if another API instance already wrote this one.
+func (r *RedisClient) WriteHashrateSnapshot(ctx context.Context, window, interval time.Duration) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	now := util.MakeTimestamp() / 1000
+	step := int64(interval / time.Second)
+	ts := now - now%step
+	exist, err := r.client.ZCount(ctx, r.formatKey(chartKey("raw", "")), strconv.FormatInt(ts, 10), "+inf").Result()
+	if err != nil || exist > 0 {
+		return false, err
+	}
+	min := strconv.FormatInt(now-int64(window/time.Second), 10)
+	raw, err := r.client.ZRangeByScoreWithScores(ctx, r.formatKey("hashrate"), &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return false, err
+	}
+	pool, miners := convertHashrateSnapshot(now, int64(window/time.Second), step, raw)
+
+	series := chartSeriesList[0]
+	oldest := chartSeriesList[len(chartSeriesList)-1]
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		r.writeChartPoint(ctx, tx, series, "", pool)
+		for login, miner := range miners {
+			r.writeChartPoint(ctx, tx, series, login, miner)
+			tx.ZAdd(ctx, r.formatKey("charts", "miners"), redis.Z{Score: float64(ts), Member: login})
+		}
+		tx.ZRemRangeByScore(ctx, r.formatKey("charts", "miners"), "-inf", fmt.Sprint("(", ts-oldest.keep()))
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for i := 1; i < len(chartSeriesList); i++ {
+		err = r.compactChart(ctx, chartSeriesList[i-1], chartSeriesList[i], now)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Point replaces one of the same timestamp, so that compaction is safe to repeat
+func (r *RedisClient) writeChartPoint(ctx context.Context, tx redis.Pipeliner, s *chartSeries, login string, p *ChartPoint) {
+	key := r.formatKey(chartKey(s.name, login))
+	ts := strconv.FormatInt(p.Timestamp, 10)
+	tx.ZRemRangeByScore(ctx, key, ts, ts)
+	tx.ZAdd(ctx, key, redis.Z{Score: float64(p.Timestamp), Member: encodeChartPoint(p)})
+	tx.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint("(", p.Timestamp-s.keep()))
+	tx.Expire(ctx, key, time.Duration(s.keep())*time.Second) // Will delete charts of miners that gone
+}
+
+func (r *RedisClient) compactChart(ctx context.Context, from, to *chartSeries, now int64) error {
+	last, err := r.client.HGet(ctx, r.formatKey("charts", "compacted"), to.name).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	start, end := compactRange(last, now, from, to)
+	if start >= end {
+		return nil
+	}
+	rangeBy := &redis.ZRangeBy{Min: strconv.FormatInt(start, 10), Max: fmt.Sprint("(", end)}
+	logins, err := r.client.ZRangeByScore(ctx, r.formatKey("charts", "miners"), &redis.ZRangeBy{Min: rangeBy.Min, Max: "+inf"}).Result()
+	if err != nil {
+		return err
+	}
+	// Pool's series goes first
+	logins = append([]string{""}, logins...)
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, login := range logins {
+			pipe.ZRangeByScore(ctx, r.formatKey(chartKey(from.name, login)), rangeBy)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		for i, login := range logins {
+			points := convertChartPoints(cmds[i].(*redis.StringSliceCmd).Val())
+			for _, p := range downsampleChart(to.step, points) {
+				r.writeChartPoint(ctx, tx, to, login, p)
+			}
+		}
+		tx.HSet(ctx, r.formatKey("charts", "compacted"), to.name, strconv.FormatInt(end, 10))
+		return nil
+	})
+	return err
+}
+
+// Points of pool or miner's chart over period, oldest first, from the finest series covering it
+func (r *RedisClient) GetHashrateChart(ctx context.Context, login string, period time.Duration) ([]*ChartPoint, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	s := chartSeriesFor(period)
+	min := strconv.FormatInt(util.MakeTimestamp()/1000-int64(period/time.Second), 10)
+	raw, err := r.client.ZRangeByScore(ctx, r.formatKey(chartKey(s.name, login)), &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return convertChartPoints(raw), nil
+}
+
+// Network stats estimated by API from the latest blocks of its daemon
+type NetworkStats struct {
+	Timestamp  int64 `json:"ts"`
+	Height     int64 `json:"height"`
+	Difficulty int64 `json:"difficulty"`
+	Hashrate   int64 `json:"hashrate"`
+	// Average seconds between the latest blocks
+	BlockTime float64 `json:"blockTime"`
+	// Block reward of current era in Wei, without fees and uncle inclusion rewards
+	Reward       string  `json:"reward"`
+	PoolHashrate int64   `json:"poolHashrate"`
+	PoolShare    float64 `json:"poolShare"`
+	// Expected seconds to find a block at pool's hashrate, 0 if pool has no hashrate
+	BlockEta int64 `json:"blockEta"`
+}
+
+// History of network stats keeps the last stats of every 10 minutes for a month
+const (
+	networkHistoryStep = 600
+	networkHistoryKeep = 30 * 86400
+)
+
+func convertNetworkHistory(raw []string) []*NetworkStats {
+	result := make([]*NetworkStats, 0, len(raw))
+	for _, v := range raw {
+		result = append(result, parseNetworkStats(v))
+	}
+	return result
+}
+
+func (r *RedisClient) WriteNetworkStats(ctx context.Context, stats *NetworkStats) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	ts := stats.Timestamp - stats.Timestamp%networkHistoryStep
+	_, err := r.client.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRemRangeByScore(ctx, r.formatKey("network"), strconv.FormatInt(ts, 10), "+inf")
+		tx.ZAdd(ctx, r.formatKey("network"), redis.Z{Score: float64(ts), Member: encodeNetworkStats(stats)})
+		tx.ZRemRangeByScore(ctx, r.formatKey("network"), "-inf", fmt.Sprint("(", ts-networkHistoryKeep))
+		return nil
+	})
+	return err
+}
+
+// Network stats over period, oldest first
+func (r *RedisClient) GetNetworkHistory(ctx context.Context, period time.Duration) ([]*NetworkStats, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	min := strconv.FormatInt(util.MakeTimestamp()/1000-int64(period/time.Second), 10)
+	raw, err := r.client.ZRangeByScore(ctx, r.formatKey("network"), &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return convertNetworkHistory(raw), nil
+}
+
+func convertCandidateResults(raw []redis.Z) []*BlockData {
+	var result []*BlockData
+	for _, v := range raw {
+		r := parseCandidate(v.Member.(string))
+		block := BlockData{}
+		block.Height = int64(v.Score)
+		block.RoundHeight = block.Height
+		block.Nonce = r.Nonce
+		block.Finder = r.Finder
+		block.Worker = r.Worker
+		block.Upstream = r.Upstream
+		block.Delay = r.Delay
+		block.PowHash = r.PowHash
+		block.MixDigest = r.MixDigest
+		block.Timestamp = r.Timestamp
+		block.Difficulty = r.Difficulty
+		block.TotalShares = r.Shares
+		block.Effort = r.effort()
+		block.candidateKey = v.Member.(string)
+		result = append(result, &block)
+	}
+	return result
+}
+
+func convertBlockResults(rows ...[]redis.Z) []*BlockData {
+	var result []*BlockData
+	for _, row := range rows {
+		for _, v := range row {
+			r := parseBlock(v.Member.(string))
+			block := BlockData{}
+			block.Height = int64(v.Score)
+			block.RoundHeight = block.Height
+			block.UncleHeight = r.UncleHeight
+			block.Uncle = block.UncleHeight > 0
+			block.Orphan = r.Orphan
+			block.Nonce = r.Nonce
+			block.Finder = r.Finder
+			block.Worker = r.Worker
+			block.Upstream = r.Upstream
+			block.Delay = r.Delay
+			block.Hash = r.Hash
+			block.Timestamp = r.Timestamp
+			block.Difficulty = r.Difficulty
+			block.TotalShares = r.Shares
+			block.Effort = r.effort()
+			block.RewardString = r.Reward
+			block.ImmatureReward = r.Reward
+			if len(r.ExtraReward) > 0 {
+				block.ExtraReward, _ = new(big.Int).SetString(r.ExtraReward, 10)
+			}
+			if r.FeesFixed {
+				block.MinerFees = r.MinerFees
+				if block.MinerFees == nil {
+					block.MinerFees = make(map[string]float64)
+				}
+			}
+			block.immatureKey = v.Member.(string)
+			result = append(result, &block)
+		}
+	}
+	return result
+}
+
+// Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
+// TS => diff, id, ms
+func convertWorkersStats(window int64, raw []redis.Z) map[string]Worker {
+	now := util.MakeTimestamp() / 1000
+	workers := make(map[string]Worker)
+
+	for _, v := range raw {
+		parts := strings.Split(v.Member.(string), ":")
+		share, _ := strconv.ParseInt(parts[0], 10, 64)
+		id := parts[1]
+		score := int64(v.Score)
+		worker := workers[id]
+
+		// Add for large window
+		worker.TotalHR += share
+
+		// Add for small window if matches
+		if score >= now-window {
+			worker.HR += share
+		}
 
 		if worker.LastBeat < score {
 			worker.LastBeat = score
@@ -908,12 +1771,12 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+func convertMinersStats(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -951,21 +1814,632 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
-func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
+func convertPaymentsResults(raw []redis.Z) []map[string]interface{} {
 	var result []map[string]interface{}
-	for _, v := range raw.Val() {
+	for _, v := range raw {
+		r := parsePayment(v.Member.(string))
 		tx := make(map[string]interface{})
 		tx["timestamp"] = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		tx["tx"] = fields[0]
+		tx["tx"] = r.Tx
+		tx["amount"] = r.Amount
 		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
-			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+		if len(r.Login) > 0 {
+			tx["address"] = r.Login
 		}
 		result = append(result, tx)
 	}
 	return result
 }
+
+type AuditEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Source    string `json:"source"`
+	Action    string `json:"action"`
+	Target    string `json:"target,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// Append-only log of operator's actions, newest first
+func (r *RedisClient) WriteAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if entry.Timestamp == 0 {
+		entry.Timestamp = util.MakeTimestamp() / 1000
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return r.client.LPush(ctx, r.formatKey("audit"), string(data)).Err()
+}
+
+func (r *RedisClient) GetAuditLog(ctx context.Context, offset, limit int64) ([]*AuditEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.LRange(ctx, r.formatKey("audit"), offset, offset+limit-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make([]*AuditEntry, 0, len(cmd.Val()))
+	for _, v := range cmd.Val() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal([]byte(v), entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// Single change of miner's funds, kinds are:
+// "immature" - share of found block credited to immature balance,
+// "orphan" - immature credit dropped because block was orphaned,
+// "credit" - share of matured block credited to balance,
+// "debit" - balance moved to pending on payout,
+// "rollback" - pending amount returned to balance after failed payout,
+// "payment" - pending amount paid out with transaction,
+// "adjust" - manual adjustment of balance, signed.
+type LedgerEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Kind      string `json:"kind"`
+	Amount    int64  `json:"amount"`
+	Round     string `json:"round,omitempty"`
+	Tx        string `json:"tx,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// Id of PostgreSQL journal record the entry was written under
+	Journal   int64  `json:"journal,omitempty"`
+}
+
+type journalKey struct{}
+
+// Ledger entries written with such context are tagged with journal id, so that pending journal records can be reconciled
+func withJournal(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, journalKey{}, id)
+}
+
+func journalID(ctx context.Context) int64 {
+	id, _ := ctx.Value(journalKey{}).(int64)
+	return id
+}
+
+var ledgerReasons = map[string]string{
+	"immature": "Block found",
+	"orphan":   "Block orphaned",
+	"credit":   "Block matured",
+	"debit":    "Payout started",
+	"rollback": "Payout failed",
+	"payment":  "Payout sent",
+}
+
+// Append-only log of miner's balance changes, newest first, written in the same transaction as the change
+func (r *RedisClient) writeLedgerEntry(ctx context.Context, tx redis.Pipeliner, login string, entry *LedgerEntry) {
+	if len(entry.Reason) == 0 {
+		entry.Reason = ledgerReasons[entry.Kind]
+	}
+	entry.Journal = journalID(ctx)
+	data, _ := json.Marshal(entry)
+	tx.LPush(ctx, r.formatKey("ledger", login), string(data))
+}
+
+func (r *RedisClient) GetLedger(ctx context.Context, login string, offset, limit int64) ([]*LedgerEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.LRange(ctx, r.formatKey("ledger", login), offset, offset+limit-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make([]*LedgerEntry, 0, len(cmd.Val()))
+	for _, v := range cmd.Val() {
+		entry := &LedgerEntry{}
+		if err := json.Unmarshal([]byte(v), entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// Pool-wide counters of miners' funds in Shannon
+var fundsFields = []string{"balance", "immature", "pending", "paid"}
+
+func (r *RedisClient) GetFinances(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.HGetAll(ctx, r.formatKey("finances"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make(map[string]int64)
+	for _, field := range append(fundsFields, "totalMined") {
+		result[field], _ = strconv.ParseInt(cmd.Val()[field], 10, 64)
+	}
+	return result, nil
+}
+
+// Scans all miners and sums their funds, returns number of miners scanned
+func (r *RedisClient) SumMinersFunds(ctx context.Context) (int64, map[string]int64, error) {
+	var count int64
+	result := make(map[string]int64)
+	for _, field := range fundsFields {
+		result[field] = 0
+	}
+
+	err := r.scan(ctx, r.formatKey("miners", "*"), func(ctx context.Context, keys []string) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+			for _, key := range keys {
+				tx.HMGet(ctx, key, fundsFields...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			for i, v := range cmd.(*redis.SliceCmd).Val() {
+				if s, ok := v.(string); ok {
+					n, _ := strconv.ParseInt(s, 10, 64)
+					result[fundsFields[i]] += n
+				}
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return count, nil, err
+	}
+	return count, result, nil
+}
+
+// Expected value is derived from miners' funds, actual is the one recorded in finances or held by wallet
+type Discrepancy struct {
+	Field    string `json:"field"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+}
+
+// Result of the last comparison of finances with miners' funds and wallet balance
+type ConsistencyReport struct {
+	Timestamp     int64            `json:"timestamp"`
+	Miners        int64            `json:"miners"`
+	MinersFunds   map[string]int64 `json:"minersFunds"`
+	Finances      map[string]int64 `json:"finances"`
+	WalletBalance *int64           `json:"walletBalance,omitempty"`
+	Discrepancies []*Discrepancy   `json:"discrepancies"`
+}
+
+func (r *RedisClient) WriteConsistencyReport(ctx context.Context, report *ConsistencyReport) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.formatKey("consistency"), string(data), 0).Err()
+}
+
+func (r *RedisClient) GetConsistencyReport(ctx context.Context) (*ConsistencyReport, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.Get(ctx, r.formatKey("consistency"))
+	if cmd.Err() == redis.Nil {
+		return nil, nil
+	} else if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	report := &ConsistencyReport{}
+	err := json.Unmarshal([]byte(cmd.Val()), report)
+	return report, err
+}
+
+// Pool fee split published by unlocker, fees are percents of block reward
+type FeeSchedule struct {
+	Fee         float64         `json:"fee"`
+	FinderBonus float64         `json:"finderBonus"`
+	Recipients  []*FeeRecipient `json:"recipients"`
+	Tiers       []*FeeTier      `json:"tiers,omitempty"`
+	TierWindow  string          `json:"tierWindow,omitempty"`
+}
+
+type FeeRecipient struct {
+	Name    string  `json:"name"`
+	Address string  `json:"address"`
+	Fee     float64 `json:"fee"`
+}
+
+// Fee of miners with average hashrate over tier window at least this
+type FeeTier struct {
+	Hashrate int64   `json:"hashrate"`
+	Fee      float64 `json:"fee"`
+}
+
+// Override of miner takes precedence over tiers, highest tier reached by miner's hashrate applies otherwise
+func (f *FeeSchedule) MinerFee(overrides map[string]float64, login string, hashrate int64) float64 {
+	if fee, ok := overrides[login]; ok {
+		return fee
+	}
+	fee := f.Fee
+	reached := int64(-1)
+	for _, tier := range f.Tiers {
+		if hashrate >= tier.Hashrate && tier.Hashrate > reached {
+			fee, reached = tier.Fee, tier.Hashrate
+		}
+	}
+	return fee
+}
+
+func (r *RedisClient) WriteFeeSchedule(ctx context.Context, fees *FeeSchedule) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	data, err := json.Marshal(fees)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.formatKey("fees"), string(data), 0).Err()
+}
+
+func (r *RedisClient) GetFeeSchedule(ctx context.Context) (*FeeSchedule, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.Get(ctx, r.formatKey("fees"))
+	if cmd.Err() == redis.Nil {
+		return nil, nil
+	} else if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	fees := &FeeSchedule{}
+	err := json.Unmarshal([]byte(cmd.Val()), fees)
+	return fees, err
+}
+
+func (r *RedisClient) SetFeeOverride(ctx context.Context, login string, fee float64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.HSet(ctx, r.formatKey("fees", "overrides"), login, strconv.FormatFloat(fee, 'f', -1, 64)).Err()
+}
+
+func (r *RedisClient) RemoveFeeOverride(ctx context.Context, login string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.HDel(ctx, r.formatKey("fees", "overrides"), login).Err()
+}
+
+func (r *RedisClient) GetFeeOverrides(ctx context.Context) (map[string]float64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.HGetAll(ctx, r.formatKey("fees", "overrides"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertFeeOverrides(cmd.Val()), nil
+}
+
+func convertFeeOverrides(raw map[string]string) map[string]float64 {
+	result := make(map[string]float64)
+	for login, v := range raw {
+		fee, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			result[login] = fee
+		}
+	}
+	return result
+}
+
+// Average hashrate of miners over window, limited by time their hashrate entries are kept
+func (r *RedisClient) GetMinersHashrate(ctx context.Context, logins []string, window time.Duration) (map[string]int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	result := make(map[string]int64)
+	if len(logins) == 0 {
+		return result, nil
+	}
+	seconds := int64(window / time.Second)
+	min := strconv.FormatInt(util.MakeTimestamp()/1000-seconds, 10)
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		for _, login := range logins {
+			tx.ZRangeByScore(ctx, r.formatKey("hashrate", login), &redis.ZRangeBy{Min: min, Max: "+inf"})
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, login := range logins {
+		result[login] = sumHashrate(cmds[i].(*redis.StringSliceCmd).Val()) / seconds
+	}
+	return result, nil
+}
+
+// Sums difficulty of "diff:id:ms" entries of miner's hashrate
+func sumHashrate(members []string) int64 {
+	total := int64(0)
+	for _, v := range members {
+		diff, _ := strconv.ParseInt(strings.Split(v, ":")[0], 10, 64)
+		total += diff
+	}
+	return total
+}
+
+// Matured block whose computed reward differs from coinbase balance change, credited only after operator confirmed it
+type RewardMismatch struct {
+	Round     string `json:"round"`
+	Height    int64  `json:"height"`
+	Hash      string `json:"hash"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Timestamp int64  `json:"timestamp"`
+	Confirmed bool   `json:"confirmed"`
+	// Reward in Wei credited instead of computed one if set by operator
+	Reward string `json:"reward,omitempty"`
+}
+
+func (r *RedisClient) WriteRewardMismatch(ctx context.Context, m *RewardMismatch) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, r.formatKey("rewards", "mismatches"), m.Round, string(data)).Err()
+}
+
+func (r *RedisClient) GetRewardMismatches(ctx context.Context) (map[string]*RewardMismatch, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.HGetAll(ctx, r.formatKey("rewards", "mismatches"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertRewardMismatches(cmd.Val())
+}
+
+func convertRewardMismatches(raw map[string]string) (map[string]*RewardMismatch, error) {
+	result := make(map[string]*RewardMismatch)
+	for round, v := range raw {
+		m := &RewardMismatch{}
+		if err := json.Unmarshal([]byte(v), m); err != nil {
+			return nil, err
+		}
+		result[round] = m
+	}
+	return result, nil
+}
+
+// Returns false if there is no mismatch for round
+func (r *RedisClient) ConfirmRewardMismatch(ctx context.Context, round, reward string) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	key := r.formatKey("rewards", "mismatches")
+	found := false
+	err := r.watch(ctx, func(wtx *redis.Tx) error {
+		cmd := wtx.HGet(ctx, key, round)
+		if cmd.Err() == redis.Nil {
+			return nil
+		} else if cmd.Err() != nil {
+			return cmd.Err()
+		}
+		found = true
+		m := &RewardMismatch{}
+		if err := json.Unmarshal([]byte(cmd.Val()), m); err != nil {
+			return err
+		}
+		m.Confirmed = true
+		m.Reward = reward
+		data, _ := json.Marshal(m)
+		_, err := wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			tx.HSet(ctx, key, round, string(data))
+			return nil
+		})
+		return err
+	}, key)
+	return found, err
+}
+
+func (r *RedisClient) RemoveRewardMismatch(ctx context.Context, round string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.HDel(ctx, r.formatKey("rewards", "mismatches"), round).Err()
+}
+
+// Sorted sets of history growing forever, archiver moves their old entries out of Redis
+var HistoryKeys = []string{"blocks:matured", "credits:all", "payments:all"}
+
+// Per-miner history is kept in "payments:<login>"
+func MinerPaymentsKey(login string) string {
+	return join("payments", login)
+}
+
+// Raw member of history sorted set with timestamp decoded from it
+type HistoryEntry struct {
+	Key       string  `json:"key"`
+	Score     float64 `json:"score"`
+	Member    string  `json:"member"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Blocks and credits are scored by height, so timestamp is taken from record
+func historyTimestamp(key string, z redis.Z) int64 {
+	switch key {
+	case "blocks:matured":
+		return parseBlock(z.Member.(string)).Timestamp
+	case "credits:all":
+		return parseCredit(z.Member.(string)).Timestamp
+	}
+	return int64(z.Score)
+}
+
+func convertHistoryEntries(key string, raw []redis.Z) []*HistoryEntry {
+	result := make([]*HistoryEntry, 0, len(raw))
+	for _, z := range raw {
+		result = append(result, &HistoryEntry{Key: key, Score: z.Score, Member: z.Member.(string), Timestamp: historyTimestamp(key, z)})
+	}
+	return result
+}
+
+func historyRows(entries []*HistoryEntry) []redis.Z {
+	result := make([]redis.Z, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, redis.Z{Score: e.Score, Member: e.Member})
+	}
+	return result
+}
+
+func DecodeBlocks(entries []*HistoryEntry) []*BlockData {
+	return convertBlockResults(historyRows(entries))
+}
+
+func DecodePayments(entries []*HistoryEntry) []map[string]interface{} {
+	return convertPaymentsResults(historyRows(entries))
+}
+
+// Returns page of history newest first and number of entries kept in Redis
+func (r *RedisClient) GetHistory(ctx context.Context, key string, offset, limit int64) ([]*HistoryEntry, int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmds, err := r.client.Pipelined(ctx, func(tx redis.Pipeliner) error {
+		tx.ZRevRangeWithScores(ctx, r.formatKey(key), offset, offset+limit-1)
+		tx.ZCard(ctx, r.formatKey(key))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := convertHistoryEntries(key, cmds[0].(*redis.ZSliceCmd).Val())
+	return entries, cmds[1].(*redis.IntCmd).Val(), nil
+}
+
+// Returns oldest entries of history sorted set
+func (r *RedisClient) GetOldestHistory(ctx context.Context, key string, limit int64) ([]*HistoryEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	cmd := r.client.ZRangeWithScores(ctx, r.formatKey(key), 0, limit-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertHistoryEntries(key, cmd.Val()), nil
+}
+
+// Removed entries are counted as archived, so that total of history is known without reading archive
+func (r *RedisClient) RemoveHistory(ctx context.Context, key string, entries []*HistoryEntry) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.watch(ctx, func(wtx *redis.Tx) error {
+		cmds, err := wtx.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for _, e := range entries {
+				p.ZScore(ctx, r.formatKey(key), e.Member)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		var members []interface{}
+		for i, cmd := range cmds {
+			if cmd.Err() == nil {
+				members = append(members, entries[i].Member)
+			}
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		_, err = wtx.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			tx.ZRem(ctx, r.formatKey(key), members...)
+			tx.HIncrBy(ctx, r.formatKey("history", "archived"), key, int64(len(members)))
+			return nil
+		})
+		return err
+	}, r.formatKey(key))
+}
+
+// Number of entries moved out of history to archive, false if they were never counted
+func (r *RedisClient) GetArchivedCount(ctx context.Context, key string) (int64, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	n, err := r.client.HGet(ctx, r.formatKey("history", "archived"), key).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	return n, err == nil, err
+}
+
+// Counts entries archived before they were counted on removal
+func (r *RedisClient) SetArchivedCount(ctx context.Context, key string, n int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.client.HSetNX(ctx, r.formatKey("history", "archived"), key, n).Err()
+}
+
+// Rewrites legacy colon-joined members of blocks, credits and payments sorted sets as records,
+// unlocker and payouts must be stopped while it runs
+func (r *RedisClient) MigrateRecords(ctx context.Context) (int64, error) {
+	keys := append([]string{}, recordKeys...)
+	logins, err := r.GetPayees(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, login := range logins {
+		keys = append(keys, MinerPaymentsKey(login))
+	}
+
+	total := int64(0)
+	for _, key := range keys {
+		n, err := r.migrateKey(ctx, key)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return total, nil
+}
+
+// Whole set is read at once, migrated members would change order of the set while paging through it
+func (r *RedisClient) migrateKey(ctx context.Context, key string) (int64, error) {
+	readCtx, cancel := r.withTimeout(ctx)
+	rows, err := r.client.ZRangeWithScores(readCtx, r.formatKey(key), 0, -1).Result()
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	remove, add := migrateRows(key, rows)
+
+	total := int64(0)
+	for i := 0; i < len(add); i += migrateBatch {
+		end := i + migrateBatch
+		if end > len(add) {
+			end = len(add)
+		}
+		batchCtx, cancel := r.withTimeout(ctx)
+		_, err := r.client.TxPipelined(batchCtx, func(tx redis.Pipeliner) error {
+			tx.ZRem(batchCtx, r.formatKey(key), remove[i:end]...)
+			tx.ZAdd(batchCtx, r.formatKey(key), add[i:end]...)
+			return nil
+		})
+		cancel()
+		if err != nil {
+			return total, err
+		}
+		total += int64(end - i)
+	}
+	return total, nil
+}
@@ -1,16 +1,22 @@
 package storage
 
 import (
+	"context"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
-	"gopkg.in/redis.v3"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/webchain-network/webchain-pool/util"
 )
 
 var r *RedisClient
 
+var ctx = context.Background()
+
 const prefix = "test"
 
 func TestMain(m *testing.M) {
@@ -24,23 +30,23 @@ func TestMain(m *testing.M) {
 func TestWriteShareCheckExist(t *testing.T) {
 	reset()
 
-	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
+	exist, _ := r.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
+	exist, _ = r.WriteShare(ctx, "x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
+	exist, _ = r.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
+	exist, _ = r.WriteShare(ctx, "z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
 	if !exist {
 		t.Error("PoW must exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
+	exist, _ = r.WriteShare(ctx, "x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
@@ -51,11 +57,11 @@ func TestGetPayees(t *testing.T) {
 
 	n := 256
 	for i := 0; i < n; i++ {
-		r.client.HSet(r.formatKey("miners", strconv.Itoa(i)), "balance", strconv.Itoa(i))
+		r.client.HSet(ctx, r.formatKey("miners", strconv.Itoa(i)), "balance", strconv.Itoa(i))
 	}
 
 	var payees []string
-	payees, _ = r.GetPayees()
+	payees, _ = r.GetPayees(ctx)
 	if len(payees) != n {
 		t.Error("Must return all payees")
 	}
@@ -71,14 +77,14 @@ func TestGetPayees(t *testing.T) {
 func TestGetBalance(t *testing.T) {
 	reset()
 
-	r.client.HSet(r.formatKey("miners:x"), "balance", "750")
+	r.client.HSet(ctx, r.formatKey("miners:x"), "balance", "750")
 
-	v, _ := r.GetBalance("x")
+	v, _ := r.GetBalance(ctx, "x")
 	if v != 750 {
 		t.Error("Must return balance")
 	}
 
-	v, err := r.GetBalance("z")
+	v, err := r.GetBalance(ctx, "z")
 	if v != 0 {
 		t.Error("Must return 0 if account does not exist")
 	}
@@ -90,13 +96,13 @@ func TestGetBalance(t *testing.T) {
 func TestLockPayouts(t *testing.T) {
 	reset()
 
-	r.LockPayouts("x", 1000)
-	v := r.client.Get("test:payments:lock").Val()
+	r.LockPayouts(ctx, "x", 1000)
+	v := r.client.Get(ctx, "test:payments:lock").Val()
 	if v != "x:1000" {
 		t.Errorf("Invalid lock amount: %v", v)
 	}
 
-	err := r.LockPayouts("x", 100)
+	err := r.LockPayouts(ctx, "x", 100)
 	if err == nil {
 		t.Errorf("Must not overwrite lock")
 	}
@@ -105,10 +111,10 @@ func TestLockPayouts(t *testing.T) {
 func TestUnlockPayouts(t *testing.T) {
 	reset()
 
-	r.client.Set(r.formatKey("payments:lock"), "x:1000", 0)
+	r.client.Set(ctx, r.formatKey("payments:lock"), "x:1000", 0)
 
-	r.UnlockPayouts()
-	err := r.client.Get(r.formatKey("payments:lock")).Err()
+	r.UnlockPayouts(ctx)
+	err := r.client.Get(ctx, r.formatKey("payments:lock")).Err()
 	if err != redis.Nil {
 		t.Errorf("Must release lock")
 	}
@@ -117,8 +123,8 @@ func TestUnlockPayouts(t *testing.T) {
 func TestIsPayoutsLocked(t *testing.T) {
 	reset()
 
-	r.LockPayouts("x", 1000)
-	if locked, _ := r.IsPayoutsLocked(); !locked {
+	r.LockPayouts(ctx, "x", 1000)
+	if locked, _ := r.IsPayoutsLocked(ctx); !locked {
 		t.Errorf("Payouts must be locked")
 	}
 }
@@ -126,18 +132,18 @@ func TestIsPayoutsLocked(t *testing.T) {
 func TestUpdateBalance(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "50", "balance": "1000"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000"},
 	)
 
 	amount := int64(250)
-	r.UpdateBalance("x", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	r.UpdateBalance(ctx, "x", amount)
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["pending"] != "250" {
 		t.Error("Must set pending amount")
 	}
@@ -148,7 +154,7 @@ func TestUpdateBalance(t *testing.T) {
 		t.Error("Must not touch paid")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["pending"] != "250" {
 		t.Error("Must set pool pending amount")
 	}
@@ -159,7 +165,7 @@ func TestUpdateBalance(t *testing.T) {
 		t.Error("Must not touch pool paid")
 	}
 
-	rank := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Val()
+	rank := r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Val()
 	if rank != 0 {
 		t.Error("Must add pending payment")
 	}
@@ -168,19 +174,19 @@ func TestUpdateBalance(t *testing.T) {
 func TestRollbackBalance(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000", "pending": "250"},
 	)
-	r.client.ZAdd(r.formatKey("payments:pending"), redis.Z{Score: 1, Member: "xx"})
+	r.client.ZAdd(ctx, r.formatKey("payments:pending"), redis.Z{Score: 1, Member: "xx"})
 
 	amount := int64(250)
-	r.RollbackBalance("x", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	r.RollbackBalance(ctx, "x", amount)
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["paid"] != "100" {
 		t.Error("Must not touch paid")
 	}
@@ -191,7 +197,7 @@ func TestRollbackBalance(t *testing.T) {
 		t.Error("Must deduct pending")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["paid"] != "500" {
 		t.Error("Must not touch pool paid")
 	}
@@ -202,7 +208,7 @@ func TestRollbackBalance(t *testing.T) {
 		t.Error("Must deduct pool pending")
 	}
 
-	err := r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err := r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Err()
 	if err != redis.Nil {
 		t.Errorf("Must remove pending payment")
 	}
@@ -211,18 +217,18 @@ func TestRollbackBalance(t *testing.T) {
 func TestWritePayment(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "50", "balance": "1000", "pending": "250"},
 	)
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("finances"),
 		map[string]string{"paid": "500", "balance": "10000", "pending": "250"},
 	)
 
 	amount := int64(250)
-	r.WritePayment("x", "0x0", amount)
-	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	r.WritePayment(ctx, "x", "0x0", amount)
+	result := r.client.HGetAll(ctx, r.formatKey("miners:x")).Val()
 	if result["pending"] != "0" {
 		t.Error("Must unset pending amount")
 	}
@@ -233,7 +239,7 @@ func TestWritePayment(t *testing.T) {
 		t.Error("Must increase paid")
 	}
 
-	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	result = r.client.HGetAll(ctx, r.formatKey("finances")).Val()
 	if result["pending"] != "0" {
 		t.Error("Must deduct pool pending amount")
 	}
@@ -244,20 +250,20 @@ func TestWritePayment(t *testing.T) {
 		t.Error("Must increase pool paid")
 	}
 
-	err := r.client.Get(r.formatKey("payments:lock")).Err()
+	err := r.client.Get(ctx, r.formatKey("payments:lock")).Err()
 	if err != redis.Nil {
 		t.Errorf("Must release lock")
 	}
 
-	err = r.client.ZRank(r.formatKey("payments:pending"), join("x", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:pending"), join("x", amount)).Err()
 	if err != redis.Nil {
 		t.Error("Must remove pending payment")
 	}
-	err = r.client.ZRank(r.formatKey("payments:all"), join("0x0", "x", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:all"), encodePayment("0x0", "x", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
-	err = r.client.ZRank(r.formatKey("payments:x"), join("0x0", amount)).Err()
+	err = r.client.ZRank(ctx, r.formatKey("payments:x"), encodePayment("0x0", "", amount)).Err()
 	if err == redis.Nil {
 		t.Error("Must add payment to set")
 	}
@@ -266,14 +272,14 @@ func TestWritePayment(t *testing.T) {
 func TestGetPendingPayments(t *testing.T) {
 	reset()
 
-	r.client.HMSetMap(
+	r.client.HSet(ctx,
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
 	)
 
 	amount := int64(1000)
-	r.UpdateBalance("x", amount)
-	pending := r.GetPendingPayments()
+	r.UpdateBalance(ctx, "x", amount)
+	pending := r.GetPendingPayments(ctx)
 
 	if len(pending) != 1 {
 		t.Error("Must return pending payment")
@@ -289,21 +295,124 @@ func TestGetPendingPayments(t *testing.T) {
 	}
 }
 
+func TestAdjustBalance(t *testing.T) {
+	reset()
+
+	r.client.HSet(ctx, r.formatKey("miners:x"), map[string]string{"balance": "1000"})
+	r.client.HSet(ctx, r.formatKey("finances"), map[string]string{"balance": "10000"})
+
+	r.AdjustBalance(ctx, "x", -250, "test")
+	if v := r.client.HGet(ctx, r.formatKey("miners:x"), "balance").Val(); v != "750" {
+		t.Errorf("Must adjust balance: %v", v)
+	}
+	if v := r.client.HGet(ctx, r.formatKey("finances"), "balance").Val(); v != "9750" {
+		t.Errorf("Must adjust pool balance: %v", v)
+	}
+
+	if err := r.AdjustBalance(ctx, "x", -751, "test"); err != ErrInsufficientBalance {
+		t.Errorf("Must reject debit exceeding balance: %v", err)
+	}
+	if v := r.client.HGet(ctx, r.formatKey("miners:x"), "balance").Val(); v != "750" {
+		t.Errorf("Must not change balance on rejected debit: %v", v)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	reset()
+
+	r.client.HSet(ctx, r.formatKey("miners:x"), "balance", "350")
+	r.UpdateBalance(ctx, "x", 250)
+	r.RollbackBalance(ctx, "x", 250)
+	r.UpdateBalance(ctx, "x", 250)
+	r.WritePayment(ctx, "x", "0x0", 250)
+	r.AdjustBalance(ctx, "x", -100, "duplicate credit")
+
+	ledger, err := r.GetLedger(ctx, "x", 0, 10)
+	if err != nil {
+		t.Fatalf("Must read ledger: %v", err)
+	}
+	kinds := []string{}
+	for _, entry := range ledger {
+		kinds = append(kinds, entry.Kind)
+	}
+	if !reflect.DeepEqual(kinds, []string{"adjust", "payment", "debit", "rollback", "debit"}) {
+		t.Errorf("Must record every change, newest first: %v", kinds)
+	}
+	if ledger[0].Amount != -100 || ledger[0].Reason != "duplicate credit" {
+		t.Errorf("Must record adjustment with reason: %+v", ledger[0])
+	}
+	if ledger[1].Tx != "0x0" {
+		t.Errorf("Must record payment tx: %+v", ledger[1])
+	}
+
+	page, _ := r.GetLedger(ctx, "x", 1, 2)
+	if len(page) != 2 || page[0].Kind != "payment" {
+		t.Errorf("Must paginate ledger: %v", page)
+	}
+
+	r.AdjustBalance(withJournal(ctx, 42), "x", 10, "")
+	ledger, _ = r.GetLedger(ctx, "x", 0, 2)
+	if ledger[0].Journal != 42 || ledger[1].Journal != 0 {
+		t.Errorf("Must tag entries with journal record: %+v %+v", ledger[0], ledger[1])
+	}
+}
+
+func TestGetBans(t *testing.T) {
+	reset()
+
+	r.AddBan(ctx, "127.0.0.1", 0)
+	r.AddBan(ctx, "127.0.0.2", 60)
+	r.client.ZAdd(ctx, r.formatKey("bans"), redis.Z{Score: 1, Member: "127.0.0.3"})
+
+	bans, _ := r.GetBans(ctx)
+	if len(bans) != 2 || bans["127.0.0.1"] != 0 || bans["127.0.0.2"] < util.MakeTimestamp()/1000+59 {
+		t.Errorf("Must return active bans only with their expiry: %v", bans)
+	}
+
+	r.RemoveBan(ctx, "127.0.0.1")
+	bans, _ = r.GetBans(ctx)
+	if _, ok := bans["127.0.0.2"]; len(bans) != 1 || !ok {
+		t.Errorf("Must remove ban: %v", bans)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	reset()
+
+	r.WriteAuditEntry(ctx, &AuditEntry{Source: "cli", Action: "ban.add", Target: "127.0.0.1"})
+	r.WriteAuditEntry(ctx, &AuditEntry{Source: "cli", Action: "ban.remove", Target: "127.0.0.1"})
+
+	entries, _ := r.GetAuditLog(ctx, 0, 10)
+	if len(entries) != 2 {
+		t.Fatalf("Must return all entries: %v", len(entries))
+	}
+	if entries[0].Action != "ban.remove" || entries[1].Action != "ban.add" {
+		t.Error("Must return newest entries first")
+	}
+	if entries[0].Timestamp <= 0 {
+		t.Error("Must set timestamp")
+	}
+	entries, _ = r.GetAuditLog(ctx, 1, 10)
+	if len(entries) != 1 || entries[0].Action != "ban.add" {
+		t.Error("Must paginate entries")
+	}
+}
+
 func TestCollectLuckStats(t *testing.T) {
 	reset()
 
 	members := []redis.Z{
 		redis.Z{Score: 0, Member: "1:0:0x0:0x0:0:100:100:0"},
 	}
-	r.client.ZAdd(r.formatKey("blocks:immature"), members...)
+	r.client.ZAdd(ctx, r.formatKey("blocks:immature"), members...)
 	members = []redis.Z{
 		redis.Z{Score: 1, Member: "1:0:0x2:0x0:0:50:100:0"},
 		redis.Z{Score: 2, Member: "0:1:0x1:0x0:0:100:100:0"},
 		redis.Z{Score: 3, Member: "0:0:0x3:0x0:0:200:100:0"},
 	}
-	r.client.ZAdd(r.formatKey("blocks:matured"), members...)
+	r.client.ZAdd(ctx, r.formatKey("blocks:matured"), members...)
 
-	stats, _ := r.CollectLuckStats([]int{1, 2, 5, 10})
+	stats, _ := r.CollectLuckStats(ctx, []int{1, 2, 5, 10})
 	expectedStats := map[string]interface{}{
 		"1": map[string]float64{
 			"luck": 1, "uncleRate": 1, "orphanRate": 0,
@@ -321,9 +430,251 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestRoundEffort(t *testing.T) {
+	reset()
+
+	r.WriteShare(ctx, "x", "rig", []string{"0x0", "0x0", "0x0"}, 3000, 100, 0)
+	if !r.client.HExists(ctx, r.formatKey("stats"), "roundStart").Val() {
+		t.Fatal("First share must start the round")
+	}
+	r.client.HSet(ctx, r.formatKey("stats"), "roundStart", "1")
+	r.WriteBlock(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 2000, 4000, 101, 0, nil)
+	candidates, _ := r.GetCandidates(ctx, 101)
+	if len(candidates) != 1 || candidates[0].Effort != 1.25 {
+		t.Fatalf("Must store effort of round with candidate: %+v", candidates)
+	}
+	start, _ := r.client.HGet(ctx, r.formatKey("stats"), "roundStart").Int64()
+	if start <= 1 {
+		t.Error("Block must start new round")
+	}
+}
+
+func TestHashrateSnapshot(t *testing.T) {
+	reset()
+
+	r.WriteShare(ctx, "x", "rig1", []string{"0x1", "0x0", "0x0"}, 600, 100, time.Hour)
+	r.WriteShare(ctx, "x", "rig1", []string{"0x2", "0x0", "0x0"}, 1200, 100, time.Hour)
+	r.WriteShare(ctx, "x", "rig2", []string{"0x3", "0x0", "0x0"}, 600, 100, time.Hour)
+	r.WriteShare(ctx, "z", "rig1", []string{"0x4", "0x0", "0x0"}, 600, 100, time.Hour)
+
+	written, err := r.WriteHashrateSnapshot(ctx, 30*time.Minute, 10*time.Minute)
+	if err != nil || !written {
+		t.Fatalf("Must write snapshot: %v", err)
+	}
+	written, _ = r.WriteHashrateSnapshot(ctx, 30*time.Minute, 10*time.Minute)
+	if written {
+		t.Error("Snapshot of the same interval must be written once")
+	}
+
+	pool, _ := r.GetHashrateChart(ctx, "", 24*time.Hour)
+	if len(pool) != 1 || pool[0].Hashrate != 5 || pool[0].Shares != 4 || pool[0].Miners != 2 || pool[0].WorkersOnline != 3 {
+		t.Fatalf("Must write pool's point: %+v", pool)
+	}
+	miner, _ := r.GetHashrateChart(ctx, "x", 24*time.Hour)
+	expected := map[string]*WorkerPoint{"rig1": {Hashrate: 3, Shares: 2}, "rig2": {Hashrate: 1, Shares: 1}}
+	if len(miner) != 1 || miner[0].Hashrate != 4 || !reflect.DeepEqual(miner[0].Workers, expected) {
+		t.Fatalf("Must write miner's point: %+v", miner)
+	}
+}
+
+func TestCompactChart(t *testing.T) {
+	reset()
+
+	now := util.MakeTimestamp() / 1000
+	hour := now - now%3600
+	raw, hourly := chartSeriesList[0], chartSeriesList[1]
+	points := []*ChartPoint{
+		{Timestamp: hour - 7200, Hashrate: 50, Shares: 1},
+		{Timestamp: hour - 3600, Hashrate: 100, Shares: 1, Workers: map[string]*WorkerPoint{"rig": {Hashrate: 100, Shares: 1}}},
+		{Timestamp: hour - 3000, Hashrate: 200, Shares: 2},
+		// Current hour is not complete yet
+		{Timestamp: hour, Hashrate: 400, Shares: 4},
+	}
+	for _, p := range points {
+		r.client.ZAdd(ctx, r.formatKey(chartKey(raw.name, "x")), redis.Z{Score: float64(p.Timestamp), Member: encodeChartPoint(p)})
+	}
+	r.client.ZAdd(ctx, r.formatKey("charts", "miners"), redis.Z{Score: float64(hour), Member: "x"})
+	r.client.HSet(ctx, r.formatKey("charts", "compacted"), hourly.name, strconv.FormatInt(hour-3600, 10))
+
+	for i := 0; i < 2; i++ {
+		if err := r.compactChart(ctx, raw, hourly, now); err != nil {
+			t.Fatalf("Must compact chart: %v", err)
+		}
+	}
+	rows, _ := r.client.ZRange(ctx, r.formatKey(chartKey(hourly.name, "x")), 0, -1).Result()
+	expected := []*ChartPoint{
+		{Timestamp: hour - 3600, Hashrate: 150, Shares: 3, Workers: map[string]*WorkerPoint{"rig": {Hashrate: 50, Shares: 1}}},
+	}
+	if result := convertChartPoints(rows); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Must average hour which is not compacted yet: %+v", result)
+	}
+	last, _ := r.client.HGet(ctx, r.formatKey("charts", "compacted"), hourly.name).Int64()
+	if last != hour {
+		t.Errorf("Must record compacted range, got %v", last)
+	}
+}
+
+func TestNetworkHistory(t *testing.T) {
+	reset()
+
+	now := util.MakeTimestamp() / 1000
+	ts := now - now%networkHistoryStep
+	r.WriteNetworkStats(ctx, &NetworkStats{Timestamp: ts - networkHistoryStep, Height: 1})
+	r.WriteNetworkStats(ctx, &NetworkStats{Timestamp: ts, Height: 2})
+	r.WriteNetworkStats(ctx, &NetworkStats{Timestamp: ts + 1, Height: 3})
+
+	history, err := r.GetNetworkHistory(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Must read network history: %v", err)
+	}
+	if len(history) != 2 || history[0].Height != 1 || history[1].Height != 3 {
+		t.Errorf("Must keep the last stats of each step: %+v", history)
+	}
+}
+
+func TestWriteBlockDelay(t *testing.T) {
+	reset()
+
+	submit := &BlockSubmit{Upstream: "main"}
+	r.WriteBlock(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 2000, 4000, 101, 0, submit)
+	r.WriteBlock(ctx, "x", "rig", []string{"0x2", "0x0", "0x0"}, 2000, 4000, 101, 0, submit)
+	if err := r.WriteBlockDelay(ctx, 101, "0x2", 250); err != nil {
+		t.Fatalf("Must write delay: %v", err)
+	}
+	r.WriteBlockDelay(ctx, 102, "0x1", 300)
+
+	candidates, _ := r.GetCandidates(ctx, 102)
+	delays := map[string]int64{}
+	for _, c := range candidates {
+		delays[c.Nonce] = c.Delay
+		if c.Upstream != "main" {
+			t.Errorf("Must keep candidate's fields: %+v", c)
+		}
+	}
+	if len(candidates) != 2 || delays["0x1"] != 0 || delays["0x2"] != 250 {
+		t.Errorf("Must set delay of matching candidate only: %v", delays)
+	}
+}
+
+func TestCollectBlockStats(t *testing.T) {
+	reset()
+
+	r.WriteBlock(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 100, 5000, 10, 0, &BlockSubmit{Upstream: "main", Delay: 40})
+	candidates, _ := r.GetCandidates(ctx, 100)
+	if len(candidates) != 1 || candidates[0].Upstream != "main" || candidates[0].Delay != 40 {
+		t.Fatalf("Must write submit details of candidate: %+v", candidates)
+	}
+	candidates[0].Orphan = true
+	r.WriteOrphan(ctx, candidates[0])
+
+	now := util.MakeTimestamp() / 1000
+	members := []redis.Z{
+		{Score: 11, Member: encodeRecord(&blockRecord{Nonce: "0x2", Upstream: "main", Delay: 20, Timestamp: now})},
+		{Score: 12, Member: encodeRecord(&blockRecord{Nonce: "0x3", Upstream: "backup", UncleHeight: 11, Timestamp: now})},
+		{Score: 5, Member: encodeRecord(&blockRecord{Nonce: "0x4", Timestamp: now - 86400})},
+		{Score: 4, Member: encodeRecord(&blockRecord{Nonce: "0x5", Timestamp: now - 3*86400})},
+	}
+	r.client.ZAdd(ctx, r.formatKey("blocks:matured"), members...)
+
+	stats, err := r.CollectBlockStats(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Days) != 2 || stats.Days[1].Day != now-now%86400 {
+		t.Fatalf("Must return series of days oldest first: %+v", stats.Days)
+	}
+	today := stats.Days[1]
+	if today.Blocks != 3 || today.Orphans != 1 || today.Uncles != 1 || today.Delay != 30 {
+		t.Errorf("Must count today's blocks: %+v", today.BlockRateStats)
+	}
+	if stats.Days[0].Blocks != 1 || stats.Days[0].Upstreams["unknown"].Blocks != 1 {
+		t.Errorf("Must count yesterday's blocks: %+v", stats.Days[0])
+	}
+	if main := stats.Upstreams["main"]; main.Blocks != 2 || main.OrphanRate != 0.5 || main.Delay != 30 {
+		t.Errorf("Must count blocks by upstream: %+v", main)
+	}
+	if backup := stats.Upstreams["backup"]; backup.UncleRate != 1 {
+		t.Errorf("Must count uncles by upstream: %+v", backup)
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	reset()
+
+	r.client.HSet(ctx, r.formatKey("miners:x"), "balance", "0")
+	r.client.ZAdd(ctx, r.formatKey("blocks:matured"), redis.Z{Score: 10, Member: "0:1:0x1:0xa:1500:100:200:5000"})
+	r.client.ZAdd(ctx, r.formatKey("blocks:candidates"), redis.Z{Score: 11, Member: "0x2:0xb:0xc:1600:100:50"})
+	r.client.ZAdd(ctx, r.formatKey("credits:all"), redis.Z{Score: 10, Member: "0xa:1700:5000"})
+	r.client.ZAdd(ctx, r.formatKey("payments:all"), redis.Z{Score: 1800, Member: "0xd:x:750"})
+	r.client.ZAdd(ctx, r.formatKey("payments:x"), redis.Z{Score: 1800, Member: "0xd:750"})
+	r.WritePayment(ctx, "x", "0xe", 250)
+
+	total, err := r.MigrateRecords(ctx)
+	if err != nil || total != 5 {
+		t.Fatalf("Must migrate legacy members only: %v, %v", total, err)
+	}
+	if total, _ := r.MigrateRecords(ctx); total != 0 {
+		t.Errorf("Must not migrate records twice: %v", total)
+	}
+
+	blocks, _ := r.GetMaturedBlocks(ctx, 10)
+	if len(blocks) != 1 || !blocks[0].Orphan || blocks[0].Hash != "0xa" || blocks[0].TotalShares != 200 || blocks[0].RewardString != "5000" {
+		t.Errorf("Must keep block fields: %+v", blocks[0])
+	}
+	candidates, _ := r.GetCandidates(ctx, 100)
+	if len(candidates) != 1 || candidates[0].PowHash != "0xb" || candidates[0].Timestamp != 1600 {
+		t.Errorf("Must keep candidate fields: %+v", candidates[0])
+	}
+	history, _, _ := r.GetHistory(ctx, "credits:all", 0, 10)
+	if len(history) != 1 || history[0].Timestamp != 1700 {
+		t.Errorf("Must keep credit fields: %+v", history)
+	}
+	stats, _ := r.GetMinerStats(ctx, "x", 10)
+	payments := stats["payments"].([]map[string]interface{})
+	if len(payments) != 2 || payments[1]["tx"] != "0xd" || payments[1]["amount"] != int64(750) {
+		t.Errorf("Must keep payment fields: %v", payments)
+	}
+}
+
+func TestBlockFinder(t *testing.T) {
+	reset()
+
+	r.WriteBlock(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 100, 5000, 10, 0, nil)
+	candidates, _ := r.GetCandidates(ctx, 100)
+	if len(candidates) != 1 || candidates[0].Finder != "x" || candidates[0].Worker != "rig" {
+		t.Fatalf("Must write finder of candidate: %+v", candidates)
+	}
+
+	block := candidates[0]
+	block.Orphan = true
+	r.WriteOrphan(ctx, block)
+	blocks, _ := r.GetMaturedBlocks(ctx, 10)
+	if len(blocks) != 1 || !blocks[0].Orphan || blocks[0].Finder != "x" || blocks[0].Worker != "rig" {
+		t.Errorf("Must keep finder of orphaned block: %+v", blocks)
+	}
+}
+
+func TestFeeOverrides(t *testing.T) {
+	reset()
+
+	r.SetFeeOverride(ctx, "x", 0.25)
+	r.SetFeeOverride(ctx, "y", 0)
+	r.RemoveFeeOverride(ctx, "y")
+	overrides, _ := r.GetFeeOverrides(ctx)
+	if !reflect.DeepEqual(overrides, map[string]float64{"x": 0.25}) {
+		t.Errorf("Must keep fee overrides: %v", overrides)
+	}
+
+	r.WriteShare(ctx, "x", "rig", []string{"0x1", "0x0", "0x0"}, 6000, 10, time.Minute)
+	hashrates, _ := r.GetMinersHashrate(ctx, []string{"x", "z"}, time.Minute)
+	if hashrates["x"] != 100 || hashrates["z"] != 0 {
+		t.Errorf("Must average miners' hashrate over window: %v", hashrates)
+	}
+}
+
 func reset() {
-	keys := r.client.Keys(r.prefix + ":*").Val()
+	keys := r.client.Keys(ctx, r.formatKey("*")).Val()
 	for _, k := range keys {
-		r.client.Del(k)
+		r.client.Del(ctx, k)
 	}
 }
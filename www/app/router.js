@@ -9,6 +9,7 @@ var Router = Ember.Router.extend(googlePageview, {
 Router.map(function() {
   this.route('account', { path: '/account/:login' }, function() {
     this.route('payouts');
+    this.route('blocks');
   });
   this.route('not-found');
 
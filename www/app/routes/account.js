@@ -1,4 +1,5 @@
 import Ember from 'ember';
+import Block from "../models/block";
 import config from '../config/environment';
 
 export default Ember.Route.extend({
@@ -6,6 +7,12 @@ export default Ember.Route.extend({
 		var url = config.APP.ApiUrl + 'api/accounts/' + params.login;
     return Ember.$.getJSON(url).then(function(data) {
       data.login = params.login;
+      data.hasFee = data.fee !== null && data.fee !== undefined;
+      if (data.blocks) {
+        data.blocks = data.blocks.map(function(b) {
+          return Block.create(b);
+        });
+      }
       return Ember.Object.create(data);
     });
 	},